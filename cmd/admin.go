@@ -0,0 +1,174 @@
+/*
+Copyright © 2024 Rafael Barbeta rafa.barbeta@gmail.com
+*/
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/tracker"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/utils"
+	"github.com/spf13/cobra"
+)
+
+// adminCmd represents the admin command
+var adminCmd = &cobra.Command{
+	Use:   "admin",
+	Short: "Administer a running tracker",
+	Long: `Talks to the admin API of a 'MicroTorr tracker' started with --admin-token.
+
+The token is given with --token, or in the ` + tracker.ADMIN_TOKEN_ENV + ` environment variable.`,
+}
+
+var adminPeersCmd = &cobra.Command{
+	Use:   "peers",
+	Short: "List the active peers of every swarm",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		swarmId, _ := cmd.Flags().GetString("swarm")
+		peers, err := adminClient(cmd).Peers(swarmId)
+		exitOnError(err)
+		fmt.Printf("%-10s %-20s %-40s %6s %12s  %s\n", "SWARM", "PEER", "ADDRESS", "SEEDER", "LEFT", "LAST SEEN")
+		for _, peer := range peers {
+			addrs := make([]string, 0, 2)
+			if peer.Ip != "" {
+				addrs = append(addrs, utils.JoinHostPort(peer.Ip, peer.Port))
+			}
+			if peer.Ip6 != "" {
+				addrs = append(addrs, utils.JoinHostPort(peer.Ip6, peer.Port))
+			}
+			left := "unknown"
+			if peer.Left >= 0 {
+				left = fmt.Sprint(peer.Left)
+			}
+			lastSeen := "unknown"
+			if !peer.LastSeen.IsZero() {
+				lastSeen = time.Since(peer.LastSeen).Truncate(time.Second).String() + " ago"
+			}
+			seeder := "no"
+			if peer.Seeder {
+				seeder = "yes"
+			}
+			fmt.Printf("%-10s %-20s %-40s %6s %12s  %s\n", peer.Swarm[:min(len(peer.Swarm), 10)], peer.Id,
+				strings.Join(addrs, " "), seeder, left, lastSeen)
+		}
+	},
+}
+
+var adminRemoveSwarmCmd = &cobra.Command{
+	Use:   "remove-swarm id",
+	Short: "Remove a swarm and all its peers",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitOnError(adminClient(cmd).RemoveSwarm(args[0]))
+	},
+}
+
+var adminBanCmd = &cobra.Command{
+	Use:   "ban peer-id|ip|cidr",
+	Short: "Ban a peer id or an IP range, removing the peers it matches",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitOnError(adminClient(cmd).Ban(parseBan(args[0])))
+	},
+}
+
+var adminUnbanCmd = &cobra.Command{
+	Use:   "unban peer-id|ip|cidr",
+	Short: "Lift a ban",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitOnError(adminClient(cmd).Unban(parseBan(args[0])))
+	},
+}
+
+var adminBansCmd = &cobra.Command{
+	Use:   "bans",
+	Short: "List the banned peer ids and IP ranges",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		bans, err := adminClient(cmd).Bans()
+		exitOnError(err)
+		for _, peerId := range bans.Peers {
+			fmt.Println("peer", peerId)
+		}
+		for _, cidr := range bans.Nets {
+			fmt.Println("net ", cidr)
+		}
+	},
+}
+
+var adminWhitelistCmd = &cobra.Command{
+	Use:   "whitelist",
+	Short: "List the torrents allowed by the tracker",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		reload, _ := cmd.Flags().GetBool("reload")
+		client := adminClient(cmd)
+		var whitelisted tracker.Whitelisted
+		var err error
+		if reload {
+			whitelisted, err = client.ReloadWhitelist()
+		} else {
+			whitelisted, err = client.Whitelist()
+		}
+		exitOnError(err)
+		if whitelisted.Dir == "" {
+			fmt.Println("No whitelist, every torrent is allowed")
+			return
+		}
+		fmt.Printf("%d torrents allowed from %s\n", len(whitelisted.Ids), whitelisted.Dir)
+		for _, id := range whitelisted.Ids {
+			fmt.Println(id)
+		}
+	},
+}
+
+func adminClient(cmd *cobra.Command) *tracker.AdminClient {
+	trackerUrl, _ := cmd.Flags().GetString("tracker")
+	token, _ := cmd.Flags().GetString("token")
+	if token == "" {
+		token = os.Getenv(tracker.ADMIN_TOKEN_ENV)
+	}
+	if token == "" {
+		exitOnError(fmt.Errorf("no admin token, use --token or %s", tracker.ADMIN_TOKEN_ENV))
+	}
+	caFile, _ := cmd.Flags().GetString("tracker-ca")
+	certFile, _ := cmd.Flags().GetString("tracker-cert")
+	keyFile, _ := cmd.Flags().GetString("tracker-key")
+	tlsConfig, err := tracker.ClientTLS(caFile, certFile, keyFile)
+	exitOnError(err)
+	return tracker.NewAdminClient(trackerUrl, token, tlsConfig)
+}
+
+// Flags of the TLS of HTTPS trackers, shared by the commands that announce or talk to them
+func addTrackerTLSFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().String("tracker-ca", "", "PEM bundle of the CAs to verify HTTPS trackers with, instead of the system ones")
+	cmd.PersistentFlags().String("tracker-cert", "", "Client certificate presented to HTTPS trackers that require one, with --tracker-key")
+	cmd.PersistentFlags().String("tracker-key", "", "Key of --tracker-cert")
+}
+
+// IPs and CIDR ranges are banned as ranges, anything else as a peer id
+func parseBan(value string) tracker.Ban {
+	if net.ParseIP(value) != nil {
+		return tracker.Ban{Net: value}
+	}
+	if _, _, err := net.ParseCIDR(value); err == nil {
+		return tracker.Ban{Net: value}
+	}
+	return tracker.Ban{Peer: value}
+}
+
+func init() {
+	rootCmd.AddCommand(adminCmd)
+	adminCmd.PersistentFlags().String("tracker", "http://127.0.0.1:8888", "URL of the tracker")
+	adminCmd.PersistentFlags().String("token", "", "Admin token of the tracker. Also read from $"+tracker.ADMIN_TOKEN_ENV)
+	addTrackerTLSFlags(adminCmd)
+	adminCmd.AddCommand(adminPeersCmd, adminRemoveSwarmCmd, adminBanCmd, adminUnbanCmd, adminBansCmd, adminWhitelistCmd)
+	adminPeersCmd.Flags().String("swarm", "", "Only list the peers of this swarm")
+	adminWhitelistCmd.Flags().Bool("reload", false, "Load the whitelist again from its directory first")
+}
@@ -25,18 +25,21 @@ to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		tracker, _ := cmd.Flags().GetString("tracker")
 		pieceLength, _ := cmd.Flags().GetInt("pieceLength")
-		verbose, _ := cmd.Flags().GetInt("verbose")
 		if len(args) < 1 {
 			fmt.Println("Error: You need to specify a file to create torrent from")
 			os.Exit(1)
 		}
-		mtorr.GenMtorrent(args[0], tracker, pieceLength, verbose)
+		err := mtorr.GenMtorrent(args[0], tracker, pieceLength)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(createMtorrCmd)
-	createMtorrCmd.Flags().StringP("tracker", "t", "http://127.0.0.1:8888", "Specify a URL tracker for this file")
+	createMtorrCmd.Flags().StringP("tracker", "t", "http://127.0.0.1:8888", "Specify a URL tracker for this file. Empty for a trackerless (DHT only) file")
 	createMtorrCmd.Flags().IntP("pieceLength", "l", 16000, "Specify the length of each piece. Default: 16KB")
 	createMtorrCmd.Flags().IntP("verbose", "v", 0, "Choses verbosity level.")
 }
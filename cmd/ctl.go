@@ -0,0 +1,162 @@
+/*
+Copyright © 2024 Rafael Barbeta rafa.barbeta@gmail.com
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/control"
+	"github.com/spf13/cobra"
+)
+
+// ctlCmd represents the ctl command
+var ctlCmd = &cobra.Command{
+	Use:   "ctl",
+	Short: "Control a running MicroTorr",
+	Long: `Talks to the control API of a running 'MicroTorr daemon', or of a
+'MicroTorr download' started with --control.
+
+Torrents are selected by their id, or by an unique prefix of it, as shown by 'MicroTorr ctl list'.`,
+}
+
+var ctlListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List torrents with their progress, peers and rates",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		torrents, err := ctlClient(cmd).List()
+		exitOnError(err)
+		fmt.Printf("%-10s %-24s %8s %6s %12s %12s  %s\n", "ID", "NAME", "DONE", "PEERS", "DOWN", "UP", "STATE")
+		for _, torrent := range torrents {
+			state := "downloading"
+			if torrent.Paused {
+				state = "paused"
+			} else if torrent.Seeding {
+				state = "seeding"
+			}
+			fmt.Printf("%-10s %-24s %7.1f%% %6d %7.1f KB/s %7.1f KB/s  %s\n",
+				torrent.Id[:10], torrent.Name, torrent.Progress, torrent.Peers,
+				torrent.DownRate/1000, torrent.UpRate/1000, state)
+		}
+	},
+}
+
+var ctlAddCmd = &cobra.Command{
+	Use:   "add file.mtorrent",
+	Short: "Add a torrent to the running client",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		seed, _ := cmd.Flags().GetString("seed")
+		autoSeed, _ := cmd.Flags().GetBool("auto-seed")
+		lazySeed, _ := cmd.Flags().GetBool("lazy")
+		seedRatio, _ := cmd.Flags().GetFloat64("seed-ratio")
+		seedTime, _ := cmd.Flags().GetDuration("seed-time")
+		priorities, _ := cmd.Flags().GetStringSlice("priority")
+		// The client may be running in another directory
+		path, err := filepath.Abs(args[0])
+		exitOnError(err)
+		if seed != "" {
+			seed, err = filepath.Abs(seed)
+			exitOnError(err)
+		}
+		request := control.AddRequest{Path: path, Seed: seed, AutoSeed: autoSeed, LazySeed: lazySeed, SeedRatio: seedRatio, Priorities: priorities}
+		if seedTime > 0 {
+			request.SeedTime = seedTime.String()
+		}
+		exitOnError(ctlClient(cmd).Add(request))
+	},
+}
+
+var ctlPauseCmd = &cobra.Command{
+	Use:   "pause id",
+	Short: "Stop downloading and uploading a torrent, keeping the pieces already downloaded",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		closeConns, _ := cmd.Flags().GetBool("close")
+		exitOnError(ctlClient(cmd).Pause(args[0], closeConns))
+	},
+}
+
+var ctlResumeCmd = &cobra.Command{
+	Use:   "resume id",
+	Short: "Continue downloading a paused torrent",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitOnError(ctlClient(cmd).Resume(args[0]))
+	},
+}
+
+var ctlPriorityCmd = &cobra.Command{
+	Use:   "priority id priority:pieces...",
+	Short: "Change the download priority of piece ranges, such as high:0-9 or skip:100-",
+	Long: `Changes the download priority of piece ranges of a torrent. Priorities are skip, low,
+normal and high. Skipped pieces are not downloaded, and once all other pieces are,
+the file is written with the skipped ranges left empty. Torrents hold a single file,
+so priorities are only set by piece.`,
+	Args: cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitOnError(ctlClient(cmd).SetPriorities(args[0], args[1:]))
+	},
+}
+
+var ctlRemoveCmd = &cobra.Command{
+	Use:   "remove id",
+	Short: "Leave the swarm of a torrent",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		deleteData, _ := cmd.Flags().GetBool("data")
+		exitOnError(ctlClient(cmd).Remove(args[0], deleteData))
+	},
+}
+
+var ctlLimitsCmd = &cobra.Command{
+	Use:   "limits",
+	Short: "Show or change the global speed limits",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		client := ctlClient(cmd)
+		limits, err := client.Limits()
+		exitOnError(err)
+		if cmd.Flags().Changed("max-down-speed") || cmd.Flags().Changed("max-up-speed") {
+			if cmd.Flags().Changed("max-down-speed") {
+				limits.MaxDownSpeed, _ = cmd.Flags().GetInt("max-down-speed")
+			}
+			if cmd.Flags().Changed("max-up-speed") {
+				limits.MaxUpSpeed, _ = cmd.Flags().GetInt("max-up-speed")
+			}
+			exitOnError(client.SetLimits(limits))
+		}
+		fmt.Printf("Down: %d KB/s Up: %d KB/s (0 for no limit)\n", limits.MaxDownSpeed, limits.MaxUpSpeed)
+	},
+}
+
+func ctlClient(cmd *cobra.Command) *control.Client {
+	socket, _ := cmd.Flags().GetString("socket")
+	return control.NewClient(socket)
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(ctlCmd)
+	ctlCmd.PersistentFlags().String("socket", control.DefaultSocket(), "Unix socket of the control API")
+	ctlCmd.AddCommand(ctlListCmd, ctlAddCmd, ctlPauseCmd, ctlResumeCmd, ctlPriorityCmd, ctlRemoveCmd, ctlLimitsCmd)
+	ctlAddCmd.Flags().StringP("seed", "s", "", "Seed the torrent with specified complete file")
+	ctlAddCmd.Flags().BoolP("auto-seed", "a", true, "Wether to seed the file after download or not")
+	ctlAddCmd.Flags().Bool("lazy", false, "With --seed, hash the file while seeding instead of loading it first. Pieces that do not match are downloaded")
+	ctlAddCmd.Flags().Float64("seed-ratio", 0, "Leave the swarm once uploaded/downloaded reaches this ratio. 0 for no goal")
+	ctlAddCmd.Flags().Duration("seed-time", 0, "Leave the swarm after seeding this long, such as 1h30m. 0 for no goal")
+	ctlAddCmd.Flags().StringSlice("priority", []string{}, "Download priority of piece ranges, such as high:0-9 or skip:100- (skip, low, normal or high). Torrents hold a single file, so there are no per file priorities")
+	ctlPauseCmd.Flags().Bool("close", false, "Also disconnect from the peers until resumed")
+	ctlRemoveCmd.Flags().Bool("data", false, "Also delete the downloaded file")
+	ctlLimitsCmd.Flags().IntP("max-down-speed", "d", 0, "New maximum download speed in KB/s. 0 for no limit")
+	ctlLimitsCmd.Flags().IntP("max-up-speed", "u", 0, "New maximum upload speed in KB/s. 0 for no limit")
+}
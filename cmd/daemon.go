@@ -0,0 +1,188 @@
+/*
+Copyright © 2024 Rafael Barbeta rafa.barbeta@gmail.com
+*/
+package cmd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/bandwidth"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/control"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/core"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/downloader"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/events"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/metrics"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/mtorr"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/tracker"
+	"github.com/spf13/cobra"
+)
+
+// daemonCmd represents the daemon command
+var daemonCmd = &cobra.Command{
+	Use:   "daemon [file.mtorrent...]",
+	Short: "Run many torrents in one process",
+	Long: `Runs all the given torrents at once, sharing the listening port,
+the speed limits and the DHT node.
+
+The torrents are downloaded to the current directory. With --seed-existing, those whose
+file is already there are seeded instead.
+
+The daemon runs in the foreground until it receives SIGINT or SIGTERM, and does not detach
+itself: run it under systemd or another supervisor to keep it in the background. Use
+'MicroTorr ctl' to add, pause and remove torrents while it runs.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		intNet, _ := cmd.Flags().GetString("interface")
+		port, _ := cmd.Flags().GetString("port")
+		autoSeed, _ := cmd.Flags().GetBool("auto-seed")
+		lazySeed, _ := cmd.Flags().GetBool("lazy")
+		seedRatio, _ := cmd.Flags().GetFloat64("seed-ratio")
+		seedTime, _ := cmd.Flags().GetDuration("seed-time")
+		maxDownSpeed, _ := cmd.Flags().GetInt("max-down-speed")
+		maxUpSpeed, _ := cmd.Flags().GetInt("max-up-speed")
+		maxPeerDownSpeed, _ := cmd.Flags().GetInt("max-peer-down-speed")
+		maxPeerUpSpeed, _ := cmd.Flags().GetInt("max-peer-up-speed")
+		scheduleFile, _ := cmd.Flags().GetString("schedule")
+		useDht, _ := cmd.Flags().GetBool("dht")
+		dhtPort, _ := cmd.Flags().GetString("dht-port")
+		dhtBootstrap, _ := cmd.Flags().GetStringSlice("dht-bootstrap")
+		useLpd, _ := cmd.Flags().GetBool("lpd")
+		controlSocket, _ := cmd.Flags().GetString("control")
+		onComplete, _ := cmd.Flags().GetString("on-complete")
+		metricsAddr, _ := cmd.Flags().GetString("metrics")
+		trackerCA, _ := cmd.Flags().GetString("tracker-ca")
+		trackerCert, _ := cmd.Flags().GetString("tracker-cert")
+		trackerKey, _ := cmd.Flags().GetString("tracker-key")
+		seedExisting, _ := cmd.Flags().GetBool("seed-existing")
+		var err error
+		if intNet != "" {
+			_, err = net.InterfaceByName(intNet)
+		}
+		if err != nil {
+			fmt.Println("Error: Interface not found")
+			os.Exit(1)
+		}
+		portInt, err := strconv.Atoi(port)
+		if portInt >= 65535 || err != nil {
+			fmt.Println("Error: Invalid port")
+			os.Exit(1)
+		}
+		if seedRatio < 0 || seedTime < 0 {
+			fmt.Println("Error: seed-ratio and seed-time must not be negative")
+			os.Exit(1)
+		}
+		if maxDownSpeed < -1 || maxUpSpeed < -1 || maxPeerDownSpeed < -1 || maxPeerUpSpeed < -1 {
+			fmt.Println("Error: speed limits must be greater than -1")
+			os.Exit(1)
+		}
+		var trackerTLS *tls.Config
+		if trackerCA != "" || trackerCert != "" {
+			trackerTLS, err = tracker.ClientTLS(trackerCA, trackerCert, trackerKey)
+			if err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+		}
+		var schedule *bandwidth.Schedule
+		if scheduleFile != "" {
+			loaded, err := bandwidth.LoadSchedule(scheduleFile)
+			if err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			schedule = &loaded
+		}
+		mtorrents := make([]mtorr.Mtorrent, 0, len(args))
+		for _, file := range args {
+			mtorrent, err := mtorr.LoadMtorrent(file)
+			if err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			if mtorrent.Announce == "" && !useDht && !useLpd {
+				fmt.Println("Error:", file, "has no tracker, use --dht or --lpd to find peers")
+				os.Exit(1)
+			}
+			mtorrents = append(mtorrents, mtorrent)
+		}
+
+		bus := events.NewBus()
+		if onComplete != "" {
+			bus.Subscribe(events.Hook(onComplete), events.DOWNLOAD_COMPLETED)
+		}
+		session, err := downloader.NewSession(intNet, port, maxDownSpeed, maxUpSpeed, maxPeerDownSpeed, maxPeerUpSpeed,
+			schedule, useDht, dhtPort, dhtBootstrap, useLpd, trackerTLS, bus)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		if controlSocket != "" {
+			listener, err := control.Listen(session, controlSocket)
+			if err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			defer listener.Close()
+		}
+		if metricsAddr != "" {
+			listener, err := metrics.Serve(metricsAddr, session.WriteMetrics)
+			if err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			defer listener.Close()
+		}
+		for _, mtorrent := range mtorrents {
+			seed := ""
+			if _, err := os.Stat(mtorrent.Info.Name); err == nil {
+				if seedExisting {
+					seed = mtorrent.Info.Name
+					fmt.Println("Seeding existing file", seed)
+				} else {
+					fmt.Println("Warning:", mtorrent.Info.Name, "already exists and is overwritten by the download, use --seed-existing to seed it")
+				}
+			}
+			// Progress bars of many torrents would overwrite each other
+			_, err = session.AddTorrent(mtorrent, core.Options{
+				Seed:        seed,
+				AutoSeed:    autoSeed,
+				LazySeed:    lazySeed,
+				SeedRatio:   seedRatio,
+				SeedTime:    seedTime,
+				WaitSeeders: 1,
+			})
+			if err != nil {
+				fmt.Println("Error:", err)
+			}
+		}
+		session.HandleSignals()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(daemonCmd)
+	daemonCmd.Flags().IntP("verbose", "v", 0, "Choses verbosity level.")
+	daemonCmd.Flags().StringP("interface", "i", "", "Specify the interface to retrieve IP from")
+	daemonCmd.Flags().StringP("port", "p", "7777", "Specify the port to listen on for other peers, shared by all torrents")
+	daemonCmd.Flags().BoolP("auto-seed", "a", true, "Wether to seed the files after download or not")
+	daemonCmd.Flags().Bool("seed-existing", false, "Seed the torrents whose file is already in the current directory instead of downloading them")
+	daemonCmd.Flags().Bool("lazy", false, "Hash the files being seeded while seeding them instead of loading them first. Pieces that do not match are downloaded")
+	daemonCmd.Flags().Float64("seed-ratio", 0, "Leave the swarm of a torrent once uploaded/downloaded reaches this ratio. 0 for no goal")
+	daemonCmd.Flags().Duration("seed-time", 0, "Leave the swarm of a torrent after seeding it this long, such as 1h30m. 0 for no goal")
+	daemonCmd.Flags().IntP("max-down-speed", "d", 0, "Specify the maximum download speed in KB/s, shared by all torrents. 0 for no limit")
+	daemonCmd.Flags().IntP("max-up-speed", "u", 0, "Specify the maximum upload speed in KB/s, shared by all torrents. 0 for no limit")
+	daemonCmd.Flags().Int("max-peer-down-speed", 0, "Specify the maximum download speed from each peer in KB/s. 0 for no limit")
+	daemonCmd.Flags().Int("max-peer-up-speed", 0, "Specify the maximum upload speed to each peer in KB/s. 0 for no limit")
+	daemonCmd.Flags().String("schedule", "", "JSON file with speed limits by time of day. Overrides max-down-speed and max-up-speed")
+	daemonCmd.Flags().Bool("dht", false, "Find peers through the DHT, in addition to the tracker")
+	daemonCmd.Flags().String("dht-port", "0", "Specify the UDP port of the DHT node. 0 for a random port")
+	daemonCmd.Flags().StringSlice("dht-bootstrap", []string{}, "Addresses (ip:port) of DHT nodes to bootstrap from")
+	daemonCmd.Flags().Bool("lpd", false, "Find peers in the local network through multicast announces")
+	daemonCmd.Flags().String("control", control.DefaultSocket(), "Unix socket to serve the control API on, used by 'MicroTorr ctl'. Empty to disable")
+	daemonCmd.Flags().String("metrics", "", "Serve Prometheus metrics at http://ADDR/metrics, such as 127.0.0.1:9100. Empty to disable")
+	addTrackerTLSFlags(daemonCmd)
+	daemonCmd.Flags().String("on-complete", "", "Shell command run when a download completes. MICROTORR_NAME, MICROTORR_FILE, MICROTORR_ID and MICROTORR_LENGTH describe the torrent")
+}
@@ -4,13 +4,18 @@ Copyright © 2024 Rafael Barbeta rafa.barbeta@gmail.com
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"net"
+	"log/slog"
 	"os"
-	"strconv"
+	"os/signal"
+	"syscall"
 
-	"github.com/rafaelbarbeta/MicroTorr/pkg/downloader"
-	"github.com/rafaelbarbeta/MicroTorr/pkg/mtorr"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/bandwidth"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/microtorr"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/tui"
 	"github.com/spf13/cobra"
 )
 
@@ -25,44 +30,106 @@ Cobra is a CLI library for Go that empowers applications.
 This application is a tool to generate the needed files
 to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		verbosity, _ := cmd.Flags().GetInt("verbose")
 		intNet, _ := cmd.Flags().GetString("interface")
 		port, _ := cmd.Flags().GetString("port")
 		seed, _ := cmd.Flags().GetString("seed")
 		autoSeed, _ := cmd.Flags().GetBool("auto-seed")
+		lazySeed, _ := cmd.Flags().GetBool("lazy")
+		seedRatio, _ := cmd.Flags().GetFloat64("seed-ratio")
+		seedTime, _ := cmd.Flags().GetDuration("seed-time")
+		sequential, _ := cmd.Flags().GetBool("sequential")
+		streamAddr, _ := cmd.Flags().GetString("stream")
+		priorities, _ := cmd.Flags().GetStringSlice("priority")
+		statsOut, _ := cmd.Flags().GetString("stats-out")
 		waitSeeders, _ := cmd.Flags().GetInt("waitSeeders")
 		waitLeechers, _ := cmd.Flags().GetInt("waitLeechers")
 		maxDownSpeed, _ := cmd.Flags().GetInt("max-down-speed")
 		maxUpSpeed, _ := cmd.Flags().GetInt("max-up-speed")
-		var err error
+		maxPeerDownSpeed, _ := cmd.Flags().GetInt("max-peer-down-speed")
+		maxPeerUpSpeed, _ := cmd.Flags().GetInt("max-peer-up-speed")
+		scheduleFile, _ := cmd.Flags().GetString("schedule")
+		useDht, _ := cmd.Flags().GetBool("dht")
+		dhtPort, _ := cmd.Flags().GetString("dht-port")
+		dhtBootstrap, _ := cmd.Flags().GetStringSlice("dht-bootstrap")
+		useLpd, _ := cmd.Flags().GetBool("lpd")
+		controlSocket, _ := cmd.Flags().GetString("control")
+		onComplete, _ := cmd.Flags().GetString("on-complete")
+		metricsAddr, _ := cmd.Flags().GetString("metrics")
+		useTui, _ := cmd.Flags().GetBool("tui")
+		trackerCA, _ := cmd.Flags().GetString("tracker-ca")
+		trackerCert, _ := cmd.Flags().GetString("tracker-cert")
+		trackerKey, _ := cmd.Flags().GetString("tracker-key")
 		if len(args) < 1 {
 			fmt.Println("Error: You must specify a .mtorrent file")
 			os.Exit(1)
 		}
-		if waitSeeders < 0 || waitLeechers < 0 {
-			fmt.Println("Error: waitSeeders and waitLeechers must be greater than 0")
-			os.Exit(1)
-		}
 		if seed != "" && (waitSeeders > 1 || waitLeechers > 0) {
 			fmt.Println("Warning: waitSeeders and waitLeechers are ignored in seeding mode")
 		}
-		if intNet != "" {
-			_, err = net.InterfaceByName(intNet)
+		if useTui && !tui.IsTerminal() {
+			fmt.Println("Error:", tui.ErrNoTerminal)
+			os.Exit(1)
+		}
+		var schedule *bandwidth.Schedule
+		if scheduleFile != "" {
+			loaded, err := bandwidth.LoadSchedule(scheduleFile)
+			if err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			schedule = &loaded
 		}
+		client := microtorr.NewClient(microtorr.Config{
+			MtorrentFile:     args[0],
+			Seed:             seed,
+			AutoSeed:         autoSeed,
+			LazySeed:         lazySeed,
+			SeedRatio:        seedRatio,
+			SeedTime:         seedTime,
+			Sequential:       sequential,
+			StreamAddr:       streamAddr,
+			Priorities:       priorities,
+			StatsOut:         statsOut,
+			TrackerCA:        trackerCA,
+			TrackerCert:      trackerCert,
+			TrackerKey:       trackerKey,
+			Interface:        intNet,
+			Port:             port,
+			WaitSeeders:      waitSeeders,
+			WaitLeechers:     waitLeechers,
+			MaxDownSpeed:     maxDownSpeed,
+			MaxUpSpeed:       maxUpSpeed,
+			MaxPeerDownSpeed: maxPeerDownSpeed,
+			MaxPeerUpSpeed:   maxPeerUpSpeed,
+			Schedule:         schedule,
+			Dht:              useDht,
+			DhtPort:          dhtPort,
+			DhtBootstrap:     dhtBootstrap,
+			Lpd:              useLpd,
+			ControlSocket:    controlSocket,
+			MetricsAddr:      metricsAddr,
+			ShowProgress:     !useTui && logging.Terminal() && !logging.Enabled("core", slog.LevelDebug),
+			OnComplete:       onComplete,
+		})
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		err := client.Start(ctx)
 		if err != nil {
-			fmt.Println("Error: Interface not found")
+			fmt.Println("Error:", err)
 			os.Exit(1)
 		}
-		portInt, err := strconv.Atoi(port)
-		if portInt >= 65535 || err != nil {
-			fmt.Println("Error: Invalid port")
-			os.Exit(1)
+		if useTui {
+			err = tui.Run(client, stop)
+			if err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
 		}
-		if maxDownSpeed < -1 || maxUpSpeed < -1 {
-			fmt.Println("Error: max-down-speed and max-up-speed must be greater than -1")
+		err = client.Wait()
+		if err != nil && !errors.Is(err, context.Canceled) {
+			fmt.Println("Error:", err)
+			os.Exit(1)
 		}
-		mtorrent := mtorr.LoadMtorrent(args[0], verbosity)
-		downloader.Download(mtorrent, intNet, port, seed, autoSeed, waitSeeders, waitLeechers, maxDownSpeed, maxUpSpeed, verbosity)
 	},
 }
 
@@ -73,8 +140,27 @@ func init() {
 	downloadCmd.Flags().StringP("port", "p", "7777", "Specify the port to listen on for other peers in the swarm")
 	downloadCmd.Flags().StringP("seed", "s", "", "Seed the torrent swarm with specified complete file")
 	downloadCmd.Flags().BoolP("auto-seed", "a", false, "Wether to seed the file after download or not")
+	downloadCmd.Flags().Bool("lazy", false, "With --seed, hash the file while seeding instead of loading it first. Pieces that do not match are downloaded")
+	downloadCmd.Flags().Float64("seed-ratio", 0, "Seed until uploaded/downloaded reaches this ratio, then exit. 0 for no goal")
+	downloadCmd.Flags().Duration("seed-time", 0, "Seed for this long, such as 1h30m, then exit. 0 for no goal")
+	downloadCmd.Flags().Bool("sequential", false, "Download pieces in order, so the start of the file can be used before it completes")
+	downloadCmd.Flags().String("stream", "", "Serve the file over HTTP on this address (such as 127.0.0.1:8080) while it downloads, requesting first the pieces being read")
+	downloadCmd.Flags().StringSlice("priority", []string{}, "Download priority of piece ranges, such as high:0-9 or skip:100- (skip, low, normal or high). Torrents hold a single file, so there are no per file priorities")
+	downloadCmd.Flags().String("stats-out", "", "Write the stats of each downloaded piece and the totals of each peer to this file when the download completes. CSV if it ends in .csv, JSON otherwise")
+	addTrackerTLSFlags(downloadCmd)
 	downloadCmd.Flags().Int("waitSeeders", 1, "Number of seeders to wait for before download starts")
 	downloadCmd.Flags().Int("waitLeechers", 0, "Number of leechers to wait for before download starts")
-	downloadCmd.Flags().IntP("max-down-speed", "d", 0, "Specify the maximum download speed in KB/s. 0 for no limit")
-	downloadCmd.Flags().IntP("max-up-speed", "u", 0, "Specify the maximum upload speed in KB/s. 0 for no limit")
+	downloadCmd.Flags().IntP("max-down-speed", "d", 0, "Specify the maximum download speed in KB/s, shared by all peers. 0 for no limit")
+	downloadCmd.Flags().IntP("max-up-speed", "u", 0, "Specify the maximum upload speed in KB/s, shared by all peers. 0 for no limit")
+	downloadCmd.Flags().Int("max-peer-down-speed", 0, "Specify the maximum download speed from each peer in KB/s. 0 for no limit")
+	downloadCmd.Flags().Int("max-peer-up-speed", 0, "Specify the maximum upload speed to each peer in KB/s. 0 for no limit")
+	downloadCmd.Flags().String("schedule", "", "JSON file with speed limits by time of day. Overrides max-down-speed and max-up-speed")
+	downloadCmd.Flags().Bool("dht", false, "Find peers through the DHT, in addition to the tracker")
+	downloadCmd.Flags().String("dht-port", "0", "Specify the UDP port of the DHT node. 0 for a random port")
+	downloadCmd.Flags().StringSlice("dht-bootstrap", []string{}, "Addresses (ip:port) of DHT nodes to bootstrap from")
+	downloadCmd.Flags().Bool("lpd", false, "Find peers in the local network through multicast announces")
+	downloadCmd.Flags().String("control", "", "Unix socket to serve the control API on, used by 'MicroTorr ctl'. Empty to disable")
+	downloadCmd.Flags().Bool("tui", false, "Show the pieces, the peers and the tracker status in a full screen view instead of the progress bar. q quits, p pauses")
+	downloadCmd.Flags().String("metrics", "", "Serve Prometheus metrics at http://ADDR/metrics, such as 127.0.0.1:9100. Empty to disable")
+	downloadCmd.Flags().String("on-complete", "", "Shell command run when the download completes. MICROTORR_NAME, MICROTORR_FILE, MICROTORR_ID and MICROTORR_LENGTH describe the torrent")
 }
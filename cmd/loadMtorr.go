@@ -5,6 +5,7 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/rafaelbarbeta/MicroTorr/pkg/mtorr"
 	"github.com/spf13/cobra"
@@ -16,8 +17,11 @@ var loadMtorrCmd = &cobra.Command{
 	Short: "Load a .mtorrent file",
 	Long:  `Load a .mtorrent file, and show its information.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		verbosity, _ := cmd.Flags().GetInt("verbosity")
-		mtorrent := mtorr.LoadMtorrent(args[0], verbosity)
+		mtorrent, err := mtorr.LoadMtorrent(args[0])
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
 		fmt.Println(mtorrent)
 	},
 }
@@ -6,6 +6,7 @@ package cmd
 import (
 	"os"
 
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
 	"github.com/spf13/cobra"
 )
 
@@ -16,6 +17,9 @@ var rootCmd = &cobra.Command{
 	Long: `Basic implementation of a peer-to-peer download client.
 
 Inspired by the BitTorrent Protocol, for didatic purposes`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return setupLogging(cmd)
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -27,5 +31,30 @@ func Execute() {
 	}
 }
 
+/*
+Configures the logs from the persistent log flags and the -v flag of the command.
+
+	--log-level overrides -v. Commands name their -v flag either verbose or verbosity
+*/
+func setupLogging(cmd *cobra.Command) error {
+	format, _ := cmd.Flags().GetString("log-format")
+	file, _ := cmd.Flags().GetString("log-file")
+	levels, _ := cmd.Flags().GetString("log-level")
+	verbosity, err := cmd.Flags().GetInt("verbose")
+	if err != nil {
+		verbosity, _ = cmd.Flags().GetInt("verbosity")
+	}
+	level, components, err := logging.ParseLevels(levels, logging.VerbosityLevel(verbosity))
+	if err != nil {
+		return err
+	}
+	return logging.Setup(logging.Config{Format: format, File: file, Level: level, Components: components})
+}
+
 func init() {
+	rootCmd.PersistentFlags().String("log-format", logging.FORMAT_CONSOLE, "Format of the logs: console, text or json")
+	rootCmd.PersistentFlags().String("log-file", "", "Append the logs to this file instead of printing them")
+	rootCmd.PersistentFlags().String("log-level", "",
+		"Minimum level of the logs (debug, info, warn or error), optionally by component, such as warn,peerwire=debug. "+
+			"Components are bandwidth, client, control, core, dht, downloader, events, lpd, mtorr, peerwire, tracker and trackercontroller. Overrides -v")
 }
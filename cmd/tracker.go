@@ -4,11 +4,14 @@ Copyright © 2024 Rafael Barbeta rafa.barbeta@gmail.com
 package cmd
 
 import (
-	"log"
+	"fmt"
 	"net/http"
+	"os"
 
 	//"encoding/json"
 	"github.com/mitchellh/colorstring"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/metrics"
 	"github.com/rafaelbarbeta/MicroTorr/pkg/tracker"
 	"github.com/spf13/cobra"
 )
@@ -19,21 +22,100 @@ var trackerCmd = &cobra.Command{
 	Short: "Start a HTTP server to act as a tracker",
 	Long: `HTTP server that will be used as a tracker for mtorrent clients.
 	
-Once it is activated, it will bind to port 8888 by default.`,
+Once it is activated, it will bind to port 8888 on all IPv4 and IPv6 addresses by default.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		bind, _ := cmd.Flags().GetString("bind")
-		verbosity, _ := cmd.Flags().GetInt("verbosity")
-		colorstring.Println("Tracker serving on: " + "[red]" + bind)
+		ipPolicy, _ := cmd.Flags().GetString("ip-policy")
+		trustedProxies, _ := cmd.Flags().GetStringSlice("trusted-proxy")
+		serveMetrics, _ := cmd.Flags().GetBool("metrics")
+		serveDashboard, _ := cmd.Flags().GetBool("dashboard")
+		whitelist, _ := cmd.Flags().GetString("whitelist")
+		adminToken, _ := cmd.Flags().GetString("admin-token")
+		tlsCert, _ := cmd.Flags().GetString("tls-cert")
+		tlsKey, _ := cmd.Flags().GetString("tls-key")
+		clientCA, _ := cmd.Flags().GetString("client-ca")
+		if adminToken == "" {
+			adminToken = os.Getenv(tracker.ADMIN_TOKEN_ENV)
+		}
+		var limits tracker.LimitsConfig
+		limits.AnnounceRate, _ = cmd.Flags().GetFloat64("announce-rate")
+		limits.AnnounceBurst, _ = cmd.Flags().GetInt("announce-burst")
+		limits.MaxSwarms, _ = cmd.Flags().GetInt("max-swarms")
+		limits.MaxPeers, _ = cmd.Flags().GetInt("max-peers")
+		limits.MinInterval, _ = cmd.Flags().GetDuration("min-interval")
+		err := tracker.SetAddressPolicy(ipPolicy, trustedProxies)
+		if err == nil {
+			err = tracker.SetLimits(limits)
+		}
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		if whitelist != "" {
+			allowed, err := tracker.LoadWhitelist(whitelist)
+			if err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			colorstring.Printf("Allowing [red]%d[reset] torrents from %s\n", allowed, whitelist)
+		}
+		server := &http.Server{Addr: bind}
+		if tlsCert != "" || tlsKey != "" || clientCA != "" {
+			server.TLSConfig, err = tracker.ServerTLS(tlsCert, tlsKey, clientCA)
+			if err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+		}
+		if server.TLSConfig == nil {
+			colorstring.Println("Tracker serving on: " + "[red]" + bind)
+		} else if clientCA == "" {
+			colorstring.Println("Tracker serving HTTPS on: " + "[red]" + bind)
+		} else {
+			colorstring.Println("Tracker serving HTTPS, only to clients with a certificate, on: " + "[red]" + bind)
+		}
 		http.HandleFunc("/announce", func(w http.ResponseWriter, r *http.Request) {
-			tracker.Announce(w, r, verbosity)
+			tracker.Announce(w, r)
 		})
-		log.Fatal(http.ListenAndServe(bind, nil))
+		if serveMetrics {
+			http.Handle("/metrics", metrics.Handler(tracker.WriteMetrics))
+		}
+		if serveDashboard {
+			http.Handle("/", tracker.Dashboard())
+		}
+		if adminToken != "" {
+			http.Handle("/admin/", tracker.AdminHandler(adminToken))
+		}
+		if server.TLSConfig != nil {
+			// The certificate is already in TLSConfig
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		logging.For("tracker").Error("Tracker stopped", "error", err)
+		os.Exit(1)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(trackerCmd)
 
-	trackerCmd.Flags().StringP("bind", "b", "0.0.0.0:8888", "Specify the address to bind")
+	trackerCmd.Flags().StringP("bind", "b", ":8888", "Specify the address to bind")
 	trackerCmd.Flags().IntP("verbosity", "v", 0, "Choses verbosity level.")
+	trackerCmd.Flags().String("ip-policy", tracker.IP_POLICY_NONE,
+		"Which addresses sent by peers are accepted: none, private, proxy (only from trusted proxies) or any")
+	trackerCmd.Flags().Bool("metrics", false, "Serve Prometheus metrics at /metrics")
+	trackerCmd.Flags().Bool("dashboard", false, "Serve an HTML dashboard of the swarms at / and its JSON API at /api/swarms")
+	trackerCmd.Flags().Float64("announce-rate", tracker.DEFAULT_ANNOUNCE_RATE, "Announces per second allowed from each IP. 0 for no limit")
+	trackerCmd.Flags().Int("announce-burst", tracker.DEFAULT_ANNOUNCE_BURST, "Announces an IP can send at once before --announce-rate applies")
+	trackerCmd.Flags().Int("max-swarms", tracker.DEFAULT_MAX_SWARMS, "Most swarms the tracker keeps. 0 for no limit")
+	trackerCmd.Flags().Int("max-peers", tracker.DEFAULT_MAX_PEERS, "Most peers in each swarm. 0 for no limit")
+	trackerCmd.Flags().Duration("min-interval", tracker.DEFAULT_MIN_INTERVAL, "Shortest time between two announces of a peer, except to leave or to tell it became a seeder. 0 for no limit")
+	trackerCmd.Flags().String("tls-cert", "", "Serve HTTPS with this PEM certificate, with --tls-key")
+	trackerCmd.Flags().String("tls-key", "", "PEM key of --tls-cert")
+	trackerCmd.Flags().String("client-ca", "", "With --tls-cert, only accept clients with a certificate signed by a CA of this PEM bundle")
+	trackerCmd.Flags().String("whitelist", "", "Only allow the torrents of the .mtorrent files in this directory")
+	trackerCmd.Flags().String("admin-token", "",
+		"Serve the admin API at /admin/, authenticated with this token. Also read from $"+tracker.ADMIN_TOKEN_ENV)
+	trackerCmd.Flags().StringSlice("trusted-proxy", []string{}, "IPs or CIDR ranges of proxies trusted to set X-Forwarded-For")
 }
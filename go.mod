@@ -1,17 +1,19 @@
 module github.com/rafaelbarbeta/MicroTorr
 
-go 1.19
+go 1.21.4
+
+require (
+	github.com/jackpal/bencode-go v1.0.2
+	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db
+	github.com/schollz/progressbar/v3 v3.14.3
+	github.com/spf13/cobra v1.8.0
+	golang.org/x/term v0.21.0
+	golang.org/x/time v0.3.0
+)
 
 require (
-	github.com/conduitio/bwlimit v0.1.0 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/jackpal/bencode-go v1.0.2 // indirect
-	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
-	github.com/schollz/progressbar/v3 v3.14.3 // indirect
-	github.com/spf13/cobra v1.8.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	golang.org/x/sys v0.21.0 // indirect
-	golang.org/x/term v0.21.0 // indirect
-	golang.org/x/time v0.3.0 // indirect
 )
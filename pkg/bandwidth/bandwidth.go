@@ -0,0 +1,114 @@
+package bandwidth
+
+import (
+	"context"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	KB        = 1000      // Speeds are given in KB/s
+	MAX_BURST = 16 * 1000 // Largest amount of bytes read or written at once
+)
+
+/*
+Token bucket limiter shared by all connections of the client.
+
+	Every byte read or written takes a token from the global bucket of its
+	direction, and from the bucket of its connection when per peer caps are set
+*/
+type Limiter struct {
+	up       *rate.Limiter
+	down     *rate.Limiter
+	peerUp   int
+	peerDown int
+}
+
+type limitedConn struct {
+	net.Conn
+	limiter  *Limiter
+	peerUp   *rate.Limiter
+	peerDown *rate.Limiter
+}
+
+// Speeds in KB/s. 0 for no limit
+func NewLimiter(maxDownSpeed, maxUpSpeed, maxPeerDownSpeed, maxPeerUpSpeed int) *Limiter {
+	return &Limiter{
+		up:       newRateLimiter(maxUpSpeed),
+		down:     newRateLimiter(maxDownSpeed),
+		peerUp:   maxPeerUpSpeed,
+		peerDown: maxPeerDownSpeed,
+	}
+}
+
+// Changes the global limits of all connections. Speeds in KB/s, 0 for no limit
+func (l *Limiter) SetLimits(maxDownSpeed, maxUpSpeed int) {
+	l.down.SetLimit(speedLimit(maxDownSpeed))
+	l.up.SetLimit(speedLimit(maxUpSpeed))
+}
+
+// Current global limits in KB/s, 0 for no limit
+func (l *Limiter) Limits() (int, int) {
+	return limitSpeed(l.down.Limit()), limitSpeed(l.up.Limit())
+}
+
+// Wraps a connection so its traffic counts towards the limits
+func (l *Limiter) Wrap(conn net.Conn) net.Conn {
+	return &limitedConn{
+		Conn:     conn,
+		limiter:  l,
+		peerUp:   newRateLimiter(l.peerUp),
+		peerDown: newRateLimiter(l.peerDown),
+	}
+}
+
+// Reads up to MAX_BURST bytes, then waits for the tokens they used
+func (c *limitedConn) Read(b []byte) (int, error) {
+	if len(b) > MAX_BURST {
+		b = b[:MAX_BURST]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.peerDown.WaitN(context.Background(), n)
+		c.limiter.down.WaitN(context.Background(), n)
+	}
+	return n, err
+}
+
+// Writes in chunks of MAX_BURST bytes, waiting for the tokens of each chunk before sending it
+func (c *limitedConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := len(b) - written
+		if chunk > MAX_BURST {
+			chunk = MAX_BURST
+		}
+		c.peerUp.WaitN(context.Background(), chunk)
+		c.limiter.up.WaitN(context.Background(), chunk)
+		n, err := c.Conn.Write(b[written : written+chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func newRateLimiter(speed int) *rate.Limiter {
+	return rate.NewLimiter(speedLimit(speed), MAX_BURST)
+}
+
+func speedLimit(speed int) rate.Limit {
+	if speed <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(speed * KB)
+}
+
+func limitSpeed(limit rate.Limit) int {
+	if limit == rate.Inf {
+		return 0
+	}
+	return int(limit) / KB
+}
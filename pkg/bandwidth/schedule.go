@@ -0,0 +1,135 @@
+package bandwidth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/utils"
+)
+
+var logger = logging.For("bandwidth")
+
+/*
+Speed limits by time of day, loaded from a JSON file such as:
+
+	{
+		"MaxDownSpeed": 0,
+		"MaxUpSpeed": 0,
+		"Rules": [
+			{"Days": ["mon", "tue", "wed", "thu", "fri"], "Start": "09:00", "End": "18:00", "MaxDownSpeed": 2000, "MaxUpSpeed": 500}
+		]
+	}
+
+The first rule matching the current time is used, and the top level limits when none does.
+Rules with End before Start go through midnight, and End equal to Start is refused.
+Rules without Days apply every day
+*/
+type Schedule struct {
+	MaxDownSpeed int
+	MaxUpSpeed   int
+	Rules        []ScheduleRule
+}
+
+type ScheduleRule struct {
+	Days         []string
+	Start        string // HH:MM
+	End          string // HH:MM, exclusive
+	MaxDownSpeed int
+	MaxUpSpeed   int
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func LoadSchedule(fileName string) (Schedule, error) {
+	var schedule Schedule
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return schedule, err
+	}
+	err = json.Unmarshal(data, &schedule)
+	if err != nil {
+		return schedule, fmt.Errorf("invalid schedule %s: %w", fileName, err)
+	}
+	for i, rule := range schedule.Rules {
+		for _, day := range rule.Days {
+			if !utils.Contains(weekdays, strings.ToLower(day)) {
+				return schedule, fmt.Errorf("rule %d: invalid day %s", i, day)
+			}
+		}
+		start, errStart := minuteOfDay(rule.Start)
+		end, errEnd := minuteOfDay(rule.End)
+		if errStart != nil || errEnd != nil {
+			return schedule, fmt.Errorf("rule %d: start and end must be HH:MM", i)
+		}
+		if start == end {
+			return schedule, fmt.Errorf("rule %d: start and end are equal, so it never applies", i)
+		}
+	}
+	return schedule, nil
+}
+
+// Download and upload limits, in KB/s, at time t
+func (s Schedule) LimitsAt(t time.Time) (int, int) {
+	minute := t.Hour()*60 + t.Minute()
+	yesterday := t.AddDate(0, 0, -1)
+	for _, rule := range s.Rules {
+		start, _ := minuteOfDay(rule.Start)
+		end, _ := minuteOfDay(rule.End)
+		if start <= end && rule.onDay(t) && minute >= start && minute < end {
+			return rule.MaxDownSpeed, rule.MaxUpSpeed
+		}
+		// Through midnight, the part after it belongs to the rule of the day before
+		if start > end && ((rule.onDay(t) && minute >= start) || (rule.onDay(yesterday) && minute < end)) {
+			return rule.MaxDownSpeed, rule.MaxUpSpeed
+		}
+	}
+	return s.MaxDownSpeed, s.MaxUpSpeed
+}
+
+/*
+Applies the schedule to limiter, checking it every minute.
+
+	Limits are only set when the schedule changes them, so limits set
+	by other means (such as the control API) last until the next change.
+	Returns when quit is closed
+*/
+func RunSchedule(limiter *Limiter, schedule Schedule, quit chan struct{}) {
+	lastDown, lastUp := -1, -1
+	for {
+		maxDown, maxUp := schedule.LimitsAt(time.Now())
+		if maxDown != lastDown || maxUp != lastUp {
+			logger.Info("Schedule changed speed limits", "down_kbps", maxDown, "up_kbps", maxUp)
+			limiter.SetLimits(maxDown, maxUp)
+			lastDown, lastUp = maxDown, maxUp
+		}
+		select {
+		case <-time.After(time.Until(time.Now().Truncate(time.Minute).Add(time.Minute))):
+		case <-quit:
+			return
+		}
+	}
+}
+
+func (rule ScheduleRule) onDay(t time.Time) bool {
+	if len(rule.Days) == 0 {
+		return true
+	}
+	for _, day := range rule.Days {
+		if strings.ToLower(day) == weekdays[t.Weekday()] {
+			return true
+		}
+	}
+	return false
+}
+
+func minuteOfDay(hhmm string) (int, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
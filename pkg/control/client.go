@@ -0,0 +1,97 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Host of the API URLs. Requests always go to the socket, so it is never resolved
+const API_HOST = "http://microtorr"
+
+// Client of the control API of a running MicroTorr
+type Client struct {
+	http *http.Client
+}
+
+func NewClient(socketPath string) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	return &Client{http: &http.Client{Transport: transport}}
+}
+
+func (c *Client) List() ([]TorrentInfo, error) {
+	torrents := make([]TorrentInfo, 0)
+	err := c.do("GET", "/torrents", nil, &torrents)
+	return torrents, err
+}
+
+func (c *Client) Add(request AddRequest) error {
+	return c.do("POST", "/torrents", request, nil)
+}
+
+func (c *Client) Pause(id string, closeConns bool) error {
+	return c.do("POST", "/torrents/pause?id="+url.QueryEscape(id)+"&close="+strconv.FormatBool(closeConns), nil, nil)
+}
+
+func (c *Client) Resume(id string) error {
+	return c.do("POST", "/torrents/resume?id="+url.QueryEscape(id), nil, nil)
+}
+
+func (c *Client) Remove(id string, deleteData bool) error {
+	return c.do("DELETE", "/torrents?id="+url.QueryEscape(id)+"&data="+strconv.FormatBool(deleteData), nil, nil)
+}
+
+func (c *Client) SetPriorities(id string, specs []string) error {
+	return c.do("POST", "/torrents/priorities?id="+url.QueryEscape(id), specs, nil)
+}
+
+func (c *Client) Limits() (Limits, error) {
+	var limits Limits
+	err := c.do("GET", "/limits", nil, &limits)
+	return limits, err
+}
+
+func (c *Client) SetLimits(limits Limits) error {
+	return c.do("PUT", "/limits", limits, nil)
+}
+
+// Sends body as JSON and decodes the JSON response into result, when they are not nil
+func (c *Client) do(method, path string, body, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	request, err := http.NewRequest(method, API_HOST+path, reader)
+	if err != nil {
+		return err
+	}
+	response, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		message, _ := io.ReadAll(response.Body)
+		return errors.New(strings.TrimSpace(string(message)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
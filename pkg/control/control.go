@@ -0,0 +1,272 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/core"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
+)
+
+// Control API of a running client, HTTP with JSON bodies over a Unix socket
+const (
+	SOCKET_NAME = "microtorr.sock"
+)
+
+var logger = logging.For("control")
+
+// Summary of a torrent of the session
+type TorrentInfo struct {
+	Id         string
+	Name       string
+	Length     int
+	Progress   float64 // Percentage of pieces downloaded
+	Peers      int
+	Downloaded int64   // Bytes
+	Uploaded   int64   // Bytes
+	DownRate   float64 // Bytes per second
+	UpRate     float64 // Bytes per second
+	Paused     bool
+	Seeding    bool
+}
+
+type AddRequest struct {
+	Path       string // Absolute path of the .mtorrent
+	Seed       string // Absolute path of the complete file, empty to download it
+	AutoSeed   bool
+	LazySeed   bool     // Hash Seed while seeding it, downloading the pieces that do not match
+	SeedRatio  float64  // Seeding goals, 0 for none
+	SeedTime   string   // Duration such as "1h30m", empty for none
+	Priorities []string // Piece priorities such as "high:0-9", see core.Priorities.Apply
+}
+
+// Global speed limits in KB/s, 0 for no limit
+type Limits struct {
+	MaxDownSpeed int
+	MaxUpSpeed   int
+}
+
+// Operations the API performs on the session. Torrents are selected by their id, or an unique prefix of it
+type Session interface {
+	AddFile(path string, options core.Options) error
+	SetPriorities(id string, specs []string) error
+	Pause(id string, closeConns bool) error
+	Resume(id string) error
+	Remove(id string, deleteData bool) error
+	Limits() (int, int)
+	SetLimits(maxDownSpeed, maxUpSpeed int)
+	List() []TorrentInfo
+}
+
+/*
+Socket used when none is given.
+
+	In $XDG_RUNTIME_DIR, which only the user can enter. Without it, in a
+	directory of the user in the temporary directory, made private by Listen
+*/
+func DefaultSocket() string {
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return filepath.Join(runtimeDir, SOCKET_NAME)
+	}
+	return filepath.Join(userDir(), SOCKET_NAME)
+}
+
+// Directory of the default socket when there is no $XDG_RUNTIME_DIR
+func userDir() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("microtorr-%d", os.Getuid()))
+}
+
+/*
+Creates dir with access for the user only, or checks an existing one is so.
+
+	Another user could have created it first in the shared temporary
+	directory, to see or replace the socket
+*/
+func privateDir(dir string) error {
+	err := os.Mkdir(dir, 0700)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(stat.Uid) != os.Getuid() || info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s is not a directory only this user can access", dir)
+	}
+	return nil
+}
+
+/*
+Serves the control API of session on the Unix socket socketPath.
+
+	A socket left behind by a client that did not exit cleanly is replaced.
+	Closing the returned listener stops the API and removes the socket
+*/
+func Listen(session Session, socketPath string) (net.Listener, error) {
+	if filepath.Dir(socketPath) == userDir() {
+		err := privateDir(userDir())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		return nil, errors.New("another client is already listening on " + socketPath)
+	}
+	os.Remove(socketPath)
+	// The API can delete files, so only the owner may use it. The socket is
+	// created with that mode, as changing it afterwards lets others in meanwhile
+	umask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", socketPath)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/torrents", func(w http.ResponseWriter, r *http.Request) {
+		handleTorrents(session, w, r)
+	})
+	// ?close=true on pause also disconnects from the peers
+	mux.HandleFunc("/torrents/pause", func(w http.ResponseWriter, r *http.Request) {
+		handlePause(session, w, r, true)
+	})
+	mux.HandleFunc("/torrents/resume", func(w http.ResponseWriter, r *http.Request) {
+		handlePause(session, w, r, false)
+	})
+	// The body is a JSON list of priority specs
+	mux.HandleFunc("/torrents/priorities", func(w http.ResponseWriter, r *http.Request) {
+		handlePriorities(session, w, r)
+	})
+	mux.HandleFunc("/limits", func(w http.ResponseWriter, r *http.Request) {
+		handleLimits(session, w, r)
+	})
+	logger.Info("Control API listening", "socket", socketPath)
+	go http.Serve(listener, mux)
+	return listener, nil
+}
+
+func handleTorrents(session Session, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJson(w, session.List())
+	case "POST":
+		var request AddRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil || request.Path == "" || request.SeedRatio < 0 {
+			http.Error(w, "Invalid add request", http.StatusBadRequest)
+			return
+		}
+		var seedTime time.Duration
+		if request.SeedTime != "" {
+			seedTime, err = time.ParseDuration(request.SeedTime)
+			if err != nil || seedTime < 0 {
+				http.Error(w, "Invalid seed time", http.StatusBadRequest)
+				return
+			}
+		}
+		logger.Info("Adding torrent", "file", request.Path)
+		// Waits for a seeder, as the download command does
+		err = session.AddFile(request.Path, core.Options{
+			Seed:        request.Seed,
+			AutoSeed:    request.AutoSeed,
+			LazySeed:    request.LazySeed,
+			SeedRatio:   request.SeedRatio,
+			SeedTime:    seedTime,
+			Priorities:  request.Priorities,
+			WaitSeeders: 1,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		deleteData, _ := strconv.ParseBool(r.URL.Query().Get("data"))
+		logger.Info("Removing torrent", "id", id, "delete_data", deleteData)
+		err := session.Remove(id, deleteData)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handlePause(session Session, w http.ResponseWriter, r *http.Request, pause bool) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	logger.Info("Control request", "path", r.URL.Path, "id", id)
+	var err error
+	if pause {
+		closeConns, _ := strconv.ParseBool(r.URL.Query().Get("close"))
+		err = session.Pause(id, closeConns)
+	} else {
+		err = session.Resume(id)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	}
+}
+
+func handlePriorities(session Session, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	var specs []string
+	err := json.NewDecoder(r.Body).Decode(&specs)
+	if err != nil {
+		http.Error(w, "Invalid priorities", http.StatusBadRequest)
+		return
+	}
+	logger.Info("Changing priorities", "id", id, "priorities", specs)
+	err = session.SetPriorities(id, specs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func handleLimits(session Session, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		maxDown, maxUp := session.Limits()
+		writeJson(w, Limits{MaxDownSpeed: maxDown, MaxUpSpeed: maxUp})
+	case "PUT":
+		var limits Limits
+		err := json.NewDecoder(r.Body).Decode(&limits)
+		if err != nil || limits.MaxDownSpeed < 0 || limits.MaxUpSpeed < 0 {
+			http.Error(w, "Invalid speed limits", http.StatusBadRequest)
+			return
+		}
+		logger.Info("Changing speed limits", "down_kbps", limits.MaxDownSpeed, "up_kbps", limits.MaxUpSpeed)
+		session.SetLimits(limits.MaxDownSpeed, limits.MaxUpSpeed)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJson(w http.ResponseWriter, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -3,44 +3,45 @@ package core
 import (
 	"crypto/sha1"
 	"fmt"
-	"math"
+	"log/slog"
 	"os"
-	"os/signal"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
+	"github.com/rafaelbarbeta/MicroTorr/pkg/events"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
 	"github.com/rafaelbarbeta/MicroTorr/pkg/messages"
 	"github.com/rafaelbarbeta/MicroTorr/pkg/mtorr"
-	"github.com/rafaelbarbeta/MicroTorr/pkg/utils"
 	"github.com/schollz/progressbar/v3"
 )
 
 const (
 	OPPORTUNISTIC_CHOICE = 0.9
 	WAIT_DEFAULT_TIME    = 200 * time.Millisecond
+	RATE_INTERVAL        = 2 * time.Second
 )
 
+var logger = logging.For("core")
+
 func InitCore(
 	mtorrent mtorr.Mtorrent,
+	options Options,
 	chanPeerWire, chanCore, chanTracker chan messages.ControlMessage,
 	myId string,
 	wait *sync.WaitGroup,
-	seed string,
-	autoSeed bool,
-	waitSeeders, waitLeechers, verbosity int,
+	status *TorrentStatus,
+	priorities *Priorities,
+	bus *events.Bus,
 ) {
-	numberOfPieces := int(math.Ceil(
-		float64(mtorrent.Info.Length) / float64(mtorrent.Info.Piece_length),
-	))
+	logger := logger.With(logging.Swarm(mtorrent.Info.Id))
+	numberOfPieces := NumberOfPieces(mtorrent)
 
 	chanPieceRequester := make(chan messages.ControlMessage)
 	chanPieceUploader := make(chan messages.ControlMessage)
 	var bar *progressbar.ProgressBar
-	// Signal handling
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	// Closed when the torrent stops, so the goroutines below exit
+	done := make(chan struct{})
 
 	PeerPieces := SyncPeerPieces{
 		Have:  make(map[string][]bool),
@@ -54,37 +55,44 @@ func InitCore(
 		Have:   make([]bool, numberOfPieces),
 	}
 
+	seed := options.Seed
+	stream := options.Stream
 	SeedMode := SeedMode{
 		SeedFile: seed,
 		active:   seed != "",
-		auto:     autoSeed,
-	}
-
-	if SeedMode.active {
-		var sha1hash strings.Builder
-		var data []byte
-		utils.PrintVerbose(verbosity, utils.VERBOSE, "Seed Mode active")
-		utils.PrintVerbose(verbosity, utils.VERBOSE, "Opening seed file ", seed)
-		// Open file and insert its pieces in the PieceBytes. Each piece has size of mtorrent.Info.Piece_length
-		file, err := os.Open(SeedMode.SeedFile)
-		utils.Check(err, verbosity, "Error opening seed file")
-		for i := 0; i < numberOfPieces; i++ {
-			data = make([]byte, mtorrent.Info.Piece_length)
-			n, err := file.Read(data)
-			utils.Check(err, verbosity, "Error reading seed file")
-			pieceHash := fmt.Sprintf("%x", sha1.Sum(data[:n]))
-			sha1hash.WriteString(pieceHash)
-			PiecesBytes.AddPiece(data[:n], i)
+		auto:     options.AutoSeed,
+		ratio:    options.SeedRatio,
+		time:     options.SeedTime,
+		lazy:     seed != "" && options.LazySeed,
+	}
+
+	if SeedMode.lazy {
+		logger.Info("Lazy seed mode active, pieces are hashed while seeding", "file", seed)
+		// Pieces that do not match are downloaded into the file itself
+		file, err := os.OpenFile(SeedMode.SeedFile, os.O_RDWR, 0)
+		if err != nil {
+			Fail(fmt.Errorf("error opening seed file: %w", err), status, chanTracker, done, logger)
+			return
 		}
-		file.Close()
-		// Making sure the file pieces are correct and match the mtorrent sha1 sum
-		if sha1hash.String() != mtorrent.Info.Sha1sum {
-			utils.PrintVerbose(verbosity, utils.CRITICAL, "Seed file SHA1 does not match with Mtorrent SHA1. Aborting...")
-			utils.PrintVerbose(verbosity, utils.DEBUG, "Seed file SHA1: ", sha1hash.String(), " \nMtorrent SHA1:", mtorrent.Info.Sha1sum)
-			wait.Done()
+		defer file.Close()
+		PiecesBytes.source = file
+		PiecesBytes.length = mtorrent.Info.Length
+		PiecesBytes.pieceLength = mtorrent.Info.Piece_length
+		PiecesBytes.Checked = make([]bool, numberOfPieces)
+		// Started to seed, so keeps seeding once the pieces that do not match are downloaded
+		SeedMode.auto = true
+	} else if SeedMode.active {
+		logger.Info("Seed Mode active")
+		logger.Info("Opening seed file", "file", seed)
+		err := LoadSeedFile(mtorrent, &PiecesBytes, SeedMode.SeedFile, numberOfPieces, logger)
+		if err != nil {
+			Fail(err, status, chanTracker, done, logger)
+			return
 		}
-		utils.PrintVerbose(verbosity, utils.VERBOSE, "File Loaded into memory")
-	} else if verbosity != utils.DEBUG {
+		logger.Info("File Loaded into memory")
+		status.SetSeeding()
+		bus.Publish(TorrentEvent(events.SEEDING_STARTED, mtorrent, &SeedMode, "", 0))
+	} else if options.ShowProgress {
 		bar = progressbar.NewOptions(numberOfPieces*mtorrent.Info.Piece_length,
 			progressbar.OptionSetDescription("Downloading pieces"),
 			progressbar.OptionEnableColorCodes(true),
@@ -102,6 +110,16 @@ func InitCore(
 		)
 	}
 
+	status.Lock.Lock()
+	status.NumberOfPieces = numberOfPieces
+	if SeedMode.active && !SeedMode.lazy {
+		status.PiecesHave = numberOfPieces
+	}
+	status.Lock.Unlock()
+
+	stream.attach(&PiecesBytes, priorities, mtorrent.Info.Piece_length, mtorrent.Info.Length)
+	status.setSnapshot(&PeerPieces, &PiecesBytes, priorities)
+
 	//Load piece hashes into memory for integrity checking
 	for i := 0; i < numberOfPieces*40; i += 40 {
 		PiecesBytes.Hash[i/40] = mtorrent.Info.Sha1sum[i : i+40]
@@ -111,12 +129,16 @@ func InitCore(
 		&PeerPieces,
 		&PiecesBytes,
 		&SeedMode,
+		status,
+		mtorrent,
 		numberOfPieces,
 		chanPeerWire,
 		chanCore,
+		chanTracker,
 		chanPieceRequester,
 		chanPieceUploader,
-		wait,
+		bus,
+		done,
 	)
 
 	if seed == "" {
@@ -124,78 +146,267 @@ func InitCore(
 			&PeerPieces,
 			&PiecesBytes,
 			&SeedMode,
+			status,
 			mtorrent,
 			numberOfPieces,
+			options,
+			priorities,
+			bus,
 			chanPieceRequester,
 			chanCore,
 			chanTracker,
-			wait,
-			waitSeeders,
-			waitLeechers,
-			verbosity,
+			done,
+			logger,
 			bar,
 		)
 	}
 
 	go PieceUploader(
 		&PiecesBytes,
+		status,
 		mtorrent,
+		stream,
 		chanPieceUploader,
 		chanCore,
-		verbosity,
+		done,
+		logger,
 	)
 
-	go HandleSignals(
-		sigs,
-		chanTracker,
-		wait,
-		verbosity,
-	)
+	// Before the lazy pass, which changes SeedMode
+	if SeedMode.active && !SeedMode.lazy && SeedMode.HasGoals() {
+		go SeedUntilGoals(mtorrent, &SeedMode, status, chanTracker, done, logger)
+	}
+
+	if SeedMode.lazy {
+		go VerifySeedFile(
+			&PeerPieces,
+			&PiecesBytes,
+			&SeedMode,
+			status,
+			mtorrent,
+			numberOfPieces,
+			options,
+			priorities,
+			bus,
+			chanPieceRequester,
+			chanCore,
+			chanTracker,
+			done,
+			logger,
+		)
+	}
 
+	go MeasureRates(status, done)
+
+	// Released by the tracker controller once it leaves the swarm
 	wait.Wait()
+	close(done)
+	stream.Stop()
 }
 
 func ListenForMessages(
 	PeerPieces *SyncPeerPieces,
 	PiecesBytes *PiecesBytes,
 	SeedMode *SeedMode,
+	status *TorrentStatus,
+	mtorrent mtorr.Mtorrent,
 	numberOfPieces int,
-	chanPeerWire, chanCore, chanPieceRequester, chanPieceUploader chan messages.ControlMessage,
-	wait *sync.WaitGroup,
+	chanPeerWire, chanCore, chanTracker, chanPieceRequester, chanPieceUploader chan messages.ControlMessage,
+	bus *events.Bus,
+	done chan struct{},
 ) {
+	var msg messages.ControlMessage
 	for {
-		msg := <-chanPeerWire
+		select {
+		case msg = <-chanPeerWire:
+		case <-done:
+			return
+		}
 		switch msg.Opcode {
 		case messages.NEW_CONNECTION:
 			PeerPieces.AddPeer(msg.PeerId, numberOfPieces)
+			status.AddPeer(msg.PeerId, msg.Payload.(string))
+			bus.Publish(TorrentEvent(events.PEER_CONNECTED, mtorrent, SeedMode, msg.PeerId, 0))
 			chanCore <- messages.ControlMessage{
 				Opcode: messages.BITFIELD,
 				PeerId: msg.PeerId,
 				Payload: messages.Bitfield{
-					Bitfield: PiecesBytes.Have,
+					Bitfield: PiecesBytes.Snapshot(),
 				},
 			}
 		case messages.DEAD_CONNECTION:
 			PeerPieces.DeletePeer(msg.PeerId)
+			status.DeletePeer(msg.PeerId)
+			bus.Publish(TorrentEvent(events.PEER_DISCONNECTED, mtorrent, SeedMode, msg.PeerId, 0))
 			if !SeedMode.active {
-				chanPieceRequester <- msg
+				select {
+				case chanPieceRequester <- msg:
+				case <-done:
+					return
+				}
 			}
 		case messages.HAVE:
 			PeerPieces.AddPiece(msg.PeerId, msg.Payload.(messages.Have).PieceIndex)
 		case messages.BITFIELD:
 			PeerPieces.SetBitfield(msg.PeerId, msg.Payload.(messages.Bitfield))
+			status.SetChoked(msg.PeerId, false)
 		case messages.REQUEST:
 			chanPieceUploader <- msg
 		case messages.PIECE:
 			if SeedMode.active {
-				panic("PIECE received when in seed mode")
+				logger.Warn("PIECE received when in seed mode, ignoring it", logging.Peer(msg.PeerId))
+				continue
+			}
+			select {
+			case chanPieceRequester <- msg:
+			case <-done:
+				return
+			}
+		case messages.REJECT:
+			if !SeedMode.active {
+				select {
+				case chanPieceRequester <- msg:
+				case <-done:
+					return
+				}
+			}
+		case messages.PAUSE: // Payload tells whether to close the connections
+			if status.IsPaused() {
+				continue
+			}
+			status.SetPaused(true)
+			if msg.Payload.(bool) {
+				chanCore <- messages.ControlMessage{Opcode: messages.PAUSE}
+			}
+			// Announced by the tracker controller in the background, peers are not kept waiting on the tracker
+			if !NotifyTracker(chanTracker, messages.PAUSE, done) {
+				return
+			}
+		case messages.RESUME:
+			if !status.IsPaused() {
+				continue
+			}
+			status.SetPaused(false)
+			chanCore <- messages.ControlMessage{Opcode: messages.RESUME}
+			// Peers forget our pieces when we reject their requests
+			chanCore <- messages.ControlMessage{
+				Opcode: messages.BITFIELD,
+				PeerId: "",
+				Payload: messages.Bitfield{
+					Bitfield: PiecesBytes.Snapshot(),
+				},
+			}
+			if !NotifyTracker(chanTracker, messages.RESUME, done) {
+				return
 			}
-			chanPieceRequester <- msg
 		case messages.HELLO:
-			fmt.Println("Received HELLO message: ",
-				msg.Payload.(messages.HelloDebug).Msg)
+			logger.Debug("Received HELLO message", logging.Peer(msg.PeerId), "message", msg.Payload.(messages.HelloDebug).Msg)
 		default:
 			panic("Unknown message type received!")
 		}
 	}
 }
+
+/*
+Sends an event to the tracker controller without waiting for its announce.
+
+	The controller leaves the swarm on the first completed or stopped event,
+	releasing wait, and ignores the rest. Returns false if the torrent
+	stopped before
+*/
+func NotifyTracker(chanTracker chan messages.ControlMessage, opcode int, done chan struct{}) bool {
+	select {
+	case chanTracker <- messages.ControlMessage{Opcode: opcode}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+/*
+Reads the pieces of a complete file into PiecesBytes.
+
+	Fails if the file does not match the pieces of mtorrent
+*/
+func LoadSeedFile(mtorrent mtorr.Mtorrent, PiecesBytes *PiecesBytes, seedFile string, numberOfPieces int, logger *slog.Logger) error {
+	var sha1hash strings.Builder
+	var data []byte
+	// Open file and insert its pieces in the PieceBytes. Each piece has size of mtorrent.Info.Piece_length
+	file, err := os.Open(seedFile)
+	if err != nil {
+		return fmt.Errorf("error opening seed file: %w", err)
+	}
+	defer file.Close()
+	for i := 0; i < numberOfPieces; i++ {
+		data = make([]byte, mtorrent.Info.Piece_length)
+		n, err := file.Read(data)
+		if err != nil {
+			return fmt.Errorf("error reading seed file: %w", err)
+		}
+		pieceHash := fmt.Sprintf("%x", sha1.Sum(data[:n]))
+		sha1hash.WriteString(pieceHash)
+		PiecesBytes.AddPiece(data[:n], i)
+	}
+	// Making sure the file pieces are correct and match the mtorrent sha1 sum
+	if sha1hash.String() != mtorrent.Info.Sha1sum {
+		logger.Debug("Seed file SHA1 mismatch", "sha1", sha1hash.String(), "expected", mtorrent.Info.Sha1sum)
+		return fmt.Errorf("seed file %s does not match with Mtorrent SHA1", seedFile)
+	}
+	return nil
+}
+
+// Event of the torrent of mtorrent, for the file being downloaded or seeded
+func TorrentEvent(eventType int, mtorrent mtorr.Mtorrent, SeedMode *SeedMode, peerId string, piece int) events.Event {
+	file := mtorrent.Info.Name
+	if SeedMode.SeedFile != "" {
+		file = SeedMode.SeedFile
+	}
+	return events.Event{
+		Type:   eventType,
+		Swarm:  mtorrent.Info.Id,
+		Name:   mtorrent.Info.Name,
+		File:   file,
+		Length: mtorrent.Info.Length,
+		Peer:   peerId,
+		Piece:  piece,
+	}
+}
+
+// Leaves the swarm because of err, which the session reports as the reason the torrent stopped
+func Fail(
+	err error,
+	status *TorrentStatus,
+	chanTracker chan messages.ControlMessage,
+	done chan struct{},
+	logger *slog.Logger,
+) {
+	logger.Error("Torrent failed, exiting swarm...", "error", err)
+	status.SetError(err)
+	NotifyTracker(chanTracker, messages.TRACKER_STOPPED, done)
+}
+
+// Updates the transfer rates of status and of its peers every RATE_INTERVAL
+func MeasureRates(status *TorrentStatus, done chan struct{}) {
+	ticker := time.NewTicker(RATE_INTERVAL)
+	defer ticker.Stop()
+	status.Lock.RLock()
+	lastDown, lastUp := status.Downloaded, status.Uploaded
+	status.Lock.RUnlock()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		status.Lock.Lock()
+		status.DownRate = float64(status.Downloaded-lastDown) / RATE_INTERVAL.Seconds()
+		status.UpRate = float64(status.Uploaded-lastUp) / RATE_INTERVAL.Seconds()
+		lastDown, lastUp = status.Downloaded, status.Uploaded
+		for _, peer := range status.PeerStatus {
+			peer.DownRate = float64(peer.Downloaded-peer.lastDown) / RATE_INTERVAL.Seconds()
+			peer.UpRate = float64(peer.Uploaded-peer.lastUp) / RATE_INTERVAL.Seconds()
+			peer.lastDown, peer.lastUp = peer.Downloaded, peer.Uploaded
+		}
+		status.Lock.Unlock()
+	}
+}
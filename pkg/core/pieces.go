@@ -3,10 +3,13 @@ package core
 import (
 	"crypto/sha1"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
-	"sync"
 	"time"
 
+	"github.com/rafaelbarbeta/MicroTorr/pkg/events"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
 	"github.com/rafaelbarbeta/MicroTorr/pkg/messages"
 	"github.com/rafaelbarbeta/MicroTorr/pkg/mtorr"
 	"github.com/rafaelbarbeta/MicroTorr/pkg/utils"
@@ -17,50 +20,93 @@ func PieceRequester(
 	PeerPieces *SyncPeerPieces,
 	PiecesBytes *PiecesBytes,
 	SeedMode *SeedMode,
+	status *TorrentStatus,
 	mtorrrent mtorr.Mtorrent,
 	numberOfPieces int,
+	options Options,
+	priorities *Priorities,
+	bus *events.Bus,
 	chanPieceRequester, chanCore, chanTracker chan messages.ControlMessage,
-	wait *sync.WaitGroup,
-	waitSeeders, waitLeechers, verbosity int,
+	done chan struct{},
+	logger *slog.Logger,
 	bar *progressbar.ProgressBar,
 ) {
 	var piecesIdx []int
 	var peers [][]string
+	var candidates []string
 	var selectedPeer string
 	var selectedPiece, selectedPieceIdx int
 	var msg messages.ControlMessage
 	var timeStart time.Time
-	stats := DownloadStats{
-		PiecesDownloaded: make([]int, 0),
-		PiecesSpeed:      make([]float64, 0),
-		FromPeers:        make([]string, 0),
-		FromSeeder:       make([]bool, 0),
-	}
+	partialDumped := false // The wanted pieces were written, the skipped ones are still missing
+	stats := NewDownloadStats(mtorrrent, options.StatsOut)
+	waitSeeders, waitLeechers := options.WaitSeeders, options.WaitLeechers
 
 	// Wait until the minimum number of seeders/leechers are in the swarm
 	for PeerPieces.NumSeeders() < waitSeeders || PeerPieces.NumLeechers()+1 < waitLeechers {
-		utils.PrintVerbose(verbosity, utils.DEBUG, "Seeders: ", PeerPieces.NumSeeders(), " Leechers: ", PeerPieces.NumLeechers()+1)
-		utils.PrintVerbose(verbosity, utils.DEBUG, "Required Seeders: ", waitSeeders, " Required Leechers: ", waitLeechers)
-		time.Sleep(WAIT_DEFAULT_TIME)
+		logger.Debug("Waiting for peers", "seeders", PeerPieces.NumSeeders(), "leechers", PeerPieces.NumLeechers()+1,
+			"required_seeders", waitSeeders, "required_leechers", waitLeechers)
+		if !Idle(chanPieceRequester, done) {
+			return
+		}
 	}
 
-	utils.PrintVerbose(verbosity, utils.VERBOSE, "Downloading pieces...")
+	logger.Info("Downloading pieces...")
+	stats.Started = time.Now()
 
 	for {
-		piecesIdx, peers = PeerPieces.RarestPieces(PiecesBytes, numberOfPieces)
-		if len(piecesIdx) == 0 { // Only happens if all pieces have been downloaded already
-			AssemblePieces(mtorrrent, PiecesBytes, SeedMode, chanTracker, &stats, wait, verbosity, bar)
+		// Pieces already downloaded are kept while paused
+		for status.IsPaused() {
+			if !Idle(chanPieceRequester, done) {
+				return
+			}
+		}
+		piecesIdx, peers = PeerPieces.RarestPieces(PiecesBytes, priorities, numberOfPieces)
+		if len(piecesIdx) == 0 && !utils.Contains(PiecesBytes.Snapshot(), false) {
+			AssemblePieces(mtorrrent, PiecesBytes, SeedMode, status, bus, chanTracker, stats, done, logger, bar)
 			break
 		}
+		if len(piecesIdx) == 0 { // Only skipped pieces are missing. Waits for their priorities to change
+			// Lazy seeds write the pieces to the seed file as they arrive
+			if !partialDumped && PiecesBytes.source == nil {
+				err := DumpPartial(mtorrrent, PiecesBytes, logger)
+				if err != nil {
+					Fail(err, status, chanTracker, done, logger)
+					return
+				}
+				partialDumped = true
+			}
+			if !Idle(chanPieceRequester, done) {
+				return
+			}
+			continue
+		}
 		selectedPiece, selectedPieceIdx = utils.RandomChoiceInt(piecesIdx)
+		candidates = peers[selectedPieceIdx]
+		if options.Order != ORDER_RAREST {
+			from := 0
+			if options.Order == ORDER_STREAMING {
+				from = options.Stream.Position()
+			}
+			// Streaming falls back to the rarest pieces when all after the read position are here
+			if piece, piecePeers := PeerPieces.FirstPiece(PiecesBytes, priorities, from); piece >= 0 {
+				selectedPiece, candidates = piece, piecePeers
+			}
+		}
+		if len(candidates) == 0 { // Wait for a peer that has it
+			if !Idle(chanPieceRequester, done) {
+				return
+			}
+			continue
+		}
 		// Minimum chance of chosing a random peer regardless of it being the quickest
 		if utils.RandomPercentChance(OPPORTUNISTIC_CHOICE) {
-			selectedPeer = PeerPieces.QuickestPeer(peers[selectedPieceIdx])
+			selectedPeer = PeerPieces.QuickestPeer(candidates)
 		} else {
-			utils.PrintVerbose(verbosity, utils.DEBUG, "Trying a random peer instead a quick peer...")
-			selectedPeer, _ = utils.RandomChoiceString(peers[selectedPieceIdx])
+			logger.Debug("Trying a random peer instead a quick peer...")
+			selectedPeer, _ = utils.RandomChoiceString(candidates)
 		}
-		utils.PrintVerbose(verbosity, utils.DEBUG, "Requesting piece ", selectedPiece, " from peer ", selectedPeer)
+		logger.Debug("Requesting piece", "piece", selectedPiece, logging.Peer(selectedPeer))
 
 		timeStart = time.Now() // To calculate download speed
 		chanCore <- messages.ControlMessage{
@@ -73,13 +119,15 @@ func PieceRequester(
 
 		// Wait for response. Make sure it's from the requested peer
 		for {
-			msg = <-chanPieceRequester
-			if msg.PeerId != selectedPeer && msg.Opcode == messages.DEAD_CONNECTION {
+			select {
+			case msg = <-chanPieceRequester:
+			case <-done:
+				return
+			}
+			if msg.PeerId != selectedPeer && (msg.Opcode == messages.DEAD_CONNECTION || msg.Opcode == messages.REJECT) {
 				continue
 			} else if msg.PeerId != selectedPeer {
-				utils.PrintVerbose(verbosity, utils.CRITICAL,
-					"Received unsolicited message from ",
-					selectedPeer[:5])
+				logger.Warn("Received unsolicited message", logging.Peer(msg.PeerId), "opcode", msg.Opcode)
 				continue
 			} else {
 				break
@@ -87,37 +135,45 @@ func PieceRequester(
 		}
 		switch msg.Opcode {
 		case messages.PIECE:
-			duration := time.Since(timeStart).Seconds()
-			speed := float64(mtorrrent.Info.Piece_length) / duration
-			go func(selectedPiece int) { //Making sure the hashes match. Not ideal, but errors out if they don't
-				hashPiece := fmt.Sprintf("%x",
-					sha1.Sum(msg.Payload.(messages.Piece).Data),
-				)
-				if hashPiece != PiecesBytes.Hash[selectedPiece] {
-					utils.PrintVerbose(verbosity, utils.CRITICAL, "Piece Hash does not match!")
-					wait.Done()
-					os.Exit(1)
-				}
-			}(selectedPiece)
+			latency := time.Since(timeStart)
+			speed := float64(len(msg.Payload.(messages.Piece).Data)) / latency.Seconds()
+			hashPiece := fmt.Sprintf("%x", sha1.Sum(msg.Payload.(messages.Piece).Data))
+			if hashPiece != PiecesBytes.Hash[selectedPiece] {
+				// Its pieces are ignored until it sends a new bitfield, and the piece is requested again
+				logger.Warn("Piece Hash does not match!", "piece", selectedPiece, logging.Peer(selectedPeer))
+				bus.Publish(TorrentEvent(events.PIECE_FAILED, mtorrrent, SeedMode, selectedPeer, selectedPiece))
+				status.AddFailed()
+				PeerPieces.SetBitfield(selectedPeer, messages.Bitfield{Bitfield: make([]bool, numberOfPieces)})
+				continue
+			}
+			bus.Publish(TorrentEvent(events.PIECE_VERIFIED, mtorrrent, SeedMode, selectedPeer, selectedPiece))
 			PeerPieces.SetSpeed(selectedPeer, speed)
-			PiecesBytes.AddPiece(msg.Payload.(messages.Piece).Data, msg.Payload.(messages.Piece).PieceIndex)
-			utils.PrintVerbose(verbosity, utils.DEBUG,
-				"Piece: ",
-				msg.Payload.(messages.Piece).PieceIndex,
-				" from: ", selectedPeer[:5],
-				"speed: ",
-				fmt.Sprintf("%.3f MB/s", speed/1000000.0),
+			err := options.Stream.AddPiece(PiecesBytes, msg.Payload.(messages.Piece).Data, msg.Payload.(messages.Piece).PieceIndex)
+			if err != nil {
+				Fail(fmt.Errorf("failed to write piece %d to the seed file: %w", selectedPiece, err), status, chanTracker, done, logger)
+				return
+			}
+			partialDumped = false
+			status.AddPiece(selectedPeer, len(msg.Payload.(messages.Piece).Data))
+			logger.Debug("Piece received",
+				"piece", msg.Payload.(messages.Piece).PieceIndex,
+				logging.Peer(selectedPeer),
+				"speed_mbps", speed/1000000.0,
 			)
-			stats.Update(msg.Payload.(messages.Piece).PieceIndex,
-				speed, selectedPeer, PeerPieces.IsSeeder(selectedPeer))
-			if verbosity != utils.DEBUG {
+			stats.Update(msg.Payload.(messages.Piece).PieceIndex, len(msg.Payload.(messages.Piece).Data),
+				latency, selectedPeer, PeerPieces.IsSeeder(selectedPeer))
+			if bar != nil {
 				bar.Add(mtorrrent.Info.Piece_length)
 			}
 		case messages.DEAD_CONNECTION:
-			utils.PrintVerbose(verbosity, utils.DEBUG,
-				"Peer", selectedPeer[:5], "cannot send piece ",
-				selectedPiece,
-				" because it is dead")
+			logger.Debug("Peer cannot send piece because it is dead", "piece", selectedPiece, logging.Peer(selectedPeer))
+			continue // The piece did not arrive, so it is not advertised
+		case messages.REJECT:
+			// The peer is paused. Its pieces are ignored until it sends a new bitfield
+			logger.Debug("Peer rejected piece", "piece", selectedPiece, logging.Peer(selectedPeer))
+			PeerPieces.SetBitfield(selectedPeer, messages.Bitfield{Bitfield: make([]bool, numberOfPieces)})
+			status.SetChoked(selectedPeer, true)
+			continue
 		default:
 			panic("Unknown message type received at PieceRequester!")
 		}
@@ -135,72 +191,330 @@ func AssemblePieces(
 	mtorrent mtorr.Mtorrent,
 	PiecesBytes *PiecesBytes,
 	SeedMode *SeedMode,
+	status *TorrentStatus,
+	bus *events.Bus,
 	chanTracker chan messages.ControlMessage,
 	stats *DownloadStats,
-	wait *sync.WaitGroup,
-	verbosity int,
+	done chan struct{},
+	logger *slog.Logger,
 	bar *progressbar.ProgressBar,
 ) {
-	if verbosity != utils.DEBUG {
+	if bar != nil {
 		bar.Exit()
 	}
-	utils.PrintVerbose(verbosity, utils.VERBOSE, "All pieces downloaded. Assembling...")
+	var err error
+	if PiecesBytes.source != nil {
+		err = CheckSeedFile(mtorrent, PiecesBytes.source, logger)
+	} else {
+		err = AssembleData(mtorrent, PiecesBytes, logger)
+	}
+	if err != nil {
+		Fail(err, status, chanTracker, done, logger)
+		return
+	}
+	status.SetCompleted()
+	bus.Publish(TorrentEvent(events.DOWNLOAD_COMPLETED, mtorrent, SeedMode, "", 0))
+	logger.Info("Download stats", "stats", stats)
+	if stats.File != "" {
+		err = stats.Write(stats.File)
+		if err != nil {
+			logger.Warn("Failed to write the download stats", "file", stats.File, "error", err)
+		} else {
+			logger.Info("Download stats written", "file", stats.File)
+		}
+	}
+	if SeedMode.auto || SeedMode.HasGoals() {
+		logger.Info("Changed to seeding mode")
+		SeedMode.active = true
+		if SeedMode.SeedFile == "" {
+			SeedMode.SeedFile = mtorrent.Info.Name
+		}
+		status.SetSeeding()
+		bus.Publish(TorrentEvent(events.SEEDING_STARTED, mtorrent, SeedMode, "", 0))
+		NotifyTracker(chanTracker, messages.TRACKER_SEEDING, done)
+		if SeedMode.HasGoals() {
+			go SeedUntilGoals(mtorrent, SeedMode, status, chanTracker, done, logger)
+		}
+	} else {
+		logger.Info("Exiting swarm...")
+		NotifyTracker(chanTracker, messages.TRACKER_COMPLETED, done)
+	}
+}
 
+// Writes the pieces downloaded into memory to the file of mtorrent
+func AssembleData(mtorrent mtorr.Mtorrent, PiecesBytes *PiecesBytes, logger *slog.Logger) error {
+	logger.Info("All pieces downloaded. Assembling...")
 	var data []byte
 	for i := 0; i < len(PiecesBytes.Pieces); i++ {
-		data = append(data, PiecesBytes.Pieces[i]...)
+		piece, err := PiecesBytes.GetPiece(i)
+		if err != nil {
+			return fmt.Errorf("failed to read piece %d: %w", i, err)
+		}
+		data = append(data, piece...)
 	}
 	// Checks the Sha1sum
 	if fmt.Sprintf("%x", sha1.Sum(data)) != mtorrent.Info.Id {
-		utils.PrintVerbose(verbosity, utils.CRITICAL, "Assembled pieces SHA1 does not match with Mtorrent SHA1!.")
-		utils.PrintVerbose(verbosity, utils.DEBUG, "Assembled pieces SHA1: ", fmt.Sprintf("%x", sha1.Sum(data)), " \nMtorrent SHA1:", mtorrent.Info.Id)
+		logger.Error("Assembled pieces SHA1 does not match with Mtorrent SHA1!",
+			"sha1", fmt.Sprintf("%x", sha1.Sum(data)), "expected", mtorrent.Info.Id)
 	} else {
-		utils.PrintVerbose(verbosity, utils.INFORMATION, "Assembled pieces SHA1 matches with Mtorrent SHA1")
+		logger.Info("Assembled pieces SHA1 matches with Mtorrent SHA1")
 	}
 
-	utils.PrintVerbose(verbosity, utils.INFORMATION, "Dumping Data...")
-	err := os.WriteFile(mtorrent.Info.Name, data, 0644)
-	utils.Check(err, verbosity, "Failed to write assembled data to disk")
-	utils.PrintVerbose(verbosity, utils.VERBOSE, "Data dumped to disk")
-	utils.PrintVerbose(verbosity, utils.CRITICAL, stats)
-	if SeedMode.auto {
-		utils.PrintVerbose(verbosity, utils.VERBOSE, "Changed to seeding mode")
-		SeedMode.active = true
-		SeedMode.SeedFile = mtorrent.Info.Name
+	logger.Info("Dumping Data...", "file", mtorrent.Info.Name)
+	err := WriteData(mtorrent.Info.Name, data)
+	if err != nil {
+		return fmt.Errorf("failed to write assembled data to disk: %w", err)
+	}
+	logger.Info("Data dumped to disk")
+	return nil
+}
+
+/*
+Completes the seed file of lazy seed mode, whose pieces were written to it as they arrived.
+
+	The file is cut to the length of mtorrent and hashed from disk,
+	without reading it into memory
+*/
+func CheckSeedFile(mtorrent mtorr.Mtorrent, file *os.File, logger *slog.Logger) error {
+	logger.Info("All pieces written to the seed file. Checking it...", "file", file.Name())
+	err := file.Truncate(int64(mtorrent.Info.Length))
+	if err != nil {
+		return fmt.Errorf("failed to cut the seed file to its length: %w", err)
+	}
+	hash := sha1.New()
+	_, err = io.Copy(hash, io.NewSectionReader(file, 0, int64(mtorrent.Info.Length)))
+	if err != nil {
+		return fmt.Errorf("failed to read the seed file: %w", err)
+	}
+	if fmt.Sprintf("%x", hash.Sum(nil)) != mtorrent.Info.Id {
+		logger.Error("Seed file SHA1 does not match with Mtorrent SHA1!",
+			"sha1", fmt.Sprintf("%x", hash.Sum(nil)), "expected", mtorrent.Info.Id)
 	} else {
-		utils.PrintVerbose(verbosity, utils.VERBOSE, "Exiting swarm...")
-		chanTracker <- messages.ControlMessage{
-			Opcode:  messages.TRACKER_COMPLETED,
-			PeerId:  "",
-			Payload: nil,
+		logger.Info("Seed file SHA1 matches with Mtorrent SHA1")
+	}
+	return nil
+}
+
+/*
+Writes the downloaded pieces to disk when the skipped ones are missing.
+
+	The file gets its final size and the wanted parts at their offsets.
+	Skipped pieces are left as they were, zeroes in a new file
+*/
+func DumpPartial(mtorrent mtorr.Mtorrent, PiecesBytes *PiecesBytes, logger *slog.Logger) error {
+	logger.Info("All wanted pieces downloaded. Dumping them, skipped pieces are left empty...", "file", mtorrent.Info.Name)
+	file, err := os.OpenFile(mtorrent.Info.Name, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open file for partial data: %w", err)
+	}
+	defer file.Close()
+	err = file.Truncate(int64(mtorrent.Info.Length))
+	if err != nil {
+		return fmt.Errorf("failed to write partial data to disk: %w", err)
+	}
+	for i := range PiecesBytes.Pieces {
+		if !PiecesBytes.Has(i) {
+			continue
+		}
+		piece, err := PiecesBytes.GetPiece(i)
+		if err != nil {
+			return fmt.Errorf("failed to read piece %d of the seed file: %w", i, err)
 		}
-		<-chanTracker
-		wait.Done()
+		_, err = file.WriteAt(piece, int64(i*mtorrent.Info.Piece_length))
+		if err != nil {
+			return fmt.Errorf("failed to write partial data to disk: %w", err)
+		}
+	}
+	logger.Info("Partial data dumped to disk")
+	return nil
+}
+
+// Writes data to fileName
+func WriteData(fileName string, data []byte) error {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteAt(data, 0)
+	if err != nil {
+		return err
 	}
+	return file.Truncate(int64(len(data)))
 }
 
 func PieceUploader(
 	PiecesBytes *PiecesBytes,
+	status *TorrentStatus,
 	mtorrent mtorr.Mtorrent,
+	stream *Stream,
 	chanPieceUploader, chanCore chan messages.ControlMessage,
-	verbosity int,
+	done chan struct{},
+	logger *slog.Logger,
 ) {
+	var msg messages.ControlMessage
 	for {
-		msg := <-chanPieceUploader
+		select {
+		case msg = <-chanPieceUploader:
+		case <-done:
+			return
+		}
+		if status.IsPaused() {
+			chanCore <- messages.ControlMessage{
+				Opcode:  messages.REJECT,
+				PeerId:  msg.PeerId,
+				Payload: messages.Reject{PieceIndex: msg.Payload.(messages.Request).PieceIndex},
+			}
+			continue
+		}
 		go func(msg messages.ControlMessage) {
+			index := msg.Payload.(messages.Request).PieceIndex
+			if PiecesBytes.source != nil && !PiecesBytes.Has(index) {
+				have, found := PiecesBytes.CheckPiece(index)
+				if found {
+					status.AddChecked()
+					stream.Wake()
+					chanCore <- messages.ControlMessage{Opcode: messages.HAVE, Payload: messages.Have{PieceIndex: index}}
+				}
+				if !have {
+					logger.Debug("Piece of the seed file does not match, rejecting", "piece", index, logging.Peer(msg.PeerId))
+					chanCore <- messages.ControlMessage{Opcode: messages.REJECT, PeerId: msg.PeerId, Payload: messages.Reject{PieceIndex: index}}
+					// The peer forgets our pieces on a reject
+					chanCore <- messages.ControlMessage{Opcode: messages.BITFIELD, PeerId: msg.PeerId, Payload: messages.Bitfield{Bitfield: PiecesBytes.Snapshot()}}
+					return
+				}
+			}
+			data, err := PiecesBytes.GetPiece(index)
+			if err != nil {
+				logger.Warn("Cannot upload piece", "piece", index, "error", err)
+				chanCore <- messages.ControlMessage{Opcode: messages.REJECT, PeerId: msg.PeerId, Payload: messages.Reject{PieceIndex: index}}
+				return
+			}
 			chanCore <- messages.ControlMessage{
 				Opcode: messages.PIECE,
 				PeerId: msg.PeerId,
 				Payload: messages.Piece{
-					PieceIndex: msg.Payload.(messages.Request).PieceIndex,
-					Data:       PiecesBytes.Pieces[msg.Payload.(messages.Request).PieceIndex],
+					PieceIndex: index,
+					Data:       data,
 				},
 			}
-			utils.PrintVerbose(
-				verbosity, utils.DEBUG,
-				"Sent piece ", msg.Payload.(messages.Request).PieceIndex,
-				" to: ", msg.PeerId[:5],
-			)
+			status.AddUploaded(msg.PeerId, len(data))
+			logger.Debug("Sent piece", "piece", index, logging.Peer(msg.PeerId))
 		}(msg)
 	}
 }
+
+// Waits WAIT_DEFAULT_TIME while no piece is requested, discarding the messages for PieceRequester. Returns false if the torrent stopped
+func Idle(chanPieceRequester chan messages.ControlMessage, done chan struct{}) bool {
+	timer := time.NewTimer(WAIT_DEFAULT_TIME)
+	defer timer.Stop()
+	for {
+		select {
+		case <-chanPieceRequester:
+		case <-timer.C:
+			return true
+		case <-done:
+			return false
+		}
+	}
+}
+
+/*
+Hashes the pieces of the seed file in lazy seed mode, advertising each one that matches.
+
+	If all match, the torrent is seeded like a complete file. Otherwise the
+	pieces found are seeded while the others are downloaded, as a partial seed
+*/
+func VerifySeedFile(
+	PeerPieces *SyncPeerPieces,
+	PiecesBytes *PiecesBytes,
+	SeedMode *SeedMode,
+	status *TorrentStatus,
+	mtorrent mtorr.Mtorrent,
+	numberOfPieces int,
+	options Options,
+	priorities *Priorities,
+	bus *events.Bus,
+	chanPieceRequester, chanCore, chanTracker chan messages.ControlMessage,
+	done chan struct{},
+	logger *slog.Logger,
+) {
+	for i := 0; i < numberOfPieces; i++ {
+		have, found := PiecesBytes.CheckPiece(i)
+		if !found {
+			if !have {
+				logger.Debug("Piece of the seed file does not match", "piece", i)
+			}
+			continue
+		}
+		status.AddChecked()
+		options.Stream.Wake()
+		select {
+		case chanCore <- messages.ControlMessage{Opcode: messages.HAVE, Payload: messages.Have{PieceIndex: i}}:
+		case <-done:
+			return
+		}
+	}
+	status.Lock.RLock()
+	piecesHave := status.PiecesHave
+	status.Lock.RUnlock()
+	if piecesHave == numberOfPieces {
+		logger.Info("Seed file verified")
+		status.SetSeeding()
+		bus.Publish(TorrentEvent(events.SEEDING_STARTED, mtorrent, SeedMode, "", 0))
+		// The tracker was told the pieces missing before the check
+		if !NotifyTracker(chanTracker, messages.TRACKER_SEEDING, done) {
+			return
+		}
+		if SeedMode.HasGoals() {
+			SeedUntilGoals(mtorrent, SeedMode, status, chanTracker, done, logger)
+		}
+		return
+	}
+	logger.Info("Some pieces of the seed file do not match, downloading them", "matching", piecesHave, "pieces", numberOfPieces)
+	SeedMode.active = false
+	// Other partial seeds may have the missing pieces, so no seeder is waited for
+	options.WaitSeeders = 0
+	PieceRequester(PeerPieces, PiecesBytes, SeedMode, status, mtorrent, numberOfPieces, options, priorities, bus,
+		chanPieceRequester, chanCore, chanTracker, done, logger, nil)
+}
+
+/*
+Seeds until the share ratio or the seed time goal is reached, then leaves the swarm.
+
+	The ratio is the bytes uploaded over the bytes downloaded, or over
+	the file length for peers that started as seeders
+*/
+func SeedUntilGoals(
+	mtorrent mtorr.Mtorrent,
+	SeedMode *SeedMode,
+	status *TorrentStatus,
+	chanTracker chan messages.ControlMessage,
+	done chan struct{},
+	logger *slog.Logger,
+) {
+	start := time.Now()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		status.Lock.RLock()
+		uploaded, downloaded := status.Uploaded, status.Downloaded
+		status.Lock.RUnlock()
+		if downloaded == 0 {
+			downloaded = int64(mtorrent.Info.Length)
+		}
+		ratio := float64(uploaded) / float64(downloaded)
+		seedTime := time.Since(start)
+		if (SeedMode.ratio > 0 && ratio >= SeedMode.ratio) || (SeedMode.time > 0 && seedTime >= SeedMode.time) {
+			logger.Info("Seeding goal reached", "ratio", ratio, "seed_time", seedTime.Round(time.Second))
+			logger.Info("Exiting swarm...")
+			NotifyTracker(chanTracker, messages.TRACKER_COMPLETED, done)
+			return
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/mtorr"
+)
+
+// Download priority of a piece. Skipped pieces are never requested
+const (
+	PRIORITY_SKIP = iota
+	PRIORITY_LOW
+	PRIORITY_NORMAL
+	PRIORITY_HIGH
+)
+
+var PRIORITY_NAMES = []string{"skip", "low", "normal", "high"}
+
+// Priority of each piece of a torrent, changed while it downloads. A nil *Priorities has every piece at PRIORITY_NORMAL
+type Priorities struct {
+	lock  sync.RWMutex
+	piece []int
+}
+
+func NumberOfPieces(mtorrent mtorr.Mtorrent) int {
+	return int(math.Ceil(
+		float64(mtorrent.Info.Length) / float64(mtorrent.Info.Piece_length),
+	))
+}
+
+func NewPriorities(numberOfPieces int) *Priorities {
+	priorities := &Priorities{piece: make([]int, numberOfPieces)}
+	for i := range priorities.piece {
+		priorities.piece[i] = PRIORITY_NORMAL
+	}
+	return priorities
+}
+
+func (p *Priorities) Get(index int) int {
+	if p == nil {
+		return PRIORITY_NORMAL
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.piece[index]
+}
+
+/*
+Sets priorities from specs such as "high:0-9", "skip:100-" or "low:42".
+
+	Each spec is a priority name and a range of piece indexes, both ends
+	included. A range without an end goes to the last piece. Later specs
+	override earlier ones. Nothing is changed if any spec is invalid
+*/
+func (p *Priorities) Apply(specs []string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	updated := make([]int, len(p.piece))
+	copy(updated, p.piece)
+	for _, spec := range specs {
+		priority, from, to, err := parsePrioritySpec(spec, len(p.piece))
+		if err != nil {
+			return err
+		}
+		for i := from; i <= to; i++ {
+			updated[i] = priority
+		}
+	}
+	p.piece = updated
+	return nil
+}
+
+// Whether some piece that is not skipped is still missing
+func (p *Priorities) Wanted(have []bool) bool {
+	for i := range have {
+		if !have[i] && p.Get(i) != PRIORITY_SKIP {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePrioritySpec(spec string, numberOfPieces int) (int, int, int, error) {
+	name, pieces, found := strings.Cut(spec, ":")
+	if !found {
+		return 0, 0, 0, fmt.Errorf("invalid priority %q, expected priority:pieces such as high:0-9", spec)
+	}
+	priority := -1
+	for i, priorityName := range PRIORITY_NAMES {
+		if strings.EqualFold(name, priorityName) {
+			priority = i
+		}
+	}
+	if priority < 0 {
+		return 0, 0, 0, fmt.Errorf("unknown priority %q, expected one of %s", name, strings.Join(PRIORITY_NAMES, ", "))
+	}
+	first, last, isRange := strings.Cut(pieces, "-")
+	from, err := strconv.Atoi(first)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid piece range %q", pieces)
+	}
+	to := from
+	if isRange && last == "" {
+		to = numberOfPieces - 1
+	} else if isRange {
+		to, err = strconv.Atoi(last)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid piece range %q", pieces)
+		}
+	}
+	if from < 0 || to < from || to >= numberOfPieces {
+		return 0, 0, 0, fmt.Errorf("piece range %q out of the %d pieces of the torrent", pieces, numberOfPieces)
+	}
+	return priority, from, to, nil
+}
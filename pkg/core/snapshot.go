@@ -0,0 +1,112 @@
+package core
+
+import (
+	"sort"
+	"time"
+)
+
+/*
+Copy of the state of a torrent at one moment, for displays such as the TUI.
+
+	Taken with TorrentStatus.Snapshot, which copies the pieces and the
+	peers under their locks, so the copy can be read while core goes on
+*/
+type Snapshot struct {
+	Have         []bool         // Pieces this client has
+	Availability []int          // Connected peers that have each piece
+	Priorities   []int          // PRIORITY_* of each piece
+	Peers        []PeerSnapshot // Sorted by id
+	Tracker      string         // Announce URL, empty for trackerless torrents
+	LastAnnounce time.Time      // When the tracker last answered
+	TrackerErr   error          // Error of the last announce, nil if it succeeded
+}
+
+type PeerSnapshot struct {
+	Id string
+	PeerStatus
+	Pieces int  // Pieces the peer has
+	Seeder bool // Has all pieces
+}
+
+// Copy of the pieces each connected peer has
+func (sp *SyncPeerPieces) Snapshot() map[string][]bool {
+	sp.Lock.RLock()
+	defer sp.Lock.RUnlock()
+	peers := make(map[string][]bool, len(sp.Have))
+	for peerId, have := range sp.Have {
+		peers[peerId] = append([]bool(nil), have...)
+	}
+	return peers
+}
+
+// Copy of the pieces this client has
+func (p *PiecesBytes) Snapshot() []bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]bool(nil), p.Have...)
+}
+
+// Copy of the priority of each piece
+func (p *Priorities) Snapshot(numberOfPieces int) []int {
+	if p == nil {
+		priorities := make([]int, numberOfPieces)
+		for i := range priorities {
+			priorities[i] = PRIORITY_NORMAL
+		}
+		return priorities
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return append([]int(nil), p.piece...)
+}
+
+// Takes a snapshot of the state of core, empty until core starts
+func (ts *TorrentStatus) Snapshot() Snapshot {
+	ts.Lock.RLock()
+	snapshot := ts.snapshot
+	ts.Lock.RUnlock()
+	if snapshot == nil {
+		return Snapshot{}
+	}
+	return snapshot()
+}
+
+// Called by core with the structures its snapshots are taken from
+func (ts *TorrentStatus) setSnapshot(PeerPieces *SyncPeerPieces, PiecesBytes *PiecesBytes, priorities *Priorities) {
+	ts.Lock.Lock()
+	defer ts.Lock.Unlock()
+	ts.snapshot = func() Snapshot {
+		return takeSnapshot(PeerPieces, PiecesBytes, priorities, ts)
+	}
+}
+
+func takeSnapshot(PeerPieces *SyncPeerPieces, PiecesBytes *PiecesBytes, priorities *Priorities, status *TorrentStatus) Snapshot {
+	have := PiecesBytes.Snapshot()
+	snapshot := Snapshot{
+		Have:         have,
+		Availability: make([]int, len(have)),
+		Priorities:   priorities.Snapshot(len(have)),
+		Peers:        make([]PeerSnapshot, 0),
+	}
+	peerStatuses := status.PeerStatuses()
+	for peerId, peerHave := range PeerPieces.Snapshot() {
+		peer := PeerSnapshot{Id: peerId, PeerStatus: peerStatuses[peerId]}
+		for i := range peerHave {
+			if peerHave[i] && i < len(have) {
+				snapshot.Availability[i]++
+				peer.Pieces++
+			}
+		}
+		peer.Seeder = peer.Pieces == len(have)
+		snapshot.Peers = append(snapshot.Peers, peer)
+	}
+	sort.Slice(snapshot.Peers, func(i, j int) bool {
+		return snapshot.Peers[i].Id < snapshot.Peers[j].Id
+	})
+	status.Lock.RLock()
+	snapshot.Tracker = status.Tracker
+	snapshot.LastAnnounce = status.LastAnnounce
+	snapshot.TrackerErr = status.TrackerErr
+	status.Lock.RUnlock()
+	return snapshot
+}
@@ -0,0 +1,251 @@
+package core
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/mtorr"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/utils"
+)
+
+/*
+Statistics of a download, written to disk with --stats-out.
+
+	Every downloaded piece is recorded with the peer it came from, so the
+	behaviour of the swarm can be studied after the download. The file is
+	written as JSON, or as CSV when its name ends in .csv
+*/
+type DownloadStats struct {
+	Id          string        `json:"id"`
+	Name        string        `json:"name"`
+	Length      int           `json:"length"`
+	PieceLength int           `json:"piece_length"`
+	Started     time.Time     `json:"started"`  // When the pieces started being requested
+	Finished    time.Time     `json:"finished"` // When the last piece arrived
+	Pieces      []PieceRecord `json:"pieces"`   // In the order they arrived
+	File        string        `json:"-"`        // Where the stats are written, if set
+}
+
+type PieceRecord struct {
+	Piece   int       `json:"piece"`
+	Time    time.Time `json:"time"` // When the piece arrived
+	Peer    string    `json:"peer"`
+	Seeder  bool      `json:"seeder"` // Whether the peer was a seeder when the piece arrived
+	Size    int       `json:"size"`
+	Speed   float64   `json:"speed"`   // Bytes per second
+	Latency float64   `json:"latency"` // Seconds from the request to the piece
+}
+
+// Totals of the pieces downloaded from a peer
+type PeerRecord struct {
+	Peer           string  `json:"peer"`
+	Seeder         bool    `json:"seeder"` // Sent some piece as a seeder
+	Pieces         int     `json:"pieces"`
+	Bytes          int64   `json:"bytes"`
+	Share          float64 `json:"share"`         // Fraction of the downloaded pieces
+	AverageSpeed   float64 `json:"average_speed"` // Bytes per second
+	MedianSpeed    float64 `json:"median_speed"`
+	AverageLatency float64 `json:"average_latency"` // Seconds
+}
+
+var PIECES_HEADER = []string{"piece", "time", "peer", "seeder", "size", "speed", "latency"}
+var PEERS_HEADER = []string{"peer", "seeder", "pieces", "bytes", "share", "average_speed", "median_speed", "average_latency"}
+
+func NewDownloadStats(mtorrent mtorr.Mtorrent, file string) *DownloadStats {
+	return &DownloadStats{
+		Id:          mtorrent.Info.Id,
+		Name:        mtorrent.Info.Name,
+		Length:      mtorrent.Info.Length,
+		PieceLength: mtorrent.Info.Piece_length,
+		Pieces:      make([]PieceRecord, 0),
+		File:        file,
+	}
+}
+
+// Records a piece that arrived now, latency after it was requested
+func (ds *DownloadStats) Update(piece, size int, latency time.Duration, peer string, seeder bool) {
+	now := time.Now()
+	ds.Pieces = append(ds.Pieces, PieceRecord{
+		Piece:   piece,
+		Time:    now,
+		Peer:    peer,
+		Seeder:  seeder,
+		Size:    size,
+		Speed:   float64(size) / latency.Seconds(),
+		Latency: latency.Seconds(),
+	})
+	ds.Finished = now
+}
+
+// Per-peer totals, in the order the peers sent their first piece
+func (ds *DownloadStats) Peers() []PeerRecord {
+	peers := make([]PeerRecord, 0)
+	index := make(map[string]int)
+	speeds := make(map[string][]float64)
+	for _, record := range ds.Pieces {
+		i, ok := index[record.Peer]
+		if !ok {
+			i = len(peers)
+			index[record.Peer] = i
+			peers = append(peers, PeerRecord{Peer: record.Peer})
+		}
+		peers[i].Seeder = peers[i].Seeder || record.Seeder
+		peers[i].Pieces++
+		peers[i].Bytes += int64(record.Size)
+		peers[i].AverageLatency += record.Latency
+		speeds[record.Peer] = append(speeds[record.Peer], record.Speed)
+	}
+	for i := range peers {
+		peers[i].Share = float64(peers[i].Pieces) / float64(len(ds.Pieces))
+		peers[i].AverageSpeed = mean(speeds[peers[i].Peer])
+		peers[i].MedianSpeed = utils.Median(speeds[peers[i].Peer])
+		peers[i].AverageLatency /= float64(peers[i].Pieces)
+	}
+	return peers
+}
+
+// Average and median speed of the pieces, in bytes per second
+func (ds *DownloadStats) Speeds() (float64, float64) {
+	speeds := make([]float64, len(ds.Pieces))
+	for i, record := range ds.Pieces {
+		speeds[i] = record.Speed
+	}
+	return mean(speeds), utils.Median(speeds)
+}
+
+// Fraction of the pieces downloaded from seeders
+func (ds *DownloadStats) FromSeeders() float64 {
+	if len(ds.Pieces) == 0 {
+		return 0
+	}
+	seeders := 0
+	for _, record := range ds.Pieces {
+		if record.Seeder {
+			seeders++
+		}
+	}
+	return float64(seeders) / float64(len(ds.Pieces))
+}
+
+/*
+Writes the stats to fileName.
+
+	As JSON, with the pieces and the per-peer totals. As CSV when
+	fileName ends in .csv, with one row for each piece, and the per-peer
+	totals in a second file named like fileName with .peers.csv instead
+*/
+func (ds *DownloadStats) Write(fileName string) error {
+	if strings.EqualFold(filepath.Ext(fileName), ".csv") {
+		return ds.writeCSV(fileName)
+	}
+	average, median := ds.Speeds()
+	data, err := json.MarshalIndent(struct {
+		*DownloadStats
+		AverageSpeed float64      `json:"average_speed"`
+		MedianSpeed  float64      `json:"median_speed"`
+		FromSeeders  float64      `json:"from_seeders"`
+		Peers        []PeerRecord `json:"peers"`
+	}{ds, average, median, ds.FromSeeders(), ds.Peers()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, append(data, '\n'), 0644)
+}
+
+func (ds *DownloadStats) writeCSV(fileName string) error {
+	rows := [][]string{PIECES_HEADER}
+	for _, record := range ds.Pieces {
+		rows = append(rows, []string{
+			strconv.Itoa(record.Piece),
+			record.Time.Format(time.RFC3339Nano),
+			record.Peer,
+			strconv.FormatBool(record.Seeder),
+			strconv.Itoa(record.Size),
+			formatFloat(record.Speed),
+			formatFloat(record.Latency),
+		})
+	}
+	err := writeRows(fileName, rows)
+	if err != nil {
+		return err
+	}
+	rows = [][]string{PEERS_HEADER}
+	for _, peer := range ds.Peers() {
+		rows = append(rows, []string{
+			peer.Peer,
+			strconv.FormatBool(peer.Seeder),
+			strconv.Itoa(peer.Pieces),
+			strconv.FormatInt(peer.Bytes, 10),
+			formatFloat(peer.Share),
+			formatFloat(peer.AverageSpeed),
+			formatFloat(peer.MedianSpeed),
+			formatFloat(peer.AverageLatency),
+		})
+	}
+	return writeRows(strings.TrimSuffix(fileName, filepath.Ext(fileName))+".peers.csv", rows)
+}
+
+func writeRows(fileName string, rows [][]string) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	writer := csv.NewWriter(file)
+	writer.WriteAll(rows)
+	if err = writer.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (ds *DownloadStats) String() string {
+	var stats strings.Builder
+	average, median := ds.Speeds()
+	stats.WriteString("\n---------------- DOWNLOAD STATS ----------------\n")
+	stats.WriteString(fmt.Sprintf("Average speed: %.3f MB/s\n", average/1000000.0))
+	stats.WriteString(fmt.Sprintf("Median speed: %.3f MB/s\n", median/1000000.0))
+	for _, peer := range ds.Peers() {
+		stats.WriteString(fmt.Sprintf("Peer %v: %.1f%% of pieces downloaded\n", peer.Peer, peer.Share*100))
+	}
+	stats.WriteString(fmt.Sprintf("Downloaded from Seeders: %.1f%%\n", ds.FromSeeders()*100))
+	stats.WriteString("---------------- END ----------------\n")
+
+	return stats.String()
+}
+
+// Logged as a group of attributes
+func (ds *DownloadStats) LogValue() slog.Value {
+	average, median := ds.Speeds()
+	attrs := []slog.Attr{
+		slog.String("average_speed", fmt.Sprintf("%.3f MB/s", average/1000000.0)),
+		slog.String("median_speed", fmt.Sprintf("%.3f MB/s", median/1000000.0)),
+	}
+	for _, peer := range ds.Peers() {
+		attrs = append(attrs, slog.String("peer_"+peer.Peer, fmt.Sprintf("%.1f%%", peer.Share*100)))
+	}
+	attrs = append(attrs, slog.String("from_seeders", fmt.Sprintf("%.1f%%", ds.FromSeeders()*100)))
+	return slog.GroupValue(attrs...)
+}
+
+func mean(data []float64) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, value := range data {
+		sum += value
+	}
+	return sum / float64(len(data))
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,125 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Order in which missing pieces are requested
+const (
+	ORDER_RAREST     = iota // Rarest pieces first, best for the swarm
+	ORDER_SEQUENTIAL        // From the first piece to the last
+	ORDER_STREAMING         // From the piece being read by the stream, then rarest
+)
+
+/*
+Reads the file of a torrent while it downloads.
+
+	Reads block until the pieces they need arrive, and move the read position
+	used by ORDER_STREAMING. Reads of pieces skipped by their priority fail
+	instead, as they never arrive. Stream implements io.ReaderAt
+*/
+type Stream struct {
+	lock        sync.Mutex
+	arrived     *sync.Cond
+	pieces      *PiecesBytes
+	priorities  *Priorities
+	pieceLength int
+	length      int
+	position    int
+	stopped     bool
+}
+
+func NewStream() *Stream {
+	stream := &Stream{}
+	stream.arrived = sync.NewCond(&stream.lock)
+	return stream
+}
+
+// Called by core once the pieces are allocated
+func (s *Stream) attach(pieces *PiecesBytes, priorities *Priorities, pieceLength, length int) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pieces = pieces
+	s.priorities = priorities
+	s.pieceLength = pieceLength
+	s.length = length
+	s.arrived.Broadcast()
+}
+
+// Stores a downloaded piece, see PiecesBytes.WritePiece, waking up the reads waiting for it. Works on a nil stream
+func (s *Stream) AddPiece(pieces *PiecesBytes, piece []byte, index int) error {
+	if s == nil {
+		return pieces.WritePiece(piece, index)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := pieces.WritePiece(piece, index)
+	s.arrived.Broadcast()
+	return err
+}
+
+// Wakes up the waiting reads, once pieces are found in the seed file or priorities change. Works on a nil stream
+func (s *Stream) Wake() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.arrived.Broadcast()
+}
+
+// Index of the piece being read
+func (s *Stream) Position() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.position
+}
+
+// Makes pending and future reads fail, once the torrent stops
+func (s *Stream) Stop() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stopped = true
+	s.arrived.Broadcast()
+}
+
+func (s *Stream) ReadAt(p []byte, off int64) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.pieces == nil && !s.stopped {
+		s.arrived.Wait()
+	}
+	n := 0
+	for n < len(p) {
+		if s.stopped {
+			return n, fmt.Errorf("torrent stopped")
+		}
+		offset := int(off) + n
+		if offset >= s.length {
+			return n, io.EOF
+		}
+		index := offset / s.pieceLength
+		s.position = index
+		if !s.pieces.Has(index) {
+			if s.priorities.Get(index) == PRIORITY_SKIP {
+				return n, fmt.Errorf("piece %d is skipped", index)
+			}
+			s.arrived.Wait()
+			continue
+		}
+		piece, err := s.pieces.GetPiece(index)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], piece[offset-index*s.pieceLength:])
+	}
+	return n, nil
+}
@@ -1,15 +1,38 @@
 package core
 
 import (
+	"crypto/sha1"
 	"fmt"
 	"math"
-	"strings"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/rafaelbarbeta/MicroTorr/pkg/messages"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/mtorr"
 	"github.com/rafaelbarbeta/MicroTorr/pkg/utils"
 )
 
+/*
+How a torrent is downloaded and seeded, given when it is added to a session.
+
+	Built from microtorr.Config, the daemon flags or the control API
+*/
+type Options struct {
+	Seed         string        // Complete file to seed. Empty to download to the file name of the .mtorrent
+	AutoSeed     bool          // Seed after the download completes
+	LazySeed     bool          // Hash Seed while seeding it, downloading the pieces that do not match
+	SeedRatio    float64       // Leave the swarm once uploaded/downloaded reaches it. 0 for no goal
+	SeedTime     time.Duration // Leave the swarm after seeding this long. 0 for no goal
+	Order        int           // One of ORDER_*
+	Stream       *Stream       // Read position followed by ORDER_STREAMING, nil for the other orders
+	Priorities   []string      // Specs as in Priorities.Apply, such as high:0-9. Empty to download every piece
+	StatsOut     string        // Write the download stats to this file when it completes. Empty for nowhere
+	WaitSeeders  int           // Seeders to wait for before the download starts
+	WaitLeechers int
+	ShowProgress bool // Draw a progress bar while downloading
+}
+
 // messages Structures
 type SyncPeerPieces struct {
 	Have  map[string][]bool
@@ -18,59 +41,75 @@ type SyncPeerPieces struct {
 }
 
 type PiecesBytes struct {
-	Pieces [][]byte
-	Hash   []string
-	Have   []bool
+	Pieces      [][]byte
+	Hash        []string
+	Have        []bool
+	Checked     []bool   // Pieces of the seed file already hashed, in lazy seed mode
+	source      *os.File // Seed file, read when a piece is not in memory. Downloaded pieces are written to it
+	length      int      // Length of the file and of its pieces, to read them from source
+	pieceLength int
+	lock        sync.Mutex // Guards Pieces, Have and Checked, as pieces are added and hashed while others read them
 }
 
 type SeedMode struct {
 	SeedFile string
 	active   bool
 	auto     bool
+	lazy     bool          // Hash the seed file piece by piece while seeding, downloading the pieces that do not match
+	ratio    float64       // Leave the swarm once uploaded/downloaded reaches it. 0 for no goal
+	time     time.Duration // Leave the swarm after seeding this long. 0 for no goal
 }
 
-type DownloadStats struct {
-	PiecesDownloaded []int     // All the pieces that have been downloaded
-	PiecesSpeed      []float64 // Speed of each piece
-	FromPeers        []string  // Peers that this piece index was downloaded from
-	FromSeeder       []bool    // Whether the piece was downloaded from a seeder
+// Progress of a torrent, read by the session while core runs
+type TorrentStatus struct {
+	Lock           sync.RWMutex
+	NumberOfPieces int
+	PiecesHave     int
+	Peers          int
+	Downloaded     int64   // Bytes of pieces received
+	Uploaded       int64   // Bytes of pieces sent
+	DownRate       float64 // Bytes per second, measured every RATE_INTERVAL
+	UpRate         float64
+	Paused         bool
+	Seeding        bool
+	Completed      bool  // All pieces were downloaded and written to disk
+	Err            error // Why the torrent stopped, if it failed
+	PiecesVerified int   // Downloaded pieces that matched their hash
+	PiecesFailed   int   // Downloaded pieces that did not match their hash
+	PeerStatus     map[string]*PeerStatus
+	Tracker        string    // Announce URL, empty for trackerless torrents
+	LastAnnounce   time.Time // When the tracker last answered
+	TrackerErr     error     // Error of the last announce, nil if it succeeded
+	snapshot       func() Snapshot
 }
 
-func (ds *DownloadStats) Update(piece int, speed float64, peer string, seeder bool) {
-	ds.PiecesDownloaded = append(ds.PiecesDownloaded, piece)
-	ds.PiecesSpeed = append(ds.PiecesSpeed, speed)
-	ds.FromPeers = append(ds.FromPeers, peer)
-	ds.FromSeeder = append(ds.FromSeeder, seeder)
-}
-
-func (ds *DownloadStats) String() string {
-	var stats strings.Builder
-	stats.WriteString("\n---------------- DOWNLOAD STATS ----------------\n")
-	stats.WriteString(fmt.Sprintf("Average speed: %.3f MB/s\n", utils.Median(ds.PiecesSpeed)/1000000.0))
-	for _, peerId := range utils.UniqueValues(ds.FromPeers) {
-		stats.WriteString(fmt.Sprintf("Peer %v: %v%% of pieces downloaded\n",
-			peerId[:5],
-			float64(utils.Count(ds.FromPeers, peerId))/
-				float64(len(ds.PiecesDownloaded))*100))
-	}
-	stats.WriteString(fmt.Sprintf("Downloaded from Seeders: %v%%\n",
-		float64(utils.Count(ds.FromSeeder, true))/
-			float64(len(ds.PiecesDownloaded))*100))
-
-	stats.WriteString("---------------- END ----------------\n")
+/*
+Transfers with a connected peer.
 
-	return stats.String()
+	There is no choking in MicroTorr. A peer chokes us when it rejects our
+	requests because it is paused, and we choke all peers while paused
+*/
+type PeerStatus struct {
+	Addr       string // Remote address of the connection
+	Downloaded int64
+	Uploaded   int64
+	DownRate   float64 // Bytes per second, measured every RATE_INTERVAL
+	UpRate     float64
+	Choked     bool // Rejected our last request. Cleared by its next bitfield
+	lastDown   int64
+	lastUp     int64
 }
 
 /*
 Returns the rarest pieces and the peers that have them.
 
-	rareRank = -1 will return the rarest pieces among all peers,
-	otherwise it will return the rarest pieces that are owned by
-	 at least rareRank peers
-	 returns List of pieces indexes, paired with their peers, and the minimum rare rank
+	Only the missing pieces of the highest priority some peer has are
+	considered, and skipped pieces never are. If no peer has a wanted
+	piece, the wanted pieces are returned without peers.
+	 returns List of pieces indexes, paired with their peers
 */
-func (sp *SyncPeerPieces) RarestPieces(PieceBytes *PiecesBytes, numberOfPieces int) ([]int, [][]string) {
+func (sp *SyncPeerPieces) RarestPieces(PieceBytes *PiecesBytes, priorities *Priorities, numberOfPieces int) ([]int, [][]string) {
+	myPieces := PieceBytes.Snapshot()
 	sp.Lock.Lock()
 	rarities := make([]int, numberOfPieces)
 	peerHasPiece := make([][]string, numberOfPieces)
@@ -78,7 +117,7 @@ func (sp *SyncPeerPieces) RarestPieces(PieceBytes *PiecesBytes, numberOfPieces i
 	peerHasRarePiece := make([][]string, 0)
 	// My pieces
 	for i := range rarities {
-		if PieceBytes.Have[i] {
+		if myPieces[i] {
 			rarities[i]++
 		}
 	}
@@ -92,11 +131,31 @@ func (sp *SyncPeerPieces) RarestPieces(PieceBytes *PiecesBytes, numberOfPieces i
 		}
 	}
 	sp.Lock.Unlock()
-	// Find rarest pieces that this client does not own already
-	minRarity := utils.MinWithExclusion(rarities, PieceBytes.Have)
+	// Highest priority among the pieces this client wants and some peer has
+	wanted := make([]bool, numberOfPieces)
+	topPriority := PRIORITY_SKIP
+	for i := range rarities {
+		wanted[i] = !myPieces[i] && priorities.Get(i) != PRIORITY_SKIP
+		if wanted[i] && rarities[i] > 0 && priorities.Get(i) > topPriority {
+			topPriority = priorities.Get(i)
+		}
+	}
+	// Find rarest pieces of that priority
+	unavailable := make([]bool, numberOfPieces)
+	for i := range rarities {
+		unavailable[i] = !wanted[i] || rarities[i] == 0 || priorities.Get(i) < topPriority
+	}
+	minRarity := utils.MinWithExclusion(rarities, unavailable)
+	if minRarity == math.MaxInt { // No connected peer has the missing pieces, returned without peers
+		minRarity = 0
+		unavailable = make([]bool, numberOfPieces)
+		for i := range unavailable {
+			unavailable[i] = !wanted[i]
+		}
+	}
 
 	for i := range rarities {
-		if rarities[i] == minRarity && !PieceBytes.Have[i] {
+		if rarities[i] == minRarity && !unavailable[i] {
 			rarePieces = append(rarePieces, i)
 			peerHasRarePiece = append(peerHasRarePiece, peerHasPiece[i])
 		}
@@ -105,6 +164,34 @@ func (sp *SyncPeerPieces) RarestPieces(PieceBytes *PiecesBytes, numberOfPieces i
 	return rarePieces, peerHasRarePiece
 }
 
+/*
+First piece from index on that this client wants and some peer has, or -1.
+
+	Only the pieces of the highest priority among those are looked at,
+	so high pieces come first and low ones last, in order
+*/
+func (sp *SyncPeerPieces) FirstPiece(PieceBytes *PiecesBytes, priorities *Priorities, from int) (int, []string) {
+	myPieces := PieceBytes.Snapshot()
+	sp.Lock.RLock()
+	defer sp.Lock.RUnlock()
+	first, firstPeers, firstPriority := -1, []string(nil), PRIORITY_SKIP
+	for i := from; i < len(myPieces) && firstPriority < PRIORITY_HIGH; i++ {
+		if myPieces[i] || priorities.Get(i) <= firstPriority {
+			continue
+		}
+		peers := make([]string, 0)
+		for peer, have := range sp.Have {
+			if have[i] {
+				peers = append(peers, peer)
+			}
+		}
+		if len(peers) > 0 {
+			first, firstPeers, firstPriority = i, peers, priorities.Get(i)
+		}
+	}
+	return first, firstPeers
+}
+
 func (sp *SyncPeerPieces) QuickestPeer(peers []string) string {
 	maxSpeed := float64(-1)
 	quickestPeer := ""
@@ -191,11 +278,57 @@ func (sp *SyncPeerPieces) SetBitfield(peerId string, bitfield messages.Bitfield)
 	sp.Lock.Unlock()
 }
 
+// Piece from memory, or from the seed file in lazy seed mode
 func (p *PiecesBytes) GetPiece(index int) ([]byte, error) {
-	if !p.Have[index] {
+	p.lock.Lock()
+	have, piece := p.Have[index], p.Pieces[index]
+	p.lock.Unlock()
+	if !have {
 		return nil, fmt.Errorf("piece %d not found", index)
 	}
-	return p.Pieces[index], nil
+	if piece != nil || p.source == nil {
+		return piece, nil
+	}
+	return p.readPiece(index)
+}
+
+// Whether this client has the piece
+func (p *PiecesBytes) Has(index int) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.Have[index]
+}
+
+func (p *PiecesBytes) readPiece(index int) ([]byte, error) {
+	offset := index * p.pieceLength
+	data := make([]byte, mtorr.Min(p.pieceLength, p.length-offset))
+	_, err := p.source.ReadAt(data, int64(offset))
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+/*
+Hashes a piece of the seed file the first time it is called for it.
+
+	Returns whether the piece can be uploaded, and whether it was found
+	in the file by this call. Pieces downloaded in the meantime are not
+	read from the file
+*/
+func (p *PiecesBytes) CheckPiece(index int) (bool, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.Checked[index] || p.Have[index] {
+		return p.Have[index], false
+	}
+	p.Checked[index] = true
+	data, err := p.readPiece(index)
+	if err != nil || fmt.Sprintf("%x", sha1.Sum(data)) != p.Hash[index] {
+		return false, false
+	}
+	p.Have[index] = true
+	return true, true
 }
 
 func (p *PiecesBytes) AddHash(sha1Hash string, index int) {
@@ -203,6 +336,139 @@ func (p *PiecesBytes) AddHash(sha1Hash string, index int) {
 }
 
 func (p *PiecesBytes) AddPiece(piece []byte, index int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	p.Pieces[index] = piece
 	p.Have[index] = true
 }
+
+// Stores a downloaded piece, in the seed file in lazy seed mode and in memory otherwise
+func (p *PiecesBytes) WritePiece(piece []byte, index int) error {
+	if p.source == nil {
+		p.AddPiece(piece, index)
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, err := p.source.WriteAt(piece, int64(index*p.pieceLength))
+	if err != nil {
+		return err
+	}
+	p.Have[index] = true
+	return nil
+}
+
+func (ts *TorrentStatus) AddPeer(peerId, addr string) {
+	ts.Lock.Lock()
+	defer ts.Lock.Unlock()
+	if ts.PeerStatus == nil {
+		ts.PeerStatus = make(map[string]*PeerStatus)
+	}
+	ts.Peers++
+	ts.PeerStatus[peerId] = &PeerStatus{Addr: addr}
+}
+
+func (ts *TorrentStatus) DeletePeer(peerId string) {
+	ts.Lock.Lock()
+	defer ts.Lock.Unlock()
+	ts.Peers--
+	delete(ts.PeerStatus, peerId)
+}
+
+// Counts a verified piece received from peerId
+func (ts *TorrentStatus) AddPiece(peerId string, size int) {
+	ts.Lock.Lock()
+	defer ts.Lock.Unlock()
+	ts.PiecesHave++
+	ts.PiecesVerified++
+	ts.Downloaded += int64(size)
+	if peer, ok := ts.PeerStatus[peerId]; ok {
+		peer.Downloaded += int64(size)
+	}
+}
+
+func (ts *TorrentStatus) AddFailed() {
+	ts.Lock.Lock()
+	defer ts.Lock.Unlock()
+	ts.PiecesFailed++
+}
+
+func (ts *TorrentStatus) SetChoked(peerId string, choked bool) {
+	ts.Lock.Lock()
+	defer ts.Lock.Unlock()
+	if peer, ok := ts.PeerStatus[peerId]; ok {
+		peer.Choked = choked
+	}
+}
+
+// Copy of the status of the connected peers
+func (ts *TorrentStatus) PeerStatuses() map[string]PeerStatus {
+	ts.Lock.RLock()
+	defer ts.Lock.RUnlock()
+	peers := make(map[string]PeerStatus, len(ts.PeerStatus))
+	for peerId, peer := range ts.PeerStatus {
+		peers[peerId] = *peer
+	}
+	return peers
+}
+
+// Counts a piece found in the seed file, which was not downloaded
+func (ts *TorrentStatus) AddChecked() {
+	ts.Lock.Lock()
+	defer ts.Lock.Unlock()
+	ts.PiecesHave++
+}
+
+func (ts *TorrentStatus) AddUploaded(peerId string, size int) {
+	ts.Lock.Lock()
+	defer ts.Lock.Unlock()
+	ts.Uploaded += int64(size)
+	if peer, ok := ts.PeerStatus[peerId]; ok {
+		peer.Uploaded += int64(size)
+	}
+}
+
+func (ts *TorrentStatus) SetPaused(paused bool) {
+	ts.Lock.Lock()
+	defer ts.Lock.Unlock()
+	ts.Paused = paused
+}
+
+func (ts *TorrentStatus) IsPaused() bool {
+	ts.Lock.RLock()
+	defer ts.Lock.RUnlock()
+	return ts.Paused
+}
+
+func (ts *TorrentStatus) SetSeeding() {
+	ts.Lock.Lock()
+	defer ts.Lock.Unlock()
+	ts.Seeding = true
+	ts.PiecesHave = ts.NumberOfPieces
+}
+
+func (ts *TorrentStatus) SetCompleted() {
+	ts.Lock.Lock()
+	defer ts.Lock.Unlock()
+	ts.Completed = true
+}
+
+func (ts *TorrentStatus) SetError(err error) {
+	ts.Lock.Lock()
+	defer ts.Lock.Unlock()
+	ts.Err = err
+}
+
+// Records the result of an announce to the tracker
+func (ts *TorrentStatus) SetAnnounce(err error) {
+	ts.Lock.Lock()
+	defer ts.Lock.Unlock()
+	ts.TrackerErr = err
+	if err == nil {
+		ts.LastAnnounce = time.Now()
+	}
+}
+
+func (sm *SeedMode) HasGoals() bool {
+	return sm.ratio > 0 || sm.time > 0
+}
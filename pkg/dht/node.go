@@ -0,0 +1,471 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/tracker"
+)
+
+var logger = logging.For("dht")
+
+const (
+	ID_LENGTH         = 20 // Bytes, same size as a sha1 sum so info hashes are valid keys
+	K                 = 8  // Bucket size and number of nodes returned by lookups
+	ALPHA             = 3  // Parallel queries during a lookup
+	RPC_TIMEOUT       = 2 * time.Second
+	ANNOUNCE_INTERVAL = 15 * time.Second
+	PEER_TTL          = 4 * ANNOUNCE_INTERVAL
+	TOKEN_ROTATION    = 5 * time.Minute
+	MAX_PACKET_SIZE   = 8192
+)
+
+// Packet types
+const (
+	QUERY    = "q"
+	RESPONSE = "r"
+	ERROR    = "e"
+)
+
+// Query methods
+const (
+	PING          = "ping"
+	FIND_NODE     = "find_node"
+	GET_PEERS     = "get_peers"
+	ANNOUNCE_PEER = "announce_peer"
+)
+
+// Every DHT message, queries and responses, is a JSON encoded Packet sent over UDP
+type Packet struct {
+	Tid    string // Transaction id, echoed in the response
+	Type   string
+	Method string
+	Sender string // Node id of the sender
+	Target string // Node id for find_node, info hash for get_peers and announce_peer
+	PeerId string // announce_peer only
+	Port   int    // announce_peer only. Port the peer wire is listening on
+	Token  string // Given in get_peers responses, required by announce_peer
+	Nodes  []Contact
+	Peers  []tracker.Peer
+	Error  string
+}
+
+type storedPeer struct {
+	peer     tracker.Peer
+	lastSeen time.Time
+}
+
+type Node struct {
+	Id      string
+	conn    *net.UDPConn
+	table   *RoutingTable
+	peers   map[string]map[string]storedPeer // Info hash -> peer id -> peer
+	pending map[string]chan Packet           // Transaction id -> waiting query
+	secrets [2]string                        // Current and previous token secrets
+	lock    sync.Mutex
+	quit    chan struct{} // Closed by Close
+	closed  sync.Once
+}
+
+type lookupResult struct {
+	contact  Contact
+	response Packet
+	err      error
+}
+
+// Creates a DHT node listening on bindAddr. Port 0 picks a random port
+func NewNode(bindAddr string) (*Node, error) {
+	addr, err := net.ResolveUDPAddr("udp", bindAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	id := RandomId()
+	node := &Node{
+		Id:      id,
+		conn:    conn,
+		table:   NewRoutingTable(id),
+		peers:   make(map[string]map[string]storedPeer),
+		pending: make(map[string]chan Packet),
+		secrets: [2]string{RandomId(), RandomId()},
+		quit:    make(chan struct{}),
+	}
+	go node.listen()
+	go node.rotateSecrets()
+	return node, nil
+}
+
+func (n *Node) Addr() string {
+	return n.conn.LocalAddr().String()
+}
+
+func (n *Node) Close() error {
+	n.closed.Do(func() { close(n.quit) })
+	return n.conn.Close()
+}
+
+// Number of contacts in the routing table
+func (n *Node) Size() int {
+	return n.table.Size()
+}
+
+// Pings the bootstrap nodes and looks up this node's own id to fill the routing table
+func (n *Node) Bootstrap(addrs []string) error {
+	var wait sync.WaitGroup
+	for _, addr := range addrs {
+		wait.Add(1)
+		go func(addr string) {
+			defer wait.Done()
+			_, err := n.query(addr, Packet{Method: PING})
+			if err != nil {
+				logger.Warn("DHT bootstrap node did not answer", "addr", addr, "error", err)
+			}
+		}(addr)
+	}
+	wait.Wait()
+	if n.table.Size() == 0 {
+		return errors.New("no bootstrap node answered")
+	}
+	n.lookup(n.Id, FIND_NODE)
+	logger.Info("DHT bootstrapped", "nodes", n.table.Size())
+	return nil
+}
+
+// Returns the peers stored in the DHT for infoHash
+func (n *Node) GetPeers(infoHash string) []tracker.Peer {
+	_, peers, _ := n.lookup(infoHash, GET_PEERS)
+	return peers
+}
+
+/*
+Stores peer under infoHash in the K nodes closest to it.
+
+	The storing nodes take the address of the peer from the UDP packet, only
+	this node keeps peer.Ip. Also returns the peers found during the lookup
+*/
+func (n *Node) Announce(infoHash string, peer tracker.Peer) []tracker.Peer {
+	closest, peers, tokens := n.lookup(infoHash, GET_PEERS)
+	for _, contact := range closest {
+		go func(contact Contact) {
+			_, err := n.query(contact.Addr, Packet{
+				Method: ANNOUNCE_PEER,
+				Target: infoHash,
+				PeerId: peer.Id,
+				Port:   peer.Port,
+				Token:  tokens[contact.Id],
+			})
+			if err != nil {
+				logger.Debug("DHT announce failed", logging.Swarm(infoHash), "addr", contact.Addr, "error", err)
+			}
+		}(contact)
+	}
+	// The node also stores its own announce, so nodes that query it directly can find this peer
+	n.storePeer(infoHash, peer)
+	return peers
+}
+
+// Announces this client and feeds the peers found into chanDiscovery every ANNOUNCE_INTERVAL
+func DiscoverPeers(
+	node *Node,
+	infoHash string,
+	myPeer tracker.Peer,
+	chanDiscovery chan tracker.Peer,
+	quit chan struct{},
+) {
+	for {
+		peers := node.Announce(infoHash, myPeer)
+		logger.Debug("DHT lookup done", logging.Swarm(infoHash), "peers", len(peers))
+		for _, peer := range peers {
+			if peer.Id != myPeer.Id {
+				select {
+				case chanDiscovery <- peer:
+				case <-quit:
+					return
+				}
+			}
+		}
+		select {
+		case <-time.After(ANNOUNCE_INTERVAL):
+		case <-quit:
+			return
+		}
+	}
+}
+
+/*
+Iterative Kademlia lookup.
+
+	Queries the ALPHA closest nodes not queried yet, until the K closest
+	nodes known have all answered. Returns the K closest nodes that answered,
+	the peers they returned and the token each of them gave
+*/
+func (n *Node) lookup(target, method string) ([]Contact, []tracker.Peer, map[string]string) {
+	shortlist := n.table.Closest(target, K)
+	queried := make(map[string]bool)
+	answered := make(map[string]bool)
+	tokens := make(map[string]string)
+	peers := make(map[string]tracker.Peer)
+	for _, peer := range n.storedPeers(target) {
+		peers[peer.Id] = peer
+	}
+
+	for {
+		batch := make([]Contact, 0, ALPHA)
+		for i := 0; i < len(shortlist) && i < K && len(batch) < ALPHA; i++ {
+			if !queried[shortlist[i].Id] {
+				batch = append(batch, shortlist[i])
+				queried[shortlist[i].Id] = true
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		results := make(chan lookupResult, len(batch))
+		for _, contact := range batch {
+			go func(contact Contact) {
+				response, err := n.query(contact.Addr, Packet{Method: method, Target: target})
+				results <- lookupResult{contact: contact, response: response, err: err}
+			}(contact)
+		}
+		for range batch {
+			result := <-results
+			if result.err != nil {
+				n.table.Remove(result.contact)
+				continue
+			}
+			answered[result.contact.Id] = true
+			tokens[result.contact.Id] = result.response.Token
+			for _, peer := range result.response.Peers {
+				peers[peer.Id] = peer
+			}
+			for _, contact := range result.response.Nodes {
+				if contact.Id != n.Id && !containsContact(shortlist, contact) {
+					shortlist = append(shortlist, contact)
+				}
+			}
+		}
+		SortByDistance(shortlist, target)
+	}
+
+	closest := make([]Contact, 0, K)
+	for _, contact := range shortlist {
+		if answered[contact.Id] && len(closest) < K {
+			closest = append(closest, contact)
+		}
+	}
+	peerList := make([]tracker.Peer, 0, len(peers))
+	for _, peer := range peers {
+		peerList = append(peerList, peer)
+	}
+	return closest, peerList, tokens
+}
+
+// Sends a query and waits up to RPC_TIMEOUT for its response
+func (n *Node) query(addr string, packet Packet) (Packet, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return Packet{}, err
+	}
+	packet.Tid = RandomId()[:8]
+	packet.Type = QUERY
+	packet.Sender = n.Id
+	chanResponse := make(chan Packet, 1)
+	n.lock.Lock()
+	n.pending[packet.Tid] = chanResponse
+	n.lock.Unlock()
+	defer func() {
+		n.lock.Lock()
+		delete(n.pending, packet.Tid)
+		n.lock.Unlock()
+	}()
+
+	err = n.send(udpAddr, packet)
+	if err != nil {
+		return Packet{}, err
+	}
+	select {
+	case response := <-chanResponse:
+		if response.Type == ERROR {
+			return response, errors.New(response.Error)
+		}
+		return response, nil
+	case <-time.After(RPC_TIMEOUT):
+		return Packet{}, fmt.Errorf("%s to %s timed out", packet.Method, addr)
+	}
+}
+
+func (n *Node) send(addr *net.UDPAddr, packet Packet) error {
+	data, err := json.Marshal(packet)
+	if err != nil {
+		return err
+	}
+	_, err = n.conn.WriteToUDP(data, addr)
+	return err
+}
+
+func (n *Node) listen() {
+	buffer := make([]byte, MAX_PACKET_SIZE)
+	for {
+		size, from, err := n.conn.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			continue
+		}
+		var packet Packet
+		if json.Unmarshal(buffer[:size], &packet) != nil {
+			logger.Debug("DHT invalid packet", "from", from)
+			continue
+		}
+		n.seen(Contact{Id: packet.Sender, Addr: from.String()})
+		switch packet.Type {
+		case QUERY:
+			n.handleQuery(packet, from)
+		case RESPONSE, ERROR:
+			// Only the first response of a query is delivered, duplicates and late ones are dropped
+			n.lock.Lock()
+			chanResponse, ok := n.pending[packet.Tid]
+			delete(n.pending, packet.Tid)
+			n.lock.Unlock()
+			if ok {
+				select {
+				case chanResponse <- packet:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (n *Node) handleQuery(query Packet, from *net.UDPAddr) {
+	logger.Debug("DHT query", "method", query.Method, "from", from)
+	response := Packet{Tid: query.Tid, Type: RESPONSE, Sender: n.Id}
+	switch query.Method {
+	case PING:
+	case FIND_NODE:
+		response.Nodes = n.table.Closest(query.Target, K)
+	case GET_PEERS:
+		response.Nodes = n.table.Closest(query.Target, K)
+		response.Peers = n.storedPeers(query.Target)
+		response.Token = n.token(from.IP, 0)
+	case ANNOUNCE_PEER:
+		if query.Token != n.token(from.IP, 0) && query.Token != n.token(from.IP, 1) {
+			response.Type = ERROR
+			response.Error = "invalid token"
+			break
+		}
+		if len(query.PeerId) < 5 || query.Port <= 0 || query.Port > 65535 {
+			response.Type = ERROR
+			response.Error = "invalid peer"
+			break
+		}
+		peer := tracker.Peer{Port: query.Port, Id: query.PeerId}
+		if from.IP.To4() != nil {
+			peer.Ip = from.IP.String()
+		} else {
+			peer.Ip6 = from.IP.String()
+		}
+		n.storePeer(query.Target, peer)
+	default:
+		response.Type = ERROR
+		response.Error = "unknown method"
+	}
+	err := n.send(from, response)
+	if err != nil {
+		logger.Debug("DHT could not answer", "to", from, "error", err)
+	}
+}
+
+// Adds a contact that sent a packet to the routing table
+func (n *Node) seen(contact Contact) {
+	stale, full := n.table.Update(contact)
+	if !full {
+		return
+	}
+	go func() {
+		_, err := n.query(stale.Addr, Packet{Method: PING})
+		if err != nil {
+			n.table.Evict(stale, contact)
+		} else {
+			n.table.Update(stale)
+		}
+	}()
+}
+
+func (n *Node) storePeer(infoHash string, peer tracker.Peer) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, ok := n.peers[infoHash]; !ok {
+		n.peers[infoHash] = make(map[string]storedPeer)
+	}
+	n.peers[infoHash][peer.Id] = storedPeer{peer: peer, lastSeen: time.Now()}
+}
+
+// Peers announced under infoHash. Expired peers are removed
+func (n *Node) storedPeers(infoHash string) []tracker.Peer {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	peers := make([]tracker.Peer, 0)
+	for peerId, stored := range n.peers[infoHash] {
+		if time.Since(stored.lastSeen) > PEER_TTL {
+			delete(n.peers[infoHash], peerId)
+			continue
+		}
+		if stored.peer.Ip != "" || stored.peer.Ip6 != "" {
+			peers = append(peers, stored.peer)
+		}
+	}
+	return peers
+}
+
+// Tokens are bound to the requester IP and expire after two secret rotations
+func (n *Node) token(ip net.IP, secret int) string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return fmt.Sprintf("%x", sha1.Sum([]byte(n.secrets[secret]+ip.String())))
+}
+
+// Until the node is closed
+func (n *Node) rotateSecrets() {
+	ticker := time.NewTicker(TOKEN_ROTATION)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.quit:
+			return
+		}
+		n.lock.Lock()
+		n.secrets[1] = n.secrets[0]
+		n.secrets[0] = RandomId()
+		n.lock.Unlock()
+	}
+}
+
+// Random hex encoded id of ID_LENGTH bytes
+func RandomId() string {
+	id := make([]byte, ID_LENGTH)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func containsContact(contacts []Contact, contact Contact) bool {
+	for _, c := range contacts {
+		if c.Id == contact.Id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package dht
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/tracker"
+)
+
+/*
+Tests of DHT nodes talking to each other over the loopback.
+
+	Every node bootstraps off the ones started before it, so they all end
+	up knowing each other, as TEST_NODES is below the bucket size K
+*/
+
+const TEST_NODES = 6
+
+// Started and bootstrapped nodes, closed when the test ends
+func startNodes(t *testing.T, count int) []*Node {
+	nodes := make([]*Node, 0, count)
+	for i := 0; i < count; i++ {
+		node, err := NewNode("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { node.Close() })
+		if i > 0 {
+			addrs := make([]string, 0, len(nodes))
+			for _, other := range nodes {
+				addrs = append(addrs, other.Addr())
+			}
+			err = node.Bootstrap(addrs)
+			if err != nil {
+				t.Fatalf("bootstrap of node %d: %v", i, err)
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// Peers found for infoHash by node, polled until one with peerId shows up, as announces are sent in the background
+func findPeer(node *Node, infoHash, peerId string) (tracker.Peer, bool) {
+	deadline := time.Now().Add(2 * RPC_TIMEOUT)
+	for time.Now().Before(deadline) {
+		for _, peer := range node.GetPeers(infoHash) {
+			if peer.Id == peerId {
+				return peer, true
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return tracker.Peer{}, false
+}
+
+func TestRoutingTableFill(t *testing.T) {
+	nodes := startNodes(t, TEST_NODES)
+	for i, node := range nodes {
+		if node.Size() != TEST_NODES-1 {
+			t.Errorf("node %d knows %d nodes, want %d", i, node.Size(), TEST_NODES-1)
+		}
+		for _, contact := range node.table.Closest(node.Id, K) {
+			if contact.Id == node.Id {
+				t.Errorf("node %d has itself in its routing table", i)
+			}
+		}
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	nodes := startNodes(t, TEST_NODES)
+	infoHash := RandomId()
+	// Without an IP, so only the copies stored by other nodes, with the address they saw, can be found
+	nodes[1].Announce(infoHash, tracker.Peer{Id: "announcer", Port: 6881})
+
+	peer, found := findPeer(nodes[TEST_NODES-1], infoHash, "announcer")
+	if !found {
+		t.Fatal("announced peer not found by another node")
+	}
+	if peer.Ip != "127.0.0.1" || peer.Port != 6881 {
+		t.Errorf("got peer at %s:%d, want 127.0.0.1:6881", peer.Ip, peer.Port)
+	}
+	if peers := nodes[0].GetPeers(RandomId()); len(peers) != 0 {
+		t.Errorf("got %d peers for a torrent nobody announced", len(peers))
+	}
+}
+
+func TestAnnounceToken(t *testing.T) {
+	nodes := startNodes(t, 2)
+	client, server := nodes[0], nodes[1]
+	infoHash := RandomId()
+	announce := func(token string) error {
+		_, err := client.query(server.Addr(), Packet{
+			Method: ANNOUNCE_PEER,
+			Target: infoHash,
+			PeerId: "announcer",
+			Port:   6881,
+			Token:  token,
+		})
+		return err
+	}
+
+	err := announce("bogus")
+	if err == nil || err.Error() != "invalid token" {
+		t.Fatalf("announce with a bogus token: got %v, want invalid token", err)
+	}
+	if len(server.storedPeers(infoHash)) != 0 {
+		t.Fatal("peer stored despite the invalid token")
+	}
+
+	response, err := client.query(server.Addr(), Packet{Method: GET_PEERS, Target: infoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := response.Token
+	// The previous secret is still accepted, so tokens outlive one rotation but not two
+	for rotation := 0; rotation < 2; rotation++ {
+		err = announce(token)
+		if err != nil {
+			t.Fatalf("announce after %d rotations: %v", rotation, err)
+		}
+		server.lock.Lock()
+		server.secrets[1] = server.secrets[0]
+		server.secrets[0] = RandomId()
+		server.lock.Unlock()
+	}
+	err = announce(token)
+	if err == nil {
+		t.Fatal("announce with an expired token accepted")
+	}
+	if len(server.storedPeers(infoHash)) != 1 {
+		t.Fatalf("server stores %d peers, want 1", len(server.storedPeers(infoHash)))
+	}
+}
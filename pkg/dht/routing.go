@@ -0,0 +1,145 @@
+package dht
+
+import (
+	"encoding/hex"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Node of the DHT, as known by other nodes
+type Contact struct {
+	Id   string // Hex encoded, same format as mtorr Info.Id
+	Addr string // host:port of the UDP socket
+}
+
+type bucketEntry struct {
+	contact  Contact
+	lastSeen time.Time
+}
+
+/*
+Kademlia routing table.
+
+	Bucket i keeps up to K contacts whose distance to this node has
+	i leading zero bits. Entries are ordered from least to most recently seen
+*/
+type RoutingTable struct {
+	myId    []byte
+	buckets [ID_LENGTH * 8][]bucketEntry
+	lock    sync.RWMutex
+}
+
+func NewRoutingTable(myId string) *RoutingTable {
+	id, _ := hex.DecodeString(myId)
+	return &RoutingTable{myId: id}
+}
+
+/*
+Inserts or refreshes a contact.
+
+	Returns the least recently seen contact of the bucket when it is full,
+	so the caller can ping it and Evict it if it does not answer
+*/
+func (rt *RoutingTable) Update(contact Contact) (Contact, bool) {
+	id, err := hex.DecodeString(contact.Id)
+	if err != nil || len(id) != ID_LENGTH || string(id) == string(rt.myId) {
+		return Contact{}, false
+	}
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	i := bucketIndex(rt.myId, id)
+	bucket := rt.buckets[i]
+	for j, entry := range bucket {
+		if entry.contact.Id == contact.Id {
+			bucket = append(bucket[:j], bucket[j+1:]...)
+			rt.buckets[i] = append(bucket, bucketEntry{contact: contact, lastSeen: time.Now()})
+			return Contact{}, false
+		}
+	}
+	if len(bucket) < K {
+		rt.buckets[i] = append(bucket, bucketEntry{contact: contact, lastSeen: time.Now()})
+		return Contact{}, false
+	}
+	return bucket[0].contact, true
+}
+
+// Replaces a stale contact with a new one
+func (rt *RoutingTable) Evict(stale, contact Contact) {
+	rt.Remove(stale)
+	rt.Update(contact)
+}
+
+func (rt *RoutingTable) Remove(contact Contact) {
+	id, err := hex.DecodeString(contact.Id)
+	if err != nil || len(id) != ID_LENGTH {
+		return
+	}
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	i := bucketIndex(rt.myId, id)
+	for j, entry := range rt.buckets[i] {
+		if entry.contact.Id == contact.Id {
+			rt.buckets[i] = append(rt.buckets[i][:j], rt.buckets[i][j+1:]...)
+			return
+		}
+	}
+}
+
+// Returns up to count contacts sorted by distance to target
+func (rt *RoutingTable) Closest(target string, count int) []Contact {
+	contacts := make([]Contact, 0)
+	rt.lock.RLock()
+	for _, bucket := range rt.buckets {
+		for _, entry := range bucket {
+			contacts = append(contacts, entry.contact)
+		}
+	}
+	rt.lock.RUnlock()
+	SortByDistance(contacts, target)
+	if len(contacts) > count {
+		contacts = contacts[:count]
+	}
+	return contacts
+}
+
+func (rt *RoutingTable) Size() int {
+	size := 0
+	rt.lock.RLock()
+	for _, bucket := range rt.buckets {
+		size += len(bucket)
+	}
+	rt.lock.RUnlock()
+	return size
+}
+
+func SortByDistance(contacts []Contact, target string) {
+	targetId, _ := hex.DecodeString(target)
+	sort.SliceStable(contacts, func(i, j int) bool {
+		return Closer(contacts[i].Id, contacts[j].Id, targetId)
+	})
+}
+
+// Whether a is closer to target than b, using the XOR metric
+func Closer(a, b string, target []byte) bool {
+	idA, _ := hex.DecodeString(a)
+	idB, _ := hex.DecodeString(b)
+	for i := 0; i < len(target) && i < len(idA) && i < len(idB); i++ {
+		distA := idA[i] ^ target[i]
+		distB := idB[i] ^ target[i]
+		if distA != distB {
+			return distA < distB
+		}
+	}
+	return false
+}
+
+func bucketIndex(myId, id []byte) int {
+	for i := range myId {
+		if distance := myId[i] ^ id[i]; distance != 0 {
+			return i*8 + bits.LeadingZeros8(distance)
+		}
+	}
+	return len(myId)*8 - 1
+}
@@ -1,101 +1,26 @@
 package downloader
 
 import (
-	//"net/http"
+	"strconv"
 
-	"math/rand"
-	"sync"
-	"time"
-
-	"github.com/rafaelbarbeta/MicroTorr/pkg/core"
-	"github.com/rafaelbarbeta/MicroTorr/pkg/messages"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
 	"github.com/rafaelbarbeta/MicroTorr/pkg/mtorr"
-	"github.com/rafaelbarbeta/MicroTorr/pkg/peerWire"
-	trackercontroller "github.com/rafaelbarbeta/MicroTorr/pkg/trackerController"
-	"github.com/rafaelbarbeta/MicroTorr/pkg/utils"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/tracker"
 )
 
 const (
-	ID_LENGTH         = 20
-	MAX_CHAN_TRACKER  = 100
-	MAX_CHAN_MESSAGES = 1000
+	ID_LENGTH          = 20
+	MAX_CHAN_TRACKER   = 100
+	MAX_CHAN_MESSAGES  = 1000
+	MAX_CHAN_DISCOVERY = 100
 )
 
-func Download(
-	mtorrent mtorr.Mtorrent,
-	intNet, port, seed string,
-	autoSeed bool,
-	waitSeeders, waitLeechers, maxDownSpeed, maxUpSpeed, verbosity int,
-) {
-	var ip string
-	var err error
-	var wait sync.WaitGroup
-
-	rand.Seed(time.Now().UnixNano())
-
-	if intNet != "" {
-		ip, err = utils.GetInterfaceIP(intNet)
-		utils.Check(err, verbosity, "Error getting interface IP", intNet)
-	} else {
-		ip, err = utils.GetDefaultRouteIP()
-		utils.Check(err, verbosity, "Error getting IP from default route")
-	}
-
-	peerId := utils.GenerateRandomString(ID_LENGTH)
-
-	utils.PrintVerbose(verbosity, utils.VERBOSE, "My Peer Id (Capped):", peerId[:5])
-
-	utils.PrintVerbose(verbosity, utils.VERBOSE, "Using IP:", ip)
-	swarm := trackercontroller.GetTrackerInfo(
-		mtorrent.Announce,
-		peerId,
-		mtorrent.Info.Id,
-		ip,
-		port,
-		verbosity)
-
-	chanTracker := make(chan messages.ControlMessage)
-	chanPeerWire := make(chan messages.ControlMessage, MAX_CHAN_MESSAGES)
-	chanCore := make(chan messages.ControlMessage, MAX_CHAN_MESSAGES)
-
-	utils.PrintVerbose(verbosity, utils.INFORMATION, "All Structures Initialized")
-	utils.PrintVerbose(verbosity, utils.INFORMATION, "Starting components")
-	wait.Add(1)
-	// Initializes all components in separated go routines
-	go trackercontroller.InitTrackerController(
-		mtorrent.Announce,
-		peerId,
-		mtorrent.Info.Id,
-		ip,
-		port,
-		verbosity,
-		chanTracker,
-	)
-
-	go peerWire.InitPeerWire(
-		swarm,
-		peerId,
-		chanPeerWire,
-		chanCore,
-		&wait,
-		maxDownSpeed,
-		maxUpSpeed,
-		verbosity,
-	)
-
-	go core.InitCore(
-		mtorrent,
-		chanPeerWire,
-		chanCore,
-		chanTracker,
-		peerId,
-		&wait,
-		seed,
-		autoSeed,
-		waitSeeders,
-		waitLeechers,
-		verbosity,
-	)
+var logger = logging.For("downloader")
 
-	wait.Wait()
+// Swarm with only this peer, used when the tracker is missing or unreachable
+func LocalSwarm(mtorrent mtorr.Mtorrent, peerId, ip, ip6, port string) tracker.Swarm {
+	portInt, _ := strconv.Atoi(port)
+	swarm := tracker.Swarm{IdHash: mtorrent.Info.Id, Peers: make(map[string]tracker.Peer)}
+	swarm.Peers[peerId] = tracker.Peer{Ip: ip, Ip6: ip6, Port: portInt, Id: peerId}
+	return swarm
 }
@@ -0,0 +1,70 @@
+package downloader
+
+import (
+	"sort"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/metrics"
+)
+
+// Writes the metrics of all torrents of the session, as served by --metrics
+func (s *Session) WriteMetrics(w *metrics.Writer) {
+	torrents := s.Torrents()
+	sort.Slice(torrents, func(i, j int) bool {
+		return torrents[i].Mtorrent.Info.Name < torrents[j].Mtorrent.Info.Name
+	})
+	var downloaded, uploaded, downRate, upRate, piecesHave, piecesTotal, verified, failed, connections, paused []metrics.Sample
+	var peerDownloaded, peerUploaded, peerChoked []metrics.Sample
+	for _, torrent := range torrents {
+		labels := []string{"swarm", torrent.Mtorrent.Info.Id, "name", torrent.Mtorrent.Info.Name}
+		status := torrent.status
+		status.Lock.RLock()
+		downloaded = append(downloaded, metrics.Sample{Labels: labels, Value: float64(status.Downloaded)})
+		uploaded = append(uploaded, metrics.Sample{Labels: labels, Value: float64(status.Uploaded)})
+		downRate = append(downRate, metrics.Sample{Labels: labels, Value: status.DownRate})
+		upRate = append(upRate, metrics.Sample{Labels: labels, Value: status.UpRate})
+		piecesHave = append(piecesHave, metrics.Sample{Labels: labels, Value: float64(status.PiecesHave)})
+		piecesTotal = append(piecesTotal, metrics.Sample{Labels: labels, Value: float64(status.NumberOfPieces)})
+		verified = append(verified, metrics.Sample{Labels: labels, Value: float64(status.PiecesVerified)})
+		failed = append(failed, metrics.Sample{Labels: labels, Value: float64(status.PiecesFailed)})
+		connections = append(connections, metrics.Sample{Labels: labels, Value: float64(status.Peers)})
+		paused = append(paused, metrics.Sample{Labels: labels, Value: boolValue(status.Paused)})
+		status.Lock.RUnlock()
+
+		peers := status.PeerStatuses()
+		peerIds := make([]string, 0, len(peers))
+		for peerId := range peers {
+			peerIds = append(peerIds, peerId)
+		}
+		sort.Strings(peerIds)
+		for _, peerId := range peerIds {
+			peerLabels := []string{"swarm", torrent.Mtorrent.Info.Id, "peer", peerId}
+			peerDownloaded = append(peerDownloaded, metrics.Sample{Labels: peerLabels, Value: float64(peers[peerId].Downloaded)})
+			peerUploaded = append(peerUploaded, metrics.Sample{Labels: peerLabels, Value: float64(peers[peerId].Uploaded)})
+			peerChoked = append(peerChoked, metrics.Sample{Labels: peerLabels, Value: boolValue(peers[peerId].Choked)})
+		}
+	}
+	maxDown, maxUp := s.Limits()
+	w.Write("microtorr_torrents", metrics.GAUGE, "Torrents in the session.", metrics.Sample{Value: float64(len(torrents))})
+	w.Write("microtorr_downloaded_bytes_total", metrics.COUNTER, "Bytes of verified pieces downloaded.", downloaded...)
+	w.Write("microtorr_uploaded_bytes_total", metrics.COUNTER, "Bytes of pieces uploaded.", uploaded...)
+	w.Write("microtorr_download_rate_bytes", metrics.GAUGE, "Download rate in bytes per second.", downRate...)
+	w.Write("microtorr_upload_rate_bytes", metrics.GAUGE, "Upload rate in bytes per second.", upRate...)
+	w.Write("microtorr_pieces_have", metrics.GAUGE, "Pieces downloaded or found in the seed file.", piecesHave...)
+	w.Write("microtorr_pieces", metrics.GAUGE, "Pieces of the torrent.", piecesTotal...)
+	w.Write("microtorr_pieces_verified_total", metrics.COUNTER, "Downloaded pieces that matched their hash.", verified...)
+	w.Write("microtorr_pieces_failed_total", metrics.COUNTER, "Downloaded pieces that did not match their hash.", failed...)
+	w.Write("microtorr_connections", metrics.GAUGE, "Connected peers.", connections...)
+	w.Write("microtorr_paused", metrics.GAUGE, "Whether the torrent is paused, choking all peers.", paused...)
+	w.Write("microtorr_peer_downloaded_bytes_total", metrics.COUNTER, "Bytes of verified pieces downloaded from a connected peer.", peerDownloaded...)
+	w.Write("microtorr_peer_uploaded_bytes_total", metrics.COUNTER, "Bytes of pieces uploaded to a connected peer.", peerUploaded...)
+	w.Write("microtorr_peer_choked", metrics.GAUGE, "Whether a connected peer rejected our last request, as it is paused.", peerChoked...)
+	w.Write("microtorr_max_download_speed_kbytes", metrics.GAUGE, "Global download speed limit in KB/s, 0 for no limit.", metrics.Sample{Value: float64(maxDown)})
+	w.Write("microtorr_max_upload_speed_kbytes", metrics.GAUGE, "Global upload speed limit in KB/s, 0 for no limit.", metrics.Sample{Value: float64(maxUp)})
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
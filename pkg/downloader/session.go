@@ -0,0 +1,545 @@
+package downloader
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/bandwidth"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/control"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/core"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/dht"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/events"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/lpd"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/messages"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/mtorr"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/peerWire"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/tracker"
+	trackercontroller "github.com/rafaelbarbeta/MicroTorr/pkg/trackerController"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/utils"
+)
+
+/*
+Torrents running in one process.
+
+	All torrents share the peer id, the listening port, the peer wire,
+	the bandwidth limiter, the DHT node and the TLS of HTTPS trackers
+*/
+type Session struct {
+	peerId   string
+	intNet   string
+	ip       string
+	ip6      string
+	port     string
+	limiter  *bandwidth.Limiter
+	wire     *peerWire.Wire
+	node     *dht.Node
+	useLpd   bool
+	client   *http.Client // Of the announces to the trackers
+	events   *events.Bus
+	torrents map[string]*Torrent
+	lock     sync.Mutex
+	wait     sync.WaitGroup // One for each running torrent
+	quit     chan struct{}  // Closed when the session is closed
+	closed   sync.Once
+}
+
+type Torrent struct {
+	Mtorrent     mtorr.Mtorrent
+	DataPath     string // File being downloaded or seeded
+	status       *core.TorrentStatus
+	priorities   *core.Priorities
+	stream       *core.Stream // nil if the torrent is not streamed
+	chanTracker  chan messages.ControlMessage
+	chanPeerWire chan messages.ControlMessage // Also used to send pause and resume to core
+	wait         sync.WaitGroup
+	quit         chan struct{} // Closed when the torrent is removed from the session
+}
+
+func NewSession(
+	intNet, port string,
+	maxDownSpeed, maxUpSpeed, maxPeerDownSpeed, maxPeerUpSpeed int,
+	schedule *bandwidth.Schedule,
+	useDht bool,
+	dhtPort string,
+	dhtBootstrap []string,
+	useLpd bool,
+	trackerTLS *tls.Config,
+	bus *events.Bus,
+) (*Session, error) {
+	portInt, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %s", port)
+	}
+	if bus == nil {
+		bus = events.NewBus()
+	}
+	s := &Session{
+		peerId:   utils.GenerateRandomString(ID_LENGTH),
+		intNet:   intNet,
+		port:     port,
+		useLpd:   useLpd,
+		client:   trackercontroller.NewClient(trackerTLS),
+		events:   bus,
+		torrents: make(map[string]*Torrent),
+		quit:     make(chan struct{}),
+	}
+
+	// Without an interface, the tracker registers the address our requests come from
+	if intNet != "" {
+		s.ip, s.ip6, err = utils.GetInterfaceIPs(intNet)
+		if err != nil {
+			return nil, err
+		}
+	}
+	logger.Info("Session started", logging.Peer(s.peerId), "ip", s.ip, "ip6", s.ip6)
+
+	s.limiter = bandwidth.NewLimiter(maxDownSpeed, maxUpSpeed, maxPeerDownSpeed, maxPeerUpSpeed)
+	if schedule != nil {
+		go bandwidth.RunSchedule(s.limiter, *schedule, s.quit)
+	}
+
+	s.wire = peerWire.NewWire(s.limiter)
+	myPeer := tracker.Peer{Ip: s.ip, Ip6: s.ip6, Port: portInt, Id: s.peerId}
+	for _, listenAddr := range peerWire.ListenAddrs(myPeer) {
+		err = s.wire.Listen(listenAddr)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	if useDht {
+		// The DHT socket serves both address families when this peer has both
+		dhtIp := ""
+		if s.ip == "" || s.ip6 == "" {
+			dhtIp = s.ip + s.ip6
+		}
+		s.node, err = dht.NewNode(net.JoinHostPort(dhtIp, dhtPort))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		logger.Info("DHT node listening", "addr", s.node.Addr())
+		if len(dhtBootstrap) > 0 {
+			err = s.node.Bootstrap(dhtBootstrap)
+			if err != nil {
+				// Not fatal, other nodes can still use this one to bootstrap
+				logger.Warn("DHT bootstrap failed", "error", err)
+			}
+		}
+	}
+	return s, nil
+}
+
+/*
+Joins the swarm of mtorrent and starts downloading or seeding it, as set by options.
+
+	The torrent leaves the session when it completes, unless options
+	auto seeds it or has seeding goals, or when the session stops
+*/
+func (s *Session) AddTorrent(mtorrent mtorr.Mtorrent, options core.Options) (*Torrent, error) {
+	var swarm tracker.Swarm
+	var err error
+	logger := logger.With(logging.Swarm(mtorrent.Info.Id))
+	idHash := mtorrent.Info.Id
+
+	priorities := core.NewPriorities(core.NumberOfPieces(mtorrent))
+	err = priorities.Apply(options.Priorities)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	if _, exists := s.torrents[idHash]; exists {
+		s.lock.Unlock()
+		return nil, fmt.Errorf("torrent %s is already in the session", mtorrent.Info.Name)
+	}
+	torrent := &Torrent{
+		Mtorrent:     mtorrent,
+		DataPath:     mtorrent.Info.Name,
+		status:       &core.TorrentStatus{Tracker: mtorrent.Announce},
+		priorities:   priorities,
+		stream:       options.Stream,
+		chanTracker:  make(chan messages.ControlMessage, MAX_CHAN_TRACKER), // Events are not kept waiting on announces
+		chanPeerWire: make(chan messages.ControlMessage, MAX_CHAN_MESSAGES),
+		quit:         make(chan struct{}),
+	}
+	if options.Seed != "" {
+		torrent.DataPath = options.Seed
+	}
+	s.torrents[idHash] = torrent
+	s.wait.Add(1)
+	torrent.wait.Add(1)
+	s.lock.Unlock()
+
+	if mtorrent.Announce != "" {
+		left := torrent.left()
+		// Lazy seeds announce the pieces they verified, once core checks them
+		if options.Seed != "" && !options.LazySeed {
+			left = 0
+		}
+		swarm, err = trackercontroller.GetTrackerInfo(
+			s.client,
+			mtorrent.Announce,
+			s.peerId,
+			idHash,
+			s.ip,
+			s.ip6,
+			s.port,
+			left)
+		torrent.status.SetAnnounce(err)
+		if err != nil {
+			s.events.Publish(torrent.event(events.TRACKER_ERROR, err))
+		}
+		if err != nil && s.node == nil && !s.useLpd {
+			s.removeTorrent(idHash)
+			return nil, fmt.Errorf("error getting swarm from tracker: %w", err)
+		} else if err != nil {
+			logger.Warn("Tracker unreachable, relying on other discovery mechanisms", "error", err)
+			swarm = LocalSwarm(mtorrent, s.peerId, s.ip, s.ip6, s.port)
+		}
+	} else {
+		logger.Info("No tracker in .mtorrent, relying on other discovery mechanisms")
+		swarm = LocalSwarm(mtorrent, s.peerId, s.ip, s.ip6, s.port)
+	}
+	myPeer := swarm.Peers[s.peerId]
+
+	chanPeerWire := torrent.chanPeerWire
+	chanCore := make(chan messages.ControlMessage, MAX_CHAN_MESSAGES)
+	chanDiscovery := make(chan tracker.Peer, MAX_CHAN_DISCOVERY)
+
+	if s.node != nil {
+		go dht.DiscoverPeers(s.node, idHash, myPeer, chanDiscovery, torrent.quit)
+	}
+
+	if s.useLpd {
+		err = lpd.Start(s.intNet, idHash, myPeer, chanDiscovery, torrent.quit)
+		if err != nil {
+			// Not fatal, the tracker or the DHT may still find peers
+			logger.Warn("Error starting Local Peer Discovery", "error", err)
+		}
+	}
+
+	logger.Info("Starting torrent", "name", mtorrent.Info.Name)
+	// Initializes all components in separated go routines
+	go trackercontroller.InitTrackerController(
+		s.client,
+		mtorrent.Announce,
+		s.peerId,
+		idHash,
+		s.ip,
+		s.ip6,
+		s.port,
+		torrent.left,
+		torrent.chanTracker,
+		chanDiscovery,
+		&torrent.wait,
+		func(err error) {
+			if mtorrent.Announce == "" {
+				return
+			}
+			torrent.status.SetAnnounce(err)
+			if err != nil {
+				s.events.Publish(torrent.event(events.TRACKER_ERROR, err))
+			}
+		},
+	)
+
+	s.wire.AddSwarm(
+		swarm,
+		s.peerId,
+		chanPeerWire,
+		chanCore,
+		chanDiscovery,
+	)
+
+	go core.InitCore(
+		mtorrent,
+		options,
+		chanPeerWire,
+		chanCore,
+		torrent.chanTracker,
+		s.peerId,
+		&torrent.wait,
+		torrent.status,
+		priorities,
+		s.events,
+	)
+
+	go func() {
+		torrent.wait.Wait()
+		s.removeTorrent(idHash)
+	}()
+	return torrent, nil
+}
+
+// Torrents currently in the session
+func (s *Session) Torrents() []*Torrent {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	torrents := make([]*Torrent, 0, len(s.torrents))
+	for _, torrent := range s.torrents {
+		torrents = append(torrents, torrent)
+	}
+	return torrents
+}
+
+// Loads the .mtorrent at path and adds it to the session, see AddTorrent
+func (s *Session) AddFile(path string, options core.Options) error {
+	mtorrent, err := mtorr.LoadMtorrent(path)
+	if err != nil {
+		return err
+	}
+	if options.Seed != "" {
+		if _, err := os.Stat(options.Seed); err != nil {
+			return err
+		}
+	}
+	_, err = s.AddTorrent(mtorrent, options)
+	return err
+}
+
+// Finds a torrent by its id, or an unique prefix of it
+func (s *Session) Find(id string) (*Torrent, error) {
+	var found *Torrent
+	if id == "" {
+		return nil, fmt.Errorf("no torrent id given")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for idHash, torrent := range s.torrents {
+		if idHash == id {
+			return torrent, nil
+		}
+		if strings.HasPrefix(idHash, id) {
+			if found != nil {
+				return nil, fmt.Errorf("more than one torrent starts with %s", id)
+			}
+			found = torrent
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no torrent with id %s", id)
+	}
+	return found, nil
+}
+
+/*
+Stops downloading and uploading pieces of a torrent, and leaves the tracker swarm.
+
+	The pieces already downloaded are kept. closeConns also disconnects
+	from the peers until the torrent is resumed
+*/
+func (s *Session) Pause(id string, closeConns bool) error {
+	torrent, err := s.Find(id)
+	if err != nil {
+		return err
+	}
+	torrent.chanPeerWire <- messages.ControlMessage{Opcode: messages.PAUSE, Payload: closeConns}
+	return nil
+}
+
+func (s *Session) Resume(id string) error {
+	torrent, err := s.Find(id)
+	if err != nil {
+		return err
+	}
+	torrent.chanPeerWire <- messages.ControlMessage{Opcode: messages.RESUME}
+	return nil
+}
+
+// Changes the download priority of pieces of a torrent, from specs as in core.Priorities.Apply
+func (s *Session) SetPriorities(id string, specs []string) error {
+	torrent, err := s.Find(id)
+	if err != nil {
+		return err
+	}
+	err = torrent.priorities.Apply(specs)
+	if err != nil {
+		return err
+	}
+	// Reads waiting for pieces that are now skipped fail
+	torrent.stream.Wake()
+	return nil
+}
+
+// Leaves the swarm of a torrent, deleting its file if deleteData is set
+func (s *Session) Remove(id string, deleteData bool) error {
+	torrent, err := s.Find(id)
+	if err != nil {
+		return err
+	}
+	torrent.stop()
+	<-torrent.quit
+	if deleteData {
+		err = os.Remove(torrent.DataPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Global speed limits in KB/s, 0 for no limit
+func (s *Session) Limits() (int, int) {
+	return s.limiter.Limits()
+}
+
+// Changes the global speed limits until the schedule, if any, changes them again
+func (s *Session) SetLimits(maxDownSpeed, maxUpSpeed int) {
+	s.limiter.SetLimits(maxDownSpeed, maxUpSpeed)
+}
+
+// Summary of all torrents of the session, sorted by name
+func (s *Session) List() []control.TorrentInfo {
+	torrents := s.Torrents()
+	list := make([]control.TorrentInfo, 0, len(torrents))
+	for _, torrent := range torrents {
+		list = append(list, torrent.Info())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Events of the torrents of the session
+func (s *Session) Events() *events.Bus {
+	return s.events
+}
+
+// Blocks until all torrents of the session are finished
+func (s *Session) Wait() {
+	s.wait.Wait()
+}
+
+// Alerts the trackers of all torrents, waits for them to leave the session and closes it
+func (s *Session) Stop() {
+	for _, torrent := range s.Torrents() {
+		go torrent.stop()
+	}
+	s.wait.Wait()
+	s.Close()
+}
+
+/*
+Stops listening for peers and the DHT node. Torrents still running lose them, see Stop.
+
+	Waits for the subscribers of the events to handle the events already published
+*/
+func (s *Session) Close() {
+	s.closed.Do(func() {
+		close(s.quit)
+		if s.wire != nil {
+			s.wire.Close()
+		}
+		if s.node != nil {
+			s.node.Close()
+		}
+		s.events.Close()
+	})
+}
+
+// Stops the session on SIGINT or SIGTERM
+func (s *Session) HandleSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	logger.Warn("Received signal, alerting tracker and stopping execution...", "signal", sig)
+	s.Stop()
+}
+
+func (s *Session) removeTorrent(idHash string) {
+	s.lock.Lock()
+	torrent := s.torrents[idHash]
+	delete(s.torrents, idHash)
+	s.lock.Unlock()
+	// Does nothing if the torrent failed before joining the wire
+	s.wire.RemoveSwarm(idHash)
+	close(torrent.quit)
+	logger.Info("Torrent left the session", logging.Swarm(idHash), "name", torrent.Mtorrent.Info.Name)
+	s.wait.Done()
+}
+
+// Sends the stopped event, unless the torrent finishes in the meantime. The tracker controller ends the torrent
+func (t *Torrent) stop() {
+	core.NotifyTracker(t.chanTracker, messages.TRACKER_STOPPED, t.quit)
+}
+
+func (t *Torrent) event(eventType int, err error) events.Event {
+	return events.Event{
+		Type:   eventType,
+		Swarm:  t.Mtorrent.Info.Id,
+		Name:   t.Mtorrent.Info.Name,
+		File:   t.DataPath,
+		Length: t.Mtorrent.Info.Length,
+		Err:    err,
+	}
+}
+
+// Closed when the torrent leaves the session
+func (t *Torrent) Done() <-chan struct{} {
+	return t.quit
+}
+
+// Why the torrent stopped, nil if it did not fail
+func (t *Torrent) Err() error {
+	t.status.Lock.RLock()
+	defer t.status.Lock.RUnlock()
+	return t.status.Err
+}
+
+// Whether all pieces were downloaded and written to disk
+func (t *Torrent) Completed() bool {
+	t.status.Lock.RLock()
+	defer t.status.Lock.RUnlock()
+	return t.status.Completed
+}
+
+// Bytes still missing, as announced to the tracker
+func (t *Torrent) left() int64 {
+	t.status.Lock.RLock()
+	defer t.status.Lock.RUnlock()
+	if t.status.Seeding || t.status.Completed {
+		return 0
+	}
+	left := int64(t.Mtorrent.Info.Length) - int64(t.status.PiecesHave)*int64(t.Mtorrent.Info.Piece_length)
+	return max(left, 0)
+}
+
+// Pieces, peers and tracker status of the torrent, see core.Snapshot
+func (t *Torrent) Snapshot() core.Snapshot {
+	return t.status.Snapshot()
+}
+
+func (t *Torrent) Info() control.TorrentInfo {
+	status := t.status
+	status.Lock.RLock()
+	defer status.Lock.RUnlock()
+	info := control.TorrentInfo{
+		Id:         t.Mtorrent.Info.Id,
+		Name:       t.Mtorrent.Info.Name,
+		Length:     t.Mtorrent.Info.Length,
+		Peers:      status.Peers,
+		Downloaded: status.Downloaded,
+		Uploaded:   status.Uploaded,
+		DownRate:   status.DownRate,
+		UpRate:     status.UpRate,
+		Paused:     status.Paused,
+		Seeding:    status.Seeding,
+	}
+	if status.NumberOfPieces > 0 {
+		info.Progress = float64(status.PiecesHave) / float64(status.NumberOfPieces) * 100
+	}
+	return info
+}
@@ -0,0 +1,38 @@
+package downloader
+
+import (
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/core"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/mtorr"
+)
+
+/*
+Serves the file of mtorrent over HTTP at addr while it downloads.
+
+	Range requests are supported, so players can seek. Reads of pieces
+	that did not arrive yet wait for them. Closing the listener stops the server
+*/
+func ServeStream(addr string, mtorrent mtorr.Mtorrent, stream *core.Stream) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Streaming", "name", mtorrent.Info.Name, "url", "http://"+listener.Addr().String()+"/")
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		logger.Debug("Stream request", "from", r.RemoteAddr, "range", r.Header.Get("Range"))
+		// Sniffing the type would read the start of the file, moving the read position there
+		if mime.TypeByExtension(filepath.Ext(mtorrent.Info.Name)) == "" {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		content := io.NewSectionReader(stream, 0, int64(mtorrent.Info.Length))
+		http.ServeContent(w, r, mtorrent.Info.Name, time.Time{}, content)
+	}
+	go http.Serve(listener, http.HandlerFunc(handler))
+	return listener, nil
+}
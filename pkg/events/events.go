@@ -0,0 +1,188 @@
+package events
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+Typed events of the torrents of a session, such as a piece verified or a download completed.
+
+	Subscribers run in their own goroutine, so a slow one does not hold
+	back the downloads, and get the events in the order they were published
+*/
+
+// Event types
+const (
+	PEER_CONNECTED = iota
+	PEER_DISCONNECTED
+	PIECE_VERIFIED     // A downloaded piece matched its hash
+	PIECE_FAILED       // A downloaded piece did not match its hash, and is requested again
+	DOWNLOAD_COMPLETED // All pieces were downloaded and written to File
+	SEEDING_STARTED
+	TRACKER_ERROR // An announce failed. Peers already known keep the torrent running
+)
+
+var NAMES = []string{
+	"peer_connected",
+	"peer_disconnected",
+	"piece_verified",
+	"piece_failed",
+	"download_completed",
+	"seeding_started",
+	"tracker_error",
+}
+
+type Event struct {
+	Type   int
+	Time   time.Time
+	Swarm  string // Id of the torrent
+	Name   string // Name of the torrent
+	File   string // File being downloaded or seeded
+	Length int    // Length of the file
+	Peer   string // Peer id, in peer and piece events
+	Piece  int    // Piece index, in piece events
+	Err    error  // In TRACKER_ERROR
+}
+
+type Handler func(Event)
+
+func (e Event) String() string {
+	text := fmt.Sprintf("%s %s", NAMES[e.Type], e.Name)
+	if e.Peer != "" {
+		text += " peer=" + e.Peer
+	}
+	if e.Type == PIECE_VERIFIED || e.Type == PIECE_FAILED {
+		text += fmt.Sprintf(" piece=%d", e.Piece)
+	}
+	if e.Err != nil {
+		text += " error=" + e.Err.Error()
+	}
+	return text
+}
+
+/*
+Delivers published events to the subscribers.
+
+	A nil *Bus discards the events. Close waits for the subscribers to
+	handle the events already published
+*/
+type Bus struct {
+	lock        sync.Mutex
+	subscribers map[int]*subscriber
+	next        int
+	closed      bool
+	wait        sync.WaitGroup // One for each subscriber goroutine
+}
+
+type subscriber struct {
+	handler Handler
+	types   map[int]bool // All types if empty
+	queue   []Event
+	wake    chan struct{} // Has a value while the queue has events
+	quit    chan struct{} // Closed to stop once the queue is empty
+}
+
+func NewBus() *Bus {
+	return &Bus{subscribers: make(map[int]*subscriber)}
+}
+
+// Calls handler for the events of types, or for all events if none are given. Returns a function that unsubscribes it
+func (b *Bus) Subscribe(handler Handler, types ...int) func() {
+	if b == nil {
+		return func() {}
+	}
+	sub := &subscriber{
+		handler: handler,
+		types:   make(map[int]bool),
+		wake:    make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
+	for _, eventType := range types {
+		sub.types[eventType] = true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return func() {}
+	}
+	id := b.next
+	b.next++
+	b.subscribers[id] = sub
+	b.wait.Add(1)
+	go b.deliver(sub)
+	return func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if _, ok := b.subscribers[id]; ok {
+			delete(b.subscribers, id)
+			close(sub.quit)
+		}
+	}
+}
+
+// Queues event for the subscribers of its type. Does not block
+func (b *Bus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, sub := range b.subscribers {
+		if len(sub.types) > 0 && !sub.types[event.Type] {
+			continue
+		}
+		sub.queue = append(sub.queue, event)
+		select {
+		case sub.wake <- struct{}{}:
+		default: // Already woken
+		}
+	}
+}
+
+// Stops accepting subscribers and waits for the subscribers to handle the events already published
+func (b *Bus) Close() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	if !b.closed {
+		b.closed = true
+		for id, sub := range b.subscribers {
+			delete(b.subscribers, id)
+			close(sub.quit)
+		}
+	}
+	b.lock.Unlock()
+	b.wait.Wait()
+}
+
+func (b *Bus) deliver(sub *subscriber) {
+	defer b.wait.Done()
+	for {
+		b.lock.Lock()
+		queue := sub.queue
+		sub.queue = nil
+		b.lock.Unlock()
+		for _, event := range queue {
+			sub.handler(event)
+		}
+		if len(queue) > 0 {
+			continue
+		}
+		select {
+		case <-sub.wake:
+		case <-sub.quit:
+			b.lock.Lock()
+			empty := len(sub.queue) == 0
+			b.lock.Unlock()
+			if empty {
+				return
+			}
+		}
+	}
+}
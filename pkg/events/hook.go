@@ -0,0 +1,54 @@
+package events
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
+)
+
+var logger = logging.For("events")
+
+/*
+Handler running command with sh -c for each event.
+
+	The event is described by environment variables: MICROTORR_EVENT,
+	MICROTORR_ID, MICROTORR_NAME, MICROTORR_FILE (absolute path),
+	MICROTORR_LENGTH, and MICROTORR_PEER, MICROTORR_PIECE and
+	MICROTORR_ERROR when the event has them. The output of the command
+	goes to the output of MicroTorr
+*/
+func Hook(command string) Handler {
+	return func(event Event) {
+		file, err := filepath.Abs(event.File)
+		if err != nil {
+			file = event.File
+		}
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = append(os.Environ(),
+			"MICROTORR_EVENT="+NAMES[event.Type],
+			"MICROTORR_ID="+event.Swarm,
+			"MICROTORR_NAME="+event.Name,
+			"MICROTORR_FILE="+file,
+			"MICROTORR_LENGTH="+strconv.Itoa(event.Length),
+		)
+		if event.Peer != "" {
+			cmd.Env = append(cmd.Env, "MICROTORR_PEER="+event.Peer)
+		}
+		if event.Type == PIECE_VERIFIED || event.Type == PIECE_FAILED {
+			cmd.Env = append(cmd.Env, "MICROTORR_PIECE="+strconv.Itoa(event.Piece))
+		}
+		if event.Err != nil {
+			cmd.Env = append(cmd.Env, "MICROTORR_ERROR="+event.Err.Error())
+		}
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		logger.Info("Running hook", "event", NAMES[event.Type], logging.Swarm(event.Swarm), "command", command)
+		err = cmd.Run()
+		if err != nil {
+			logger.Warn("Hook failed", "event", NAMES[event.Type], logging.Swarm(event.Swarm), "command", command, "error", err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/colorstring"
+)
+
+/*
+Handler printing coloured lines such as "[INFO] core: Piece received piece=3".
+
+	Each line first clears the terminal line, so the records are not mixed
+	with the progress bar
+*/
+type ConsoleHandler struct {
+	lock   *sync.Mutex
+	writer io.Writer
+	attrs  string // Formatted attributes of WithAttrs
+	group  string // Prefix of the keys, from WithGroup
+}
+
+func NewConsoleHandler(writer io.Writer) *ConsoleHandler {
+	return &ConsoleHandler{lock: &sync.Mutex{}, writer: writer}
+}
+
+func (h *ConsoleHandler) Enabled(_ context.Context, _ slog.Level) bool {
+	return true
+}
+
+func (h *ConsoleHandler) Handle(_ context.Context, record slog.Record) error {
+	var sb strings.Builder
+	sb.WriteString("\033[2K\r")
+	switch {
+	case record.Level >= slog.LevelError:
+		sb.WriteString(colorstring.Color("[red][ERROR][reset] "))
+	case record.Level >= slog.LevelWarn:
+		sb.WriteString(colorstring.Color("[yellow][WARN][reset] "))
+	case record.Level >= slog.LevelInfo:
+		sb.WriteString(colorstring.Color("[blue][INFO][reset] "))
+	default:
+		sb.WriteString(colorstring.Color("[green][DEBUG][reset] "))
+	}
+	component, attrs, _ := strings.Cut(h.attrs, " ")
+	// The component is always the first attribute, added by componentHandler
+	if name, found := strings.CutPrefix(component, "component="); found {
+		sb.WriteString(name + ": ")
+	} else {
+		attrs = h.attrs
+	}
+	sb.WriteString(record.Message)
+	if attrs != "" {
+		sb.WriteString(" " + attrs)
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		writeAttr(&sb, h.group, attr)
+		return true
+	})
+	sb.WriteString("\n")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	_, err := io.WriteString(h.writer, sb.String())
+	return err
+}
+
+func (h *ConsoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var sb strings.Builder
+	sb.WriteString(h.attrs)
+	for _, attr := range attrs {
+		writeAttr(&sb, h.group, attr)
+	}
+	return &ConsoleHandler{lock: h.lock, writer: h.writer, attrs: strings.TrimPrefix(sb.String(), " "), group: h.group}
+}
+
+func (h *ConsoleHandler) WithGroup(name string) slog.Handler {
+	return &ConsoleHandler{lock: h.lock, writer: h.writer, attrs: h.attrs, group: h.group + name + "."}
+}
+
+func writeAttr(sb *strings.Builder, group string, attr slog.Attr) {
+	value := attr.Value.Resolve()
+	if value.Kind() == slog.KindGroup {
+		for _, member := range value.Group() {
+			writeAttr(sb, group+attr.Key+".", member)
+		}
+		return
+	}
+	if attr.Key == "" {
+		return
+	}
+	text := value.String()
+	if strings.ContainsAny(text, " \"=") {
+		text = fmt.Sprintf("%q", text)
+	}
+	sb.WriteString(" " + group + attr.Key + "=" + text)
+}
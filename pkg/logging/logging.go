@@ -0,0 +1,220 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+/*
+Leveled, structured logs of all components, built on log/slog.
+
+	Each package logs through the logger returned by For, tagged with its
+	component name. The output format and the levels can be changed at any
+	time with Setup, or replaced by another slog.Handler with SetHandler,
+	and the loggers already created follow
+*/
+
+// Output formats
+const (
+	FORMAT_CONSOLE = "console" // Coloured lines for terminals, as printed by the CLI
+	FORMAT_TEXT    = "text"    // key=value lines, see slog.TextHandler
+	FORMAT_JSON    = "json"    // One JSON object per line, see slog.JSONHandler
+)
+
+type Config struct {
+	Format     string                // One of FORMAT_*, FORMAT_CONSOLE if empty
+	File       string                // Appends to this file instead of stdout, if not empty
+	Level      slog.Level            // Minimum level of the components without one in Components
+	Components map[string]slog.Level // Minimum level by component name
+}
+
+var (
+	lock       sync.RWMutex
+	handler    slog.Handler = NewConsoleHandler(os.Stdout)
+	level      slog.Level   = slog.LevelWarn
+	components              = map[string]slog.Level{}
+	output     io.Closer
+	terminal   = true // Whether the records are console lines on stdout
+)
+
+// Logger of a component, such as "core" or "tracker"
+func For(component string) *slog.Logger {
+	return slog.New(&componentHandler{component: component})
+}
+
+/*
+Replaces the output and the levels of all loggers.
+
+	The file of a previous Setup, if any, is closed
+*/
+func Setup(config Config) error {
+	var writer io.Writer = os.Stdout
+	var file *os.File
+	var err error
+	if config.File != "" {
+		file, err = os.OpenFile(config.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		writer = file
+	}
+	var newHandler slog.Handler
+	// The handlers filter nothing, componentHandler applies the levels
+	options := &slog.HandlerOptions{Level: slog.Level(-100)}
+	switch config.Format {
+	case "", FORMAT_CONSOLE:
+		newHandler = NewConsoleHandler(writer)
+	case FORMAT_TEXT:
+		newHandler = slog.NewTextHandler(writer, options)
+	case FORMAT_JSON:
+		newHandler = slog.NewJSONHandler(writer, options)
+	default:
+		if file != nil {
+			file.Close()
+		}
+		return fmt.Errorf("unknown log format %q, expected %s, %s or %s", config.Format, FORMAT_CONSOLE, FORMAT_TEXT, FORMAT_JSON)
+	}
+	SetHandler(newHandler)
+	SetLevels(config.Level, config.Components)
+	lock.Lock()
+	defer lock.Unlock()
+	terminal = file == nil && (config.Format == "" || config.Format == FORMAT_CONSOLE)
+	if output != nil {
+		output.Close()
+	}
+	output = nil
+	if file != nil {
+		output = file
+	}
+	return nil
+}
+
+// Sends the records of all components to handler, so programs embedding MicroTorr can capture them
+func SetHandler(newHandler slog.Handler) {
+	lock.Lock()
+	defer lock.Unlock()
+	handler = newHandler
+	terminal = false
+}
+
+// Whether the logs are printed to the terminal as console lines, which the progress bar can share
+func Terminal() bool {
+	lock.RLock()
+	defer lock.RUnlock()
+	return terminal
+}
+
+// Sets the minimum level of all components, and of some of them by name
+func SetLevels(defaultLevel slog.Level, componentLevels map[string]slog.Level) {
+	lock.Lock()
+	defer lock.Unlock()
+	level = defaultLevel
+	components = make(map[string]slog.Level, len(componentLevels))
+	for component, componentLevel := range componentLevels {
+		components[component] = componentLevel
+	}
+}
+
+// Whether a component logs records of level
+func Enabled(component string, recordLevel slog.Level) bool {
+	lock.RLock()
+	defer lock.RUnlock()
+	componentLevel, found := components[component]
+	if !found {
+		componentLevel = level
+	}
+	return recordLevel >= componentLevel
+}
+
+// Level of the -v flags of the CLI: 0 for warnings and errors, 1 and 2 add information, 3 adds debug
+func VerbosityLevel(verbosity int) slog.Level {
+	switch {
+	case verbosity >= 3:
+		return slog.LevelDebug
+	case verbosity >= 1:
+		return slog.LevelInfo
+	default:
+		return slog.LevelWarn
+	}
+}
+
+/*
+Parses levels such as "info", "peerwire=debug" or "warn,dht=debug,core=info".
+
+	Returns the level of all components, defaultLevel if not given,
+	and the levels by component
+*/
+func ParseLevels(spec string, defaultLevel slog.Level) (slog.Level, map[string]slog.Level, error) {
+	componentLevels := make(map[string]slog.Level)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		component, name, found := strings.Cut(part, "=")
+		if !found {
+			component, name = "", part
+		}
+		var parsed slog.Level
+		err := parsed.UnmarshalText([]byte(name))
+		if err != nil {
+			return defaultLevel, nil, fmt.Errorf("invalid log level %q", name)
+		}
+		if component == "" {
+			defaultLevel = parsed
+		} else {
+			componentLevels[component] = parsed
+		}
+	}
+	return defaultLevel, componentLevels, nil
+}
+
+// Swarm attribute, the start of the id as shown by 'MicroTorr ctl list'
+func Swarm(idHash string) slog.Attr {
+	return slog.String("swarm", idHash[:min(len(idHash), 10)])
+}
+
+// Peer attribute, the start of the peer id
+func Peer(peerId string) slog.Attr {
+	return slog.String("peer", peerId[:min(len(peerId), 5)])
+}
+
+// Adds the component to the records and filters them by its level, then passes them to the current handler
+type componentHandler struct {
+	component string
+	apply     []func(slog.Handler) slog.Handler // WithAttrs and WithGroup calls, in order
+}
+
+func (h *componentHandler) Enabled(_ context.Context, recordLevel slog.Level) bool {
+	return Enabled(h.component, recordLevel)
+}
+
+func (h *componentHandler) Handle(ctx context.Context, record slog.Record) error {
+	lock.RLock()
+	current := handler
+	lock.RUnlock()
+	current = current.WithAttrs([]slog.Attr{slog.String("component", h.component)})
+	for _, apply := range h.apply {
+		current = apply(current)
+	}
+	return current.Handle(ctx, record)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *componentHandler) with(apply func(slog.Handler) slog.Handler) slog.Handler {
+	applied := make([]func(slog.Handler) slog.Handler, len(h.apply), len(h.apply)+1)
+	copy(applied, h.apply)
+	return &componentHandler{component: h.component, apply: append(applied, apply)}
+}
@@ -0,0 +1,204 @@
+package lpd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/tracker"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/utils"
+)
+
+var logger = logging.For("lpd")
+
+// Local Peer Discovery, similar to BEP 14
+const (
+	MULTICAST_ADDR  = "239.192.152.143:6771"
+	MULTICAST_ADDR6 = "[ff15::efc0:988f]:6771"
+	ANNOUNCE_METHOD = "BT-SEARCH"
+	LPD_INTERVAL    = 10 * time.Second
+	MAX_PACKET_SIZE = 1500
+)
+
+/*
+Joins the LPD multicast groups and starts announcing infoHash every LPD_INTERVAL.
+
+	The IPv4 group is used if myPeer has an IPv4 address, and the IPv6 group
+	if it has an IPv6 one. Peers announcing the same infoHash are sent to
+	chanDiscovery. intNet selects the interface to use, empty for the system default.
+	Closing quit leaves the groups
+*/
+func Start(
+	intNet, infoHash string,
+	myPeer tracker.Peer,
+	chanDiscovery chan tracker.Peer,
+	quit chan struct{},
+) error {
+	logger := logger.With(logging.Swarm(infoHash))
+	var iface *net.Interface
+	var err error
+	if intNet != "" {
+		iface, err = net.InterfaceByName(intNet)
+		if err != nil {
+			return err
+		}
+	}
+	if myPeer.Ip != "" || myPeer.Ip6 == "" {
+		err = startGroup("udp4", MULTICAST_ADDR, iface, myPeer.Ip, infoHash, myPeer, chanDiscovery, quit, logger)
+		if err != nil {
+			return err
+		}
+	}
+	if myPeer.Ip6 != "" {
+		err = startGroup("udp6", MULTICAST_ADDR6, iface, myPeer.Ip6, infoHash, myPeer, chanDiscovery, quit, logger)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startGroup(
+	network, groupAddr string,
+	iface *net.Interface,
+	localIp, infoHash string,
+	myPeer tracker.Peer,
+	chanDiscovery chan tracker.Peer,
+	quit chan struct{},
+	logger *slog.Logger,
+) error {
+	group, err := net.ResolveUDPAddr(network, groupAddr)
+	if err != nil {
+		return err
+	}
+	listener, err := net.ListenMulticastUDP(network, iface, group)
+	if err != nil {
+		return err
+	}
+	// Binding to our address makes the announces leave through its interface
+	var localAddr *net.UDPAddr
+	if utils.IsLocalIP(localIp) {
+		localAddr = &net.UDPAddr{IP: net.ParseIP(localIp)}
+	}
+	sender, err := net.DialUDP(network, localAddr, group)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	logger.Info("Local Peer Discovery started", "group", groupAddr)
+
+	go Listen(listener, infoHash, myPeer, chanDiscovery, quit, logger)
+	go AnnounceLoop(sender, groupAddr, infoHash, myPeer, quit, logger)
+	return nil
+}
+
+func AnnounceLoop(sender *net.UDPConn, groupAddr, infoHash string, myPeer tracker.Peer, quit chan struct{}, logger *slog.Logger) {
+	defer sender.Close()
+	announce := AnnounceMessage(groupAddr, infoHash, myPeer)
+	for {
+		_, err := sender.Write(announce)
+		if err != nil {
+			logger.Warn("LPD announce failed", "error", err)
+		}
+		select {
+		case <-time.After(LPD_INTERVAL):
+		case <-quit:
+			return
+		}
+	}
+}
+
+func Listen(
+	listener *net.UDPConn,
+	infoHash string,
+	myPeer tracker.Peer,
+	chanDiscovery chan tracker.Peer,
+	quit chan struct{},
+	logger *slog.Logger,
+) {
+	go func() {
+		<-quit
+		listener.Close()
+	}()
+	buffer := make([]byte, MAX_PACKET_SIZE)
+	for {
+		size, from, err := listener.ReadFromUDP(buffer)
+		select {
+		case <-quit:
+			return
+		default:
+		}
+		if err != nil {
+			logger.Warn("LPD stopped listening", "error", err)
+			return
+		}
+		peer, infoHashes, err := ParseAnnounce(buffer[:size])
+		if err != nil {
+			logger.Debug("LPD invalid announce", "from", from, "error", err)
+			continue
+		}
+		if peer.Id == myPeer.Id || !utils.Contains(infoHashes, infoHash) {
+			continue
+		}
+		if from.IP.To4() != nil {
+			peer.Ip = from.IP.String()
+		} else {
+			peer.Ip6 = from.IP.String()
+		}
+		logger.Debug("LPD found peer", logging.Peer(peer.Id), "ip", from.IP)
+		select {
+		case chanDiscovery <- peer:
+		case <-quit:
+			return
+		}
+	}
+}
+
+/*
+Announces follow BEP 14, an HTTP like request sent over UDP:
+
+	BT-SEARCH * HTTP/1.1
+	Host: <multicast group>
+	Port: <port>
+	Infohash: <info hash>
+	Peer-Id: <peer id>
+
+Peer-Id is not in BEP 14. It is needed to filter our own announces and by the peer wire
+*/
+func AnnounceMessage(groupAddr, infoHash string, myPeer tracker.Peer) []byte {
+	var announce strings.Builder
+	announce.WriteString(ANNOUNCE_METHOD + " * HTTP/1.1\r\n")
+	announce.WriteString("Host: " + groupAddr + "\r\n")
+	announce.WriteString("Port: " + strconv.Itoa(myPeer.Port) + "\r\n")
+	announce.WriteString("Infohash: " + infoHash + "\r\n")
+	announce.WriteString("Peer-Id: " + myPeer.Id + "\r\n")
+	announce.WriteString("\r\n\r\n")
+	return []byte(announce.String())
+}
+
+// Returns the announcing peer, without its IP, and the info hashes it announced
+func ParseAnnounce(data []byte) (tracker.Peer, []string, error) {
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return tracker.Peer{}, nil, err
+	}
+	if request.Method != ANNOUNCE_METHOD {
+		return tracker.Peer{}, nil, fmt.Errorf("unexpected method %s", request.Method)
+	}
+	port, err := strconv.Atoi(request.Header.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return tracker.Peer{}, nil, fmt.Errorf("invalid port")
+	}
+	peerId := request.Header.Get("Peer-Id")
+	if len(peerId) < 5 { // Ids are printed capped to 5 characters
+		return tracker.Peer{}, nil, fmt.Errorf("missing or invalid peer id")
+	}
+	return tracker.Peer{Port: port, Id: peerId}, request.Header.Values("Infohash"), nil
+}
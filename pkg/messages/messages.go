@@ -7,6 +7,7 @@ const (
 	DEAD_CONNECTION
 	TRACKER_COMPLETED
 	TRACKER_STOPPED
+	TRACKER_SEEDING // All pieces are here and the torrent stays in the swarm as a seeder
 	HANDSHAKE
 	HAVE
 	BITFIELD
@@ -14,6 +15,9 @@ const (
 	REJECT
 	PIECE
 	HELLO
+	PEX
+	PAUSE
+	RESUME
 	EXIT
 )
 
@@ -26,6 +30,9 @@ type HandShake struct {
 	Pstr   string
 	IdHash string
 	PeerId string
+	Ip     string // Addresses the peer is listening on, so they can be shared with PEX
+	Ip6    string
+	Port   int
 }
 
 type Have struct {
@@ -46,6 +53,24 @@ type Piece struct {
 	Data []byte
 }
 
+// Sent instead of a Piece when the requested piece will not be uploaded, such as while paused
+type Reject struct {
+	PieceIndex int
+}
+
+// Peer Exchange. Lists peers connected to the sender since the last PEX
+type Pex struct {
+	Added   []PexPeer
+	Dropped []PexPeer
+}
+
+type PexPeer struct {
+	Id   string
+	Ip   string
+	Ip6  string
+	Port int
+}
+
 type HelloDebug struct {
 	Msg string
 }
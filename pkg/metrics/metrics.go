@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+Metrics in the Prometheus text format, served at /metrics.
+
+	Values are read from the state of the client or the tracker when
+	scraped, so nothing is kept here
+*/
+
+// Metric types
+const (
+	COUNTER = "counter"
+	GAUGE   = "gauge"
+)
+
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+type Sample struct {
+	Labels []string // Pairs of label name and value
+	Value  float64
+}
+
+// Writes metrics in the text format. Nothing is sent until Flush
+type Writer struct {
+	writer *bufio.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{writer: bufio.NewWriter(w)}
+}
+
+// Writes the samples of the metric name, after its HELP and TYPE lines
+func (w *Writer) Write(name, kind, help string, samples ...Sample) {
+	fmt.Fprintf(w.writer, "# HELP %s %s\n", name, strings.ReplaceAll(help, "\n", " "))
+	fmt.Fprintf(w.writer, "# TYPE %s %s\n", name, kind)
+	for _, sample := range samples {
+		w.writer.WriteString(name)
+		if len(sample.Labels) > 0 {
+			w.writer.WriteString("{")
+			for i := 0; i+1 < len(sample.Labels); i += 2 {
+				if i > 0 {
+					w.writer.WriteString(",")
+				}
+				w.writer.WriteString(sample.Labels[i] + `="` + escape(sample.Labels[i+1]) + `"`)
+			}
+			w.writer.WriteString("}")
+		}
+		w.writer.WriteString(" " + strconv.FormatFloat(sample.Value, 'f', -1, 64) + "\n")
+	}
+}
+
+// Sends what was written
+func (w *Writer) Flush() error {
+	return w.writer.Flush()
+}
+
+// Handler answering with the metrics written by collect
+func Handler(collect func(w *Writer)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", CONTENT_TYPE)
+		writer := NewWriter(w)
+		collect(writer)
+		writer.Flush()
+	})
+}
+
+// Serves the metrics written by collect at http://addr/metrics. Closing the listener stops the server
+func Serve(addr string, collect func(w *Writer)) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler(collect))
+	go http.Serve(listener, mux)
+	return listener, nil
+}
+
+func escape(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return strings.ReplaceAll(value, `"`, `\"`)
+}
@@ -0,0 +1,428 @@
+package microtorr
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/bandwidth"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/control"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/core"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/downloader"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/events"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/metrics"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/mtorr"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/tracker"
+)
+
+/*
+Downloads and seeds of MicroTorr embedded in other programs.
+
+	A Client runs one torrent in its own session, as the download command
+	does. Errors are returned by Start and Wait instead of exiting, and the
+	progress of the torrent is sent as events
+*/
+
+const (
+	DEFAULT_PORT      = "7777"
+	PROGRESS_INTERVAL = time.Second
+	MAX_EVENTS        = 100
+)
+
+// Event types
+const (
+	EVENT_STARTED   = iota // Joined the swarm
+	EVENT_PROGRESS         // Sent every PROGRESS_INTERVAL while the torrent runs
+	EVENT_COMPLETED        // All pieces were downloaded and written to disk
+	EVENT_SEEDING          // Started seeding, after completing or verifying the seed file
+	EVENT_STOPPED          // Left the swarm. Always the last event, unless EVENT_FAILED
+	EVENT_FAILED           // Left the swarm because of Err. Always the last event
+)
+
+var EVENT_NAMES = []string{"started", "progress", "completed", "seeding", "stopped", "failed"}
+
+var (
+	ErrStarted   = errors.New("client already started")
+	ErrNoPeers   = errors.New("the .mtorrent has no tracker, enable Dht or Lpd to find peers")
+	ErrNoTorrent = errors.New("no .mtorrent given, set Mtorrent or MtorrentFile")
+)
+
+var logger = logging.For("client")
+
+// Options of a Client. The zero value of each option is the default of the download command, except where noted
+type Config struct {
+	Mtorrent     mtorr.Mtorrent // Torrent to download or seed
+	MtorrentFile string         // Path of the .mtorrent, loaded by Start when Mtorrent is not set
+
+	Seed       string        // Complete file to seed. Empty to download to the file name of the .mtorrent
+	AutoSeed   bool          // Seed after the download completes
+	LazySeed   bool          // Hash Seed while seeding it, downloading the pieces that do not match
+	SeedRatio  float64       // Leave the swarm once uploaded/downloaded reaches it. 0 for no goal
+	SeedTime   time.Duration // Leave the swarm after seeding this long. 0 for no goal
+	Sequential bool          // Download pieces in order
+	StreamAddr string        // Serve the file over HTTP on this address while it downloads. Empty to disable
+	Priorities []string      // Specs as in core.Priorities.Apply, such as high:0-9
+	StatsOut   string        // Write the download stats to this file when it completes, CSV if it ends in .csv. Empty to disable
+
+	TrackerCA   string // PEM bundle of the CAs to verify HTTPS trackers with. Empty for the system ones
+	TrackerCert string // Certificate presented to HTTPS trackers that check clients, with TrackerKey. Empty for none
+	TrackerKey  string
+
+	Interface    string // Interface to retrieve the IPs from. Empty to let the tracker see them
+	Port         string // DEFAULT_PORT if empty
+	WaitSeeders  int    // Seeders to wait for before the download starts. 0 does not wait, unlike the download command
+	WaitLeechers int
+
+	MaxDownSpeed, MaxUpSpeed         int // KB/s shared by all peers. 0 for no limit
+	MaxPeerDownSpeed, MaxPeerUpSpeed int // KB/s of each peer. 0 for no limit
+	Schedule                         *bandwidth.Schedule
+
+	Dht           bool
+	DhtPort       string // 0 for a random port if empty
+	DhtBootstrap  []string
+	Lpd           bool
+	ControlSocket string // Unix socket to serve the control API on. Empty to disable
+	MetricsAddr   string // Serve Prometheus metrics at http://MetricsAddr/metrics. Empty to disable
+	ShowProgress  bool   // Draw a progress bar on stdout while downloading
+	OnComplete    string // Shell command run when the download completes, see events.Hook. Empty for none
+}
+
+type Event struct {
+	Type int
+	Info control.TorrentInfo
+	Err  error // Why the torrent failed, in EVENT_FAILED
+}
+
+func (e Event) String() string {
+	if e.Type == EVENT_FAILED {
+		return fmt.Sprintf("%s %s: %v", EVENT_NAMES[e.Type], e.Info.Name, e.Err)
+	}
+	return fmt.Sprintf("%s %s %.1f%%", EVENT_NAMES[e.Type], e.Info.Name, e.Info.Progress)
+}
+
+type Client struct {
+	config    Config
+	bus       *events.Bus
+	session   *downloader.Session
+	torrent   *downloader.Torrent
+	listeners []net.Listener // Stream, control API and metrics servers, closed when the torrent stops
+	events    chan Event
+	done      chan struct{} // Closed when the torrent stopped and the session is closed
+	err       error
+	lock      sync.Mutex
+	started   bool
+}
+
+func NewClient(config Config) *Client {
+	return &Client{
+		config: config,
+		bus:    events.NewBus(),
+		events: make(chan Event, MAX_EVENTS),
+		done:   make(chan struct{}),
+	}
+}
+
+/*
+Joins the swarm and starts downloading or seeding in the background.
+
+	Returns an error if the torrent cannot start, which Wait returns as
+	well. A Client starts only once, even if Start fails. Cancelling ctx
+	alerts the tracker and stops the torrent, see Wait
+*/
+func (c *Client) Start(ctx context.Context) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.started {
+		return ErrStarted
+	}
+	c.started = true
+	err := c.start(ctx)
+	if err != nil {
+		c.bus.Close()
+		c.err = err
+		close(c.events)
+		close(c.done)
+	}
+	return err
+}
+
+func (c *Client) start(ctx context.Context) error {
+	config := c.config
+	err := config.check()
+	if err != nil {
+		return err
+	}
+	mtorrent := config.Mtorrent
+	if mtorrent.Info.Id == "" {
+		mtorrent, err = mtorr.LoadMtorrent(config.MtorrentFile)
+		if err != nil {
+			return err
+		}
+	}
+	if mtorrent.Announce == "" && !config.Dht && !config.Lpd {
+		return ErrNoPeers
+	}
+	var trackerTLS *tls.Config
+	if config.TrackerCA != "" || config.TrackerCert != "" {
+		trackerTLS, err = tracker.ClientTLS(config.TrackerCA, config.TrackerCert, config.TrackerKey)
+		if err != nil {
+			return err
+		}
+	}
+	// Checked before the session starts listening
+	err = core.NewPriorities(core.NumberOfPieces(mtorrent)).Apply(config.Priorities)
+	if err != nil {
+		return err
+	}
+	if config.OnComplete != "" {
+		c.bus.Subscribe(events.Hook(config.OnComplete), events.DOWNLOAD_COMPLETED)
+	}
+
+	session, err := downloader.NewSession(config.Interface, config.Port, config.MaxDownSpeed, config.MaxUpSpeed,
+		config.MaxPeerDownSpeed, config.MaxPeerUpSpeed, config.Schedule, config.Dht, config.DhtPort, config.DhtBootstrap, config.Lpd, trackerTLS, c.bus)
+	if err != nil {
+		return fmt.Errorf("error starting session: %w", err)
+	}
+
+	options := config.options()
+	if config.StreamAddr != "" {
+		options.Order = core.ORDER_STREAMING
+		options.Stream = core.NewStream()
+		listener, err := downloader.ServeStream(config.StreamAddr, mtorrent, options.Stream)
+		if err != nil {
+			c.close(session)
+			return fmt.Errorf("error starting stream server: %w", err)
+		}
+		c.listeners = append(c.listeners, listener)
+	}
+
+	torrent, err := session.AddTorrent(mtorrent, options)
+	if err != nil {
+		c.close(session)
+		return fmt.Errorf("error starting torrent: %w", err)
+	}
+
+	if config.ControlSocket != "" {
+		listener, err := control.Listen(session, config.ControlSocket)
+		if err != nil {
+			session.Stop()
+			c.close(session)
+			return fmt.Errorf("error starting control API: %w", err)
+		}
+		c.listeners = append(c.listeners, listener)
+	}
+
+	if config.MetricsAddr != "" {
+		listener, err := metrics.Serve(config.MetricsAddr, session.WriteMetrics)
+		if err != nil {
+			session.Stop()
+			c.close(session)
+			return fmt.Errorf("error starting metrics server: %w", err)
+		}
+		c.listeners = append(c.listeners, listener)
+	}
+
+	c.session = session
+	c.torrent = torrent
+	c.send(Event{Type: EVENT_STARTED, Info: torrent.Info()})
+	go c.run(ctx)
+	return nil
+}
+
+/*
+Calls handler for the events of types, such as events.PIECE_VERIFIED, or for all if none are given.
+
+	Subscribe before Start to get all events. Returns a function that unsubscribes handler
+*/
+func (c *Client) Subscribe(handler events.Handler, types ...int) func() {
+	return c.bus.Subscribe(handler, types...)
+}
+
+// Events of the torrent, closed after the last one. Events are dropped while MAX_EVENTS are waiting to be read
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+/*
+Blocks until the torrent leaves the swarm.
+
+	Returns nil if it completed or reached its seeding goals, the error
+	that made it fail, or the error of the context that stopped it
+*/
+func (c *Client) Wait() error {
+	<-c.done
+	return c.err
+}
+
+// Progress of the torrent, such as its peers and rates
+func (c *Client) Info() control.TorrentInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.torrent == nil {
+		return control.TorrentInfo{}
+	}
+	return c.torrent.Info()
+}
+
+// Pieces, peers and tracker status of the torrent, see core.Snapshot
+func (c *Client) Snapshot() core.Snapshot {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.torrent == nil {
+		return core.Snapshot{}
+	}
+	return c.torrent.Snapshot()
+}
+
+// Stops downloading and uploading pieces, see downloader.Session.Pause
+func (c *Client) Pause(closeConns bool) error {
+	if !c.isStarted() {
+		return errors.New("client not started")
+	}
+	return c.session.Pause(c.torrent.Mtorrent.Info.Id, closeConns)
+}
+
+func (c *Client) Resume() error {
+	if !c.isStarted() {
+		return errors.New("client not started")
+	}
+	return c.session.Resume(c.torrent.Mtorrent.Info.Id)
+}
+
+// Sends the events of the torrent until it leaves the session
+func (c *Client) run(ctx context.Context) {
+	var err error
+	ticker := time.NewTicker(PROGRESS_INTERVAL)
+	defer ticker.Stop()
+	completed, seeding := c.torrent.Completed(), c.torrent.Info().Seeding
+	stopping := ctx.Done()
+	for running := true; running; {
+		select {
+		case <-ticker.C:
+		case <-stopping:
+			logger.Warn("Context done, alerting tracker and stopping execution...", "error", ctx.Err())
+			err = ctx.Err()
+			stopping = nil
+			go c.session.Stop()
+			continue
+		case <-c.torrent.Done():
+			running = false
+		}
+		info := c.torrent.Info()
+		if !completed && c.torrent.Completed() {
+			completed = true
+			c.send(Event{Type: EVENT_COMPLETED, Info: info})
+		}
+		if !seeding && info.Seeding {
+			seeding = true
+			c.send(Event{Type: EVENT_SEEDING, Info: info})
+		}
+		if running {
+			c.send(Event{Type: EVENT_PROGRESS, Info: info})
+		}
+	}
+	c.close(c.session)
+	// Stopped by ctx after completing is still a success
+	if completed {
+		err = nil
+	}
+	if torrentErr := c.torrent.Err(); torrentErr != nil {
+		err = torrentErr
+		c.send(Event{Type: EVENT_FAILED, Info: c.torrent.Info(), Err: err})
+	} else {
+		c.send(Event{Type: EVENT_STOPPED, Info: c.torrent.Info()})
+	}
+	c.err = err
+	close(c.events)
+	close(c.done)
+}
+
+func (c *Client) send(event Event) {
+	select {
+	case c.events <- event:
+	default:
+		logger.Debug("Event dropped, nobody is reading the events", "event", event.String())
+	}
+}
+
+func (c *Client) close(session *downloader.Session) {
+	for _, listener := range c.listeners {
+		listener.Close()
+	}
+	session.Close()
+}
+
+func (c *Client) isStarted() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.torrent != nil
+}
+
+// Options of the torrent, without the stream, which needs its server
+func (config *Config) options() core.Options {
+	options := core.Options{
+		Seed:         config.Seed,
+		AutoSeed:     config.AutoSeed,
+		LazySeed:     config.LazySeed,
+		SeedRatio:    config.SeedRatio,
+		SeedTime:     config.SeedTime,
+		Order:        core.ORDER_RAREST,
+		Priorities:   config.Priorities,
+		StatsOut:     config.StatsOut,
+		WaitSeeders:  config.WaitSeeders,
+		WaitLeechers: config.WaitLeechers,
+		ShowProgress: config.ShowProgress,
+	}
+	if config.Sequential {
+		options.Order = core.ORDER_SEQUENTIAL
+	}
+	return options
+}
+
+// Validates the options, filling the defaults
+func (config *Config) check() error {
+	if config.Mtorrent.Info.Id == "" && config.MtorrentFile == "" {
+		return ErrNoTorrent
+	}
+	if config.Port == "" {
+		config.Port = DEFAULT_PORT
+	}
+	if config.DhtPort == "" {
+		config.DhtPort = "0"
+	}
+	if config.Interface != "" {
+		_, err := net.InterfaceByName(config.Interface)
+		if err != nil {
+			return fmt.Errorf("interface %s not found", config.Interface)
+		}
+	}
+	port, err := strconv.Atoi(config.Port)
+	if err != nil || port < 0 || port >= 65535 {
+		return fmt.Errorf("invalid port: %s", config.Port)
+	}
+	if config.WaitSeeders < 0 || config.WaitLeechers < 0 {
+		return errors.New("WaitSeeders and WaitLeechers must not be negative")
+	}
+	if config.SeedRatio < 0 || config.SeedTime < 0 {
+		return errors.New("SeedRatio and SeedTime must not be negative")
+	}
+	if config.MaxDownSpeed < -1 || config.MaxUpSpeed < -1 || config.MaxPeerDownSpeed < -1 || config.MaxPeerUpSpeed < -1 {
+		return errors.New("speed limits must be greater than -1")
+	}
+	if config.StatsOut != "" {
+		// Checked now instead of when the download completes
+		info, err := os.Stat(filepath.Dir(config.StatsOut))
+		if err != nil || !info.IsDir() {
+			return fmt.Errorf("directory of %s not found", config.StatsOut)
+		}
+	}
+	return nil
+}
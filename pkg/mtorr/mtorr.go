@@ -8,7 +8,7 @@ import (
 	"strings"
 
 	"github.com/jackpal/bencode-go"
-	"github.com/rafaelbarbeta/MicroTorr/pkg/utils"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
 )
 
 const ()
@@ -26,16 +26,21 @@ type Info struct {
 	Id           string
 }
 
-func GenMtorrent(fileName string, tracker string, pieceLength int, verbose int) {
+var logger = logging.For("mtorr")
+
+// Hashes fileName and writes fileName.mtorrent next to it
+func GenMtorrent(fileName string, tracker string, pieceLength int) error {
 	var sha1hash strings.Builder
 	var bencodeBuffer bytes.Buffer
 	mtorrent := Mtorrent{}
 
-	utils.PrintVerbose(verbose, utils.DEBUG, "Reading file", fileName)
+	logger.Debug("Reading file", "file", fileName)
 	data, err := os.ReadFile(fileName)
-	utils.Check(err, verbose, "Error reading file")
+	if err != nil {
+		return err
+	}
 	length := len(data)
-	utils.PrintVerbose(verbose, utils.INFORMATION, "File length:", length)
+	logger.Info("File read", "length", length)
 
 	mtorrent.Announce = tracker
 	mtorrent.Info.Length = length
@@ -44,31 +49,38 @@ func GenMtorrent(fileName string, tracker string, pieceLength int, verbose int)
 
 	for i := 0; i < length; i += pieceLength {
 		p := data[i:Min(i+pieceLength, length)]
-		utils.PrintVerbose(verbose, utils.DEBUG, "Piece", i/pieceLength)
+		logger.Debug("Hashing piece", "piece", i/pieceLength)
 		sha1hash.WriteString(fmt.Sprintf("%x", sha1.Sum(p)))
 	}
 
 	mtorrent.Info.Sha1sum = sha1hash.String()
 	mtorrent.Info.Id = fmt.Sprintf("%x", sha1.Sum(data))
-	utils.PrintVerbose(verbose, utils.VERBOSE, "Mtorrent:", mtorrent)
+	logger.Info("Mtorrent generated", "name", mtorrent.Info.Name, "id", mtorrent.Info.Id, "tracker", mtorrent.Announce)
 
 	// Bencode the Mtorrent
 	err = bencode.Marshal(&bencodeBuffer, mtorrent)
-	utils.Check(err, verbose, "Error bencoding Mtorrent")
+	if err != nil {
+		return fmt.Errorf("error bencoding Mtorrent: %w", err)
+	}
 
-	err = os.WriteFile(fileName+".mtorrent", bencodeBuffer.Bytes(), 0644)
-	utils.Check(err, verbose, "Error writing Mtorrent")
+	return os.WriteFile(fileName+".mtorrent", bencodeBuffer.Bytes(), 0644)
 }
 
-func LoadMtorrent(fileName string, verbosity int) Mtorrent {
+func LoadMtorrent(fileName string) (Mtorrent, error) {
 	mtorrent := Mtorrent{}
 	file, err := os.Open(fileName)
-	utils.Check(err, verbosity, "Error opening Mtorrent", fileName)
+	if err != nil {
+		return mtorrent, err
+	}
+	defer file.Close()
 	err = bencode.Unmarshal(file, &mtorrent)
-	utils.Check(err, verbosity, "Error unmarshalling Mtorrent", fileName)
-	file.Close()
-
-	return mtorrent
+	if err != nil {
+		return mtorrent, err
+	}
+	if mtorrent.Info.Id == "" || mtorrent.Info.Piece_length <= 0 {
+		return mtorrent, fmt.Errorf("%s is not a valid .mtorrent", fileName)
+	}
+	return mtorrent, nil
 }
 
 func (mtorrent Mtorrent) String() string {
@@ -2,115 +2,285 @@ package peerWire
 
 import (
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
-	"strconv"
 	"sync"
+	"time"
 
-	"github.com/conduitio/bwlimit"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/bandwidth"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
 	"github.com/rafaelbarbeta/MicroTorr/pkg/messages"
 	"github.com/rafaelbarbeta/MicroTorr/pkg/tracker"
 	"github.com/rafaelbarbeta/MicroTorr/pkg/utils"
 )
 
+var logger = logging.For("peerwire")
+
+const (
+	PEX_INTERVAL      = 10 * time.Second
+	MIN_PEX_INTERVAL  = PEX_INTERVAL / 2 // PEX messages arriving faster than this are dropped
+	MAX_PEX_ADDED     = 50               // Added peers handled per PEX message, as in BEP 11
+	MAX_PENDING_DIALS = 8                // Discovered peers being dialed at the same time
+)
+
 type peerConn struct {
 	conns   map[string]net.Conn
 	send    map[string]*gob.Encoder
 	receive map[string]*gob.Decoder
+	addrs   map[string]messages.PexPeer // Listening address of each connected peer
+	pexSent map[string]map[string]bool  // Peers already advertised to each connected peer
+	pexLast map[string]time.Time        // When each connected peer last sent a PEX message
+	dialing map[string]bool             // Discovered peers being dialed
 	lock    sync.RWMutex
+	myPeer  tracker.Peer
+	fileId  string
+	limiter *bandwidth.Limiter
+	quit    chan struct{}     // Closed when the swarm is removed from the wire
+	paused  bool              // Connections were closed by a pause, and no new ones are made
+	resume  []tracker.Peer    // Peers to reconnect to when resumed
+	found   chan tracker.Peer // chanDiscovery of the swarm, peers learned from PEX are queued there too
 }
 
-func InitPeerWire(
-	swarm tracker.Swarm,
-	myId string,
-	chanPeerWire, chanCore chan messages.ControlMessage,
-	wait *sync.WaitGroup,
-	maxDownSpeed, maxUpSpeed, verbosity int,
-) {
+/*
+Connections of all swarms of a session.
+
+	The swarms share the listening sockets. Incoming connections are
+	routed to the swarm whose IdHash is in the peer handshake
+*/
+type Wire struct {
+	swarms    map[string]*peerConn
+	chans     map[string]chan messages.ControlMessage // chanPeerWire of each swarm
+	lock      sync.RWMutex
+	limiter   *bandwidth.Limiter
+	listeners []net.Listener
+}
+
+func NewWire(limiter *bandwidth.Limiter) *Wire {
 	gob.Register(messages.HandShake{})
 	gob.Register(messages.Have{})
 	gob.Register(messages.Bitfield{})
 	gob.Register(messages.Request{})
 	gob.Register(messages.Piece{})
+	gob.Register(messages.Reject{})
+	gob.Register(messages.Pex{})
 	gob.Register(messages.HelloDebug{})
 
-	peerConn := peerConn{
+	return &Wire{
+		swarms:  make(map[string]*peerConn),
+		chans:   make(map[string]chan messages.ControlMessage),
+		limiter: limiter,
+	}
+}
+
+// Starts accepting connections on listenAddr, for every swarm of the wire
+func (w *Wire) Listen(listenAddr string) error {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	logger.Debug("Listening for peers", "addr", listenAddr)
+	w.lock.Lock()
+	w.listeners = append(w.listeners, listener)
+	w.lock.Unlock()
+	go ListenForConns(w, listener, logger)
+	return nil
+}
+
+// Stops listening for peers. The swarms are left as they are, see RemoveSwarm
+func (w *Wire) Close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, listener := range w.listeners {
+		listener.Close()
+	}
+	w.listeners = nil
+}
+
+/*
+Adds a swarm to the wire and connects to its peers.
+
+	Messages from peers go to chanPeerWire, and messages in chanCore are sent
+	out to peers. Peers sent to chanDiscovery, and the ones learned from
+	PEX, are dialed as they arrive
+*/
+func (w *Wire) AddSwarm(
+	swarm tracker.Swarm,
+	myId string,
+	chanPeerWire, chanCore chan messages.ControlMessage,
+	chanDiscovery chan tracker.Peer,
+) {
+	logger := logger.With(logging.Swarm(swarm.IdHash))
+	peerConn := &peerConn{
 		conns:   make(map[string]net.Conn),
 		send:    make(map[string]*gob.Encoder),
 		receive: make(map[string]*gob.Decoder),
+		addrs:   make(map[string]messages.PexPeer),
+		pexSent: make(map[string]map[string]bool),
+		pexLast: make(map[string]time.Time),
+		dialing: make(map[string]bool),
 		lock:    sync.RWMutex{},
+		myPeer:  swarm.Peers[myId],
+		fileId:  swarm.IdHash,
+		limiter: w.limiter,
+		quit:    make(chan struct{}),
+		found:   chanDiscovery,
 	}
+	w.lock.Lock()
+	w.swarms[swarm.IdHash] = peerConn
+	w.chans[swarm.IdHash] = chanPeerWire
+	w.lock.Unlock()
+
 	// Connect to all Peers and insert than in the map
 	// Also performs Handshake with each, so they know 'myId'
 	for _, peer := range swarm.Peers {
 		if peer.Id == myId {
 			continue
 		}
-		utils.PrintVerbose(verbosity, utils.INFORMATION, "Connecting to peer: ", peer.Id[:5])
-		dialer := bwlimit.NewDialer(&net.Dialer{}, bwlimit.Byte(maxUpSpeed)*bwlimit.KB, bwlimit.Byte(maxDownSpeed)*bwlimit.KB)
-		conn, err := dialer.Dial("tcp", peer.Ip+":"+strconv.Itoa(peer.Port))
-		utils.Check(err, verbosity, "Error connecting to peer: ", peer.Id[:5])
-		peerConn.conns[peer.Id] = conn
-		peerConn.send[peer.Id] = gob.NewEncoder(conn)
-		peerConn.receive[peer.Id] = gob.NewDecoder(conn)
-		peerId, err := PerfomHandshake(peerConn.send[peer.Id],
-			peerConn.receive[peer.Id],
-			myId,
-			swarm.IdHash,
-			verbosity)
-		utils.Check(err, verbosity, "Error performing Handshake with peer: ", peer.Id[:5])
-		utils.PrintVerbose(verbosity, utils.VERBOSE, "Handshake with peer: ", peer.Id[:5], "sucessful")
-		chanPeerWire <- messages.ControlMessage{
-			Opcode:  messages.NEW_CONNECTION,
-			PeerId:  peerId,
-			Payload: nil,
+		err := ConnectToPeer(peerConn, peer, chanPeerWire, logger)
+		if err != nil {
+			logger.Warn("Error connecting to peer", logging.Peer(peer.Id), "error", err)
 		}
-		go ListenForMessages(&peerConn, peer.Id, chanPeerWire, verbosity)
 	}
 
-	// Start listener for new connections
-	go ListenForConns(
-		&peerConn,
-		myId,
-		swarm.IdHash,
-		swarm.Peers[myId].Ip+":"+strconv.Itoa(swarm.Peers[myId].Port),
-		chanPeerWire,
-		maxDownSpeed,
-		maxUpSpeed,
-		verbosity,
-	)
-
 	// Listen for Core messages to be sent out to peers
-	// TODO: ADD A FOR LOOP TO LISTEN FOR MUTIPLE CORE MESSAGES
 	go ListenForCoreMessages(
-		&peerConn,
+		peerConn,
 		chanCore,
-		wait,
-		verbosity,
+		chanPeerWire,
+		logger,
+	)
+
+	// Periodically tell connected peers about each other
+	go PeerExchange(
+		peerConn,
+		logger,
+	)
+
+	// Connect to peers found without the tracker
+	go ListenForDiscoveredPeers(
+		peerConn,
+		chanDiscovery,
+		chanPeerWire,
+		logger,
 	)
+}
+
+// Closes all connections of a swarm and stops routing connections to it
+func (w *Wire) RemoveSwarm(idHash string) {
+	w.lock.Lock()
+	peerConn, ok := w.swarms[idHash]
+	delete(w.swarms, idHash)
+	delete(w.chans, idHash)
+	w.lock.Unlock()
+	if !ok {
+		return
+	}
+	close(peerConn.quit)
+	peerConn.lock.Lock()
+	for _, conn := range peerConn.conns {
+		conn.Close()
+	}
+	peerConn.lock.Unlock()
+}
 
-	wait.Wait()
+// Dials a peer, performs the handshake and starts listening for its messages
+func ConnectToPeer(
+	peerConn *peerConn,
+	peer tracker.Peer,
+	chanPeerWire chan messages.ControlMessage,
+	logger *slog.Logger,
+) error {
+	logger.Info("Connecting to peer", logging.Peer(peer.Id))
+	var conn net.Conn
+	err := fmt.Errorf("peer has no address")
+	// Tries IPv4 first, then IPv6
+	for _, ip := range []string{peer.Ip, peer.Ip6} {
+		if ip == "" {
+			continue
+		}
+		conn, err = net.Dial("tcp", utils.JoinHostPort(ip, peer.Port))
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	conn = peerConn.limiter.Wrap(conn)
+	gobSend := gob.NewEncoder(conn)
+	gobReceive := gob.NewDecoder(conn)
+	peerHandShake, err := PerfomHandshake(gobSend, gobReceive, peerConn.myPeer, peerConn.fileId, logger)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	logger.Info("Handshake with peer sucessful", logging.Peer(peer.Id))
+	pexPeer := messages.PexPeer{Id: peerHandShake.PeerId, Ip: peer.Ip, Ip6: peer.Ip6, Port: peer.Port}
+	if !AddPeer(peerConn, conn, gobSend, gobReceive, pexPeer, chanPeerWire) {
+		logger.Debug("Already connected to peer", logging.Peer(peer.Id))
+		conn.Close()
+		return nil
+	}
+	go ListenForMessages(peerConn, pexPeer.Id, chanPeerWire, logger)
+	return nil
+}
+
+// Registers a connection that went through the handshake and tells core about it.
+// Returns false if there is already a connection with this peer
+func AddPeer(
+	peerConn *peerConn,
+	conn net.Conn,
+	gobSend *gob.Encoder,
+	gobReceive *gob.Decoder,
+	peer messages.PexPeer,
+	chanPeerWire chan messages.ControlMessage,
+) bool {
+	peerConn.lock.Lock()
+	defer peerConn.lock.Unlock()
+	if _, exists := peerConn.conns[peer.Id]; exists {
+		return false
+	}
+	peerConn.conns[peer.Id] = conn
+	peerConn.send[peer.Id] = gobSend
+	peerConn.receive[peer.Id] = gobReceive
+	peerConn.addrs[peer.Id] = peer
+	peerConn.pexSent[peer.Id] = make(map[string]bool)
+	chanPeerWire <- messages.ControlMessage{
+		Opcode:  messages.NEW_CONNECTION,
+		PeerId:  peer.Id,
+		Payload: conn.RemoteAddr().String(),
+	}
+	return true
 }
 
 func ListenForMessages(
 	peerConn *peerConn,
 	peerId string,
 	chanPeerWire chan messages.ControlMessage,
-	verbosity int,
+	logger *slog.Logger,
 ) {
-	utils.PrintVerbose(verbosity, utils.DEBUG, "Starting listening for messages from peer: ", peerId[:5])
+	logger.Debug("Starting listening for messages from peer", logging.Peer(peerId))
+	peerConn.lock.RLock()
+	receive := peerConn.receive[peerId]
+	peerConn.lock.RUnlock()
 	var msg messages.Message
 	for {
-		err := peerConn.receive[peerId].Decode(&msg)
+		err := receive.Decode(&msg)
 		// verificar desconexão ou erro de envio
 		if err != nil {
 			peerConn.lock.Lock()
-			DisconnectPeer(peerConn, chanPeerWire, peerId, verbosity)
+			DisconnectPeer(peerConn, chanPeerWire, peerId, logger)
 			peerConn.lock.Unlock()
 			return
 		}
 		opcode := MessageOpcode(msg)
-		utils.PrintVerbose(verbosity, utils.DEBUG, "Message from peer: ", peerId[:5], " opcode: ", opcode)
+		logger.Debug("Message from peer", logging.Peer(peerId), "opcode", opcode)
+		if opcode == messages.PEX { // Handled here, core does not need to know about it
+			HandlePex(peerConn, peerId, msg.Data.(messages.Pex), logger)
+			continue
+		}
 		chanPeerWire <- messages.ControlMessage{
 			Opcode:  opcode,
 			PeerId:  peerId,
@@ -121,95 +291,395 @@ func ListenForMessages(
 
 func ListenForCoreMessages(
 	peerConn *peerConn,
-	chanCore chan messages.ControlMessage,
-	wait *sync.WaitGroup,
-	verbosity int,
+	chanCore, chanPeerWire chan messages.ControlMessage,
+	logger *slog.Logger,
 ) {
 	var controlMsg messages.ControlMessage
 	var peerMsg messages.Message
 	for {
-		controlMsg = <-chanCore
+		select {
+		case controlMsg = <-chanCore:
+		case <-peerConn.quit:
+			return
+		}
+		switch controlMsg.Opcode {
+		case messages.PAUSE:
+			PauseSwarm(peerConn, logger)
+			continue
+		case messages.RESUME:
+			ResumeSwarm(peerConn, chanPeerWire, logger)
+			continue
+		}
 		peerMsg = messages.Message{Data: controlMsg.Payload}
 		if controlMsg.PeerId == "" { // Empty string is used to broadcast message
 			peerConn.lock.Lock()
 			for _, conn := range peerConn.send {
 				err := conn.Encode(peerMsg)
 				if err != nil {
-					DisconnectPeer(peerConn, chanCore, controlMsg.PeerId, verbosity)
+					DisconnectPeer(peerConn, chanCore, controlMsg.PeerId, logger)
 				}
 			}
 			peerConn.lock.Unlock()
 		} else {
-			err := peerConn.send[controlMsg.PeerId].Encode(peerMsg)
-			if err != nil {
-				peerConn.lock.Lock()
-				DisconnectPeer(peerConn, chanCore, controlMsg.PeerId, verbosity)
-				peerConn.lock.Unlock()
+			peerConn.lock.Lock()
+			send, ok := peerConn.send[controlMsg.PeerId]
+			if ok && send.Encode(peerMsg) != nil {
+				DisconnectPeer(peerConn, chanCore, controlMsg.PeerId, logger)
 			}
+			peerConn.lock.Unlock()
 		}
 	}
 }
 
 func ListenForConns(
-	peerConn *peerConn,
-	myId, fileId, listenAddr string,
-	chanPeerWire chan messages.ControlMessage,
-	maxDownSpeed, maxUpSpeed, verbosity int,
+	wire *Wire,
+	listener net.Listener,
+	logger *slog.Logger,
 ) {
-	listener, err := net.Listen("tcp", listenAddr)
-	utils.Check(err, verbosity, "Error in ListenForConns")
-	listenerLimited := bwlimit.NewListener(listener, bwlimit.Byte(maxUpSpeed)*bwlimit.KB, bwlimit.Byte(maxUpSpeed)*bwlimit.KB)
 	for {
-		conn, err := listenerLimited.Accept()
-		utils.Check(err, verbosity, "Error in Accepting new connection")
-		utils.PrintVerbose(verbosity, utils.VERBOSE, "New connection from: ", conn.RemoteAddr().String())
-		gobSend := gob.NewEncoder(conn)
-		gobReceive := gob.NewDecoder(conn)
-		peerId, err := PerfomHandshake(gobSend, gobReceive, myId, fileId, verbosity)
-		if err != nil {
-			utils.PrintVerbose(verbosity, utils.CRITICAL, "Error in Perfoming Handshake: ", err)
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			logger.Warn("Error in Accepting new connection", "error", err)
+			time.Sleep(time.Second)
 			continue
 		}
-		peerConn.lock.Lock()
-		peerConn.conns[peerId] = conn
-		peerConn.send[peerId] = gobSend
-		peerConn.receive[peerId] = gobReceive
-		chanPeerWire <- messages.ControlMessage{
-			Opcode:  messages.NEW_CONNECTION,
-			PeerId:  peerId,
-			Payload: nil,
+		logger.Info("New connection", "from", conn.RemoteAddr().String())
+		go AcceptPeer(wire, wire.limiter.Wrap(conn), logger)
+	}
+}
+
+// Performs the handshake of an incoming connection and adds it to the swarm the peer asked for
+func AcceptPeer(
+	wire *Wire,
+	conn net.Conn,
+	logger *slog.Logger,
+) {
+	gobSend := gob.NewEncoder(conn)
+	gobReceive := gob.NewDecoder(conn)
+	peerHandShake, peerConn, chanPeerWire, err := AnswerHandshake(wire, gobSend, gobReceive, logger)
+	if err != nil {
+		logger.Warn("Error in Perfoming Handshake", "from", conn.RemoteAddr().String(), "error", err)
+		conn.Close()
+		return
+	}
+	// Older peers do not advertise their address, so fall back to the one they connected from
+	pexPeer := messages.PexPeer{
+		Id:   peerHandShake.PeerId,
+		Ip:   peerHandShake.Ip,
+		Ip6:  peerHandShake.Ip6,
+		Port: peerHandShake.Port,
+	}
+	if pexPeer.Ip == "" && pexPeer.Ip6 == "" {
+		remoteIp, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if tracker.IsIPv6(remoteIp) {
+			pexPeer.Ip6 = remoteIp
+		} else {
+			pexPeer.Ip = remoteIp
 		}
-		peerConn.lock.Unlock()
-		go ListenForMessages(peerConn, peerId, chanPeerWire, verbosity)
 	}
+	if !AddPeer(peerConn, conn, gobSend, gobReceive, pexPeer, chanPeerWire) {
+		logger.Debug("Dropping duplicated connection", logging.Swarm(peerHandShake.IdHash), logging.Peer(pexPeer.Id))
+		conn.Close()
+		return
+	}
+	go ListenForMessages(peerConn, pexPeer.Id, chanPeerWire, logger)
+}
+
+/*
+Addresses to listen on.
+
+	All interfaces when this peer's addresses are not assigned to this host,
+	as happens when the tracker sees the address of a NAT
+*/
+func ListenAddrs(myPeer tracker.Peer) []string {
+	addrs := make([]string, 0, 2)
+	for _, ip := range []string{myPeer.Ip, myPeer.Ip6} {
+		if utils.IsLocalIP(ip) {
+			addrs = append(addrs, utils.JoinHostPort(ip, myPeer.Port))
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = append(addrs, utils.JoinHostPort("", myPeer.Port))
+	}
+	return addrs
 }
 
 func PerfomHandshake(
 	connSend *gob.Encoder,
 	connRecv *gob.Decoder,
-	myId, fileId string,
-	verbosity int,
-) (string, error) {
+	myPeer tracker.Peer,
+	fileId string,
+	logger *slog.Logger,
+) (messages.HandShake, error) {
 	myHandShake := messages.HandShake{
 		Pstr:   messages.PROTOCOL_ID,
 		IdHash: fileId,
-		PeerId: myId,
+		PeerId: myPeer.Id,
+		Ip:     myPeer.Ip,
+		Ip6:    myPeer.Ip6,
+		Port:   myPeer.Port,
 	}
 
 	peerHandShake := messages.HandShake{}
 	err := connSend.Encode(myHandShake)
 	if err != nil {
-		return "", fmt.Errorf("error sending handshake")
+		return peerHandShake, fmt.Errorf("error sending handshake")
 	}
 	err = connRecv.Decode(&peerHandShake)
 	if err != nil {
-		return "", fmt.Errorf("error receiving handshake")
+		return peerHandShake, fmt.Errorf("error receiving handshake")
 	}
 	if peerHandShake.Pstr != messages.PROTOCOL_ID || fileId != peerHandShake.IdHash {
-		return "", fmt.Errorf("handshake failed: protocol id or file id mismatch")
+		return peerHandShake, fmt.Errorf("handshake failed: protocol id or file id mismatch")
+	}
+	logger.Debug("Handshake sucessful with peer", logging.Swarm(fileId), logging.Peer(peerHandShake.PeerId))
+	return peerHandShake, nil
+}
+
+/*
+Handshake of the accepting side.
+
+	Waits for the peer handshake first, so the answer is sent with
+	the data of the swarm the peer is looking for
+*/
+func AnswerHandshake(
+	wire *Wire,
+	connSend *gob.Encoder,
+	connRecv *gob.Decoder,
+	logger *slog.Logger,
+) (messages.HandShake, *peerConn, chan messages.ControlMessage, error) {
+	peerHandShake := messages.HandShake{}
+	err := connRecv.Decode(&peerHandShake)
+	if err != nil {
+		return peerHandShake, nil, nil, fmt.Errorf("error receiving handshake")
+	}
+	wire.lock.RLock()
+	peerConn, ok := wire.swarms[peerHandShake.IdHash]
+	chanPeerWire := wire.chans[peerHandShake.IdHash]
+	wire.lock.RUnlock()
+	if peerHandShake.Pstr != messages.PROTOCOL_ID || !ok || len(peerHandShake.PeerId) < 5 {
+		return peerHandShake, nil, nil, fmt.Errorf("handshake failed: protocol id mismatch or unknown file id")
+	}
+	peerConn.lock.RLock()
+	paused := peerConn.paused
+	peerConn.lock.RUnlock()
+	if paused {
+		return peerHandShake, nil, nil, fmt.Errorf("handshake refused: swarm is paused")
+	}
+	myHandShake := messages.HandShake{
+		Pstr:   messages.PROTOCOL_ID,
+		IdHash: peerConn.fileId,
+		PeerId: peerConn.myPeer.Id,
+		Ip:     peerConn.myPeer.Ip,
+		Ip6:    peerConn.myPeer.Ip6,
+		Port:   peerConn.myPeer.Port,
+	}
+	err = connSend.Encode(myHandShake)
+	if err != nil {
+		return peerHandShake, nil, nil, fmt.Errorf("error sending handshake")
+	}
+	logger.Debug("Handshake sucessful with peer", logging.Swarm(peerHandShake.IdHash), logging.Peer(peerHandShake.PeerId))
+	return peerHandShake, peerConn, chanPeerWire, nil
+}
+
+/*
+Sends every PEX_INTERVAL a PEX message to each connected peer.
+
+	Each message only carries the difference between the peers currently
+	connected and the ones already advertised to that peer
+*/
+func PeerExchange(
+	peerConn *peerConn,
+	logger *slog.Logger,
+) {
+	ticker := time.NewTicker(PEX_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-peerConn.quit:
+			return
+		}
+		peerConn.lock.Lock()
+		for peerId, send := range peerConn.send {
+			pex := messages.Pex{
+				Added:   make([]messages.PexPeer, 0),
+				Dropped: make([]messages.PexPeer, 0),
+			}
+			sent := peerConn.pexSent[peerId]
+			for otherId, addr := range peerConn.addrs {
+				if otherId != peerId && !sent[otherId] {
+					pex.Added = append(pex.Added, addr)
+					sent[otherId] = true
+				}
+			}
+			for otherId := range sent {
+				if _, connected := peerConn.addrs[otherId]; !connected {
+					pex.Dropped = append(pex.Dropped, messages.PexPeer{Id: otherId})
+					delete(sent, otherId)
+				}
+			}
+			if len(pex.Added) == 0 && len(pex.Dropped) == 0 {
+				continue
+			}
+			logger.Debug("Sending PEX", logging.Peer(peerId), "added", len(pex.Added), "dropped", len(pex.Dropped))
+			if send.Encode(messages.Message{Data: pex}) != nil {
+				// ListenForMessages will notice the closed connection and disconnect the peer
+				peerConn.conns[peerId].Close()
+			}
+		}
+		peerConn.lock.Unlock()
+	}
+}
+
+/*
+Queues for dialing the peers a connected peer told us about.
+
+	PEX comes from untrusted peers, so messages sent faster than
+	MIN_PEX_INTERVAL are dropped, only the first MAX_PEX_ADDED peers of
+	each are looked at, and peers already connected or being dialed are
+	skipped. When chanDiscovery is full, the remaining peers are dropped
+*/
+func HandlePex(
+	peerConn *peerConn,
+	fromPeer string,
+	pex messages.Pex,
+	logger *slog.Logger,
+) {
+	logger.Debug("PEX received", logging.Peer(fromPeer), "added", len(pex.Added), "dropped", len(pex.Dropped))
+	now := time.Now()
+	peerConn.lock.Lock()
+	if now.Sub(peerConn.pexLast[fromPeer]) < MIN_PEX_INTERVAL {
+		peerConn.lock.Unlock()
+		logger.Debug("Dropping PEX sent too soon", logging.Peer(fromPeer))
+		return
+	}
+	peerConn.pexLast[fromPeer] = now
+	added := pex.Added
+	if len(added) > MAX_PEX_ADDED {
+		added = added[:MAX_PEX_ADDED]
+	}
+	peers := make([]tracker.Peer, 0, len(added))
+	seen := make(map[string]bool, len(added))
+	for _, pexPeer := range added {
+		_, connected := peerConn.conns[pexPeer.Id]
+		// Peers with a smaller id dial us, see DialDiscoveredPeer
+		if pexPeer.Id <= peerConn.myPeer.Id || connected || peerConn.dialing[pexPeer.Id] || seen[pexPeer.Id] {
+			continue
+		}
+		seen[pexPeer.Id] = true
+		peers = append(peers, tracker.Peer{Id: pexPeer.Id, Ip: pexPeer.Ip, Ip6: pexPeer.Ip6, Port: pexPeer.Port})
+	}
+	peerConn.lock.Unlock()
+	for i, peer := range peers {
+		select {
+		case peerConn.found <- peer:
+		default:
+			logger.Debug("Discovery is full, dropping PEX peers", logging.Peer(fromPeer), "dropped", len(peers)-i)
+			return
+		}
+	}
+}
+
+/*
+Dials peers sent by PEX and other discovery mechanisms, such as the DHT.
+
+	At most MAX_PENDING_DIALS are dialed at the same time. The others wait
+	in chanDiscovery, and are dropped by the senders once it is full
+*/
+func ListenForDiscoveredPeers(
+	peerConn *peerConn,
+	chanDiscovery chan tracker.Peer,
+	chanPeerWire chan messages.ControlMessage,
+	logger *slog.Logger,
+) {
+	pending := make(chan struct{}, MAX_PENDING_DIALS)
+	for {
+		select {
+		case pending <- struct{}{}:
+		case <-peerConn.quit:
+			return
+		}
+		select {
+		case peer := <-chanDiscovery:
+			go func() {
+				DialDiscoveredPeer(peerConn, peer, chanPeerWire, logger)
+				<-pending
+			}()
+		case <-peerConn.quit:
+			return
+		}
+	}
+}
+
+/*
+Dials a peer learned from PEX or other discovery mechanism, if not connected to it yet.
+
+	Only the peer with the smallest id dials, so two peers that learn
+	about each other at the same time do not open two connections
+*/
+func DialDiscoveredPeer(
+	peerConn *peerConn,
+	peer tracker.Peer,
+	chanPeerWire chan messages.ControlMessage,
+	logger *slog.Logger,
+) {
+	if peer.Id == "" || peer.Id <= peerConn.myPeer.Id {
+		return
+	}
+	peerConn.lock.Lock()
+	_, connected := peerConn.conns[peer.Id]
+	if connected || peerConn.paused || peerConn.dialing[peer.Id] {
+		peerConn.lock.Unlock()
+		return
+	}
+	peerConn.dialing[peer.Id] = true
+	peerConn.lock.Unlock()
+	err := ConnectToPeer(peerConn, peer, chanPeerWire, logger)
+	peerConn.lock.Lock()
+	delete(peerConn.dialing, peer.Id)
+	peerConn.lock.Unlock()
+	if err != nil {
+		logger.Warn("Could not connect to discovered peer", logging.Peer(peer.Id), "error", err)
+	}
+}
+
+/*
+Closes all connections of a swarm and refuses new ones until ResumeSwarm.
+
+	The addresses of the peers are kept, so they can be dialed again on resume
+*/
+func PauseSwarm(peerConn *peerConn, logger *slog.Logger) {
+	peerConn.lock.Lock()
+	defer peerConn.lock.Unlock()
+	peerConn.paused = true
+	for peerId, conn := range peerConn.conns {
+		addr := peerConn.addrs[peerId]
+		peerConn.resume = append(peerConn.resume, tracker.Peer{Id: peerId, Ip: addr.Ip, Ip6: addr.Ip6, Port: addr.Port})
+		// ListenForMessages will notice the closed connection and disconnect the peer
+		conn.Close()
+	}
+	logger.Info("Swarm paused", "closed", len(peerConn.resume))
+}
+
+// Accepts connections again and dials the peers connected before the pause
+func ResumeSwarm(peerConn *peerConn, chanPeerWire chan messages.ControlMessage, logger *slog.Logger) {
+	peerConn.lock.Lock()
+	peers := peerConn.resume
+	peerConn.resume = nil
+	peerConn.paused = false
+	peerConn.lock.Unlock()
+	logger.Info("Swarm resumed", "reconnecting", len(peers))
+	for _, peer := range peers {
+		go func(peer tracker.Peer) {
+			err := ConnectToPeer(peerConn, peer, chanPeerWire, logger)
+			if err != nil {
+				logger.Warn("Could not reconnect to peer", logging.Peer(peer.Id), "error", err)
+			}
+		}(peer)
 	}
-	utils.PrintVerbose(verbosity, utils.DEBUG, "Handshake sucessful with peer: ", peerHandShake.PeerId[:5])
-	return peerHandShake.PeerId, nil
 }
 
 func MessageOpcode(msg messages.Message) int {
@@ -222,6 +692,10 @@ func MessageOpcode(msg messages.Message) int {
 		return messages.REQUEST
 	case messages.Piece:
 		return messages.PIECE
+	case messages.Reject:
+		return messages.REJECT
+	case messages.Pex:
+		return messages.PEX
 	case messages.HelloDebug:
 		return messages.HELLO
 	default:
@@ -233,12 +707,15 @@ func DisconnectPeer(
 	peerConn *peerConn,
 	chanPeerWire chan messages.ControlMessage,
 	peerId string,
-	verbosity int,
+	logger *slog.Logger,
 ) {
-	utils.PrintVerbose(verbosity, utils.CRITICAL, "Peer: ", peerId[:5], "disconnected!")
+	logger.Warn("Peer disconnected", logging.Peer(peerId))
 	delete(peerConn.conns, peerId)
 	delete(peerConn.send, peerId)
 	delete(peerConn.receive, peerId)
+	delete(peerConn.addrs, peerId)
+	delete(peerConn.pexSent, peerId)
+	delete(peerConn.pexLast, peerId)
 	chanPeerWire <- messages.ControlMessage{
 		Opcode:  messages.DEAD_CONNECTION,
 		PeerId:  peerId,
@@ -0,0 +1,136 @@
+package tracker
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Policies for the "ip" and "ipv6" parameters sent by peers
+const (
+	IP_POLICY_NONE    = "none"    // Always use the address the request came from
+	IP_POLICY_PRIVATE = "private" // Also accept addresses in private and loopback ranges
+	IP_POLICY_PROXY   = "proxy"   // Accept any address, but only from trusted proxies
+	IP_POLICY_ANY     = "any"     // Accept any address. Lets peers register third parties!
+)
+
+type AddressConfig struct {
+	IpPolicy       string
+	TrustedProxies []*net.IPNet // X-Forwarded-For is only read from these
+}
+
+var Address = AddressConfig{IpPolicy: IP_POLICY_NONE}
+
+// Sets the address policy. Proxies can be single IPs or CIDR ranges
+func SetAddressPolicy(ipPolicy string, trustedProxies []string) error {
+	switch ipPolicy {
+	case IP_POLICY_NONE, IP_POLICY_PRIVATE, IP_POLICY_PROXY, IP_POLICY_ANY:
+	default:
+		return fmt.Errorf("unknown ip policy %s", ipPolicy)
+	}
+	proxies := make([]*net.IPNet, 0, len(trustedProxies))
+	for _, proxy := range trustedProxies {
+		ipNet, err := ParseNet(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %s", proxy)
+		}
+		proxies = append(proxies, ipNet)
+	}
+	Address = AddressConfig{IpPolicy: ipPolicy, TrustedProxies: proxies}
+	return nil
+}
+
+// Parses a CIDR range, or a single IP as a range with only it
+func ParseNet(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		if IsIPv6(value) {
+			value += "/128"
+		} else {
+			value += "/32"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(value)
+	return ipNet, err
+}
+
+/*
+Returns the IPv4 and IPv6 addresses to register for the peer that sent r.
+
+	By default it is the address of the connection, or the one in X-Forwarded-For
+	when the connection comes from a trusted proxy. The addresses sent as
+	parameters replace it only if the ip policy allows them
+*/
+func PeerAddress(r *http.Request, ipv4, ipv6 string) (string, string, error) {
+	if (ipv4 != "" && net.ParseIP(ipv4).To4() == nil) || (ipv6 != "" && !IsIPv6(ipv6)) {
+		return "", "", fmt.Errorf("invalid IP address")
+	}
+	remoteIp, fromProxy := ClientIP(r)
+	if remoteIp == nil {
+		return "", "", fmt.Errorf("could not find the address of the request")
+	}
+	var peerIpv4, peerIpv6 string
+	if remoteIp.To4() != nil {
+		peerIpv4 = remoteIp.String()
+	} else {
+		peerIpv6 = remoteIp.String()
+	}
+	if ipv4 != "" && ipAllowed(net.ParseIP(ipv4), fromProxy) {
+		peerIpv4 = ipv4
+	}
+	if ipv6 != "" && ipAllowed(net.ParseIP(ipv6), fromProxy) {
+		peerIpv6 = ipv6
+	}
+	return peerIpv4, peerIpv6, nil
+}
+
+/*
+Address of the client that sent r, and whether r went through a trusted proxy.
+
+	X-Forwarded-For is read from right to left, skipping trusted proxies,
+	as entries on its left can be forged by the client
+*/
+func ClientIP(r *http.Request) (net.IP, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !trustedProxy(ip) {
+		return ip, false
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedIp := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if forwardedIp == nil {
+			break
+		}
+		ip = forwardedIp
+		if !trustedProxy(ip) {
+			break
+		}
+	}
+	return ip, true
+}
+
+func ipAllowed(ip net.IP, fromProxy bool) bool {
+	switch Address.IpPolicy {
+	case IP_POLICY_PRIVATE:
+		return ip.IsPrivate() || ip.IsLoopback()
+	case IP_POLICY_PROXY:
+		return fromProxy
+	case IP_POLICY_ANY:
+		return true
+	default:
+		return false
+	}
+}
+
+func trustedProxy(ip net.IP) bool {
+	for _, ipNet := range Address.TrustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
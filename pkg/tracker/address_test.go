@@ -0,0 +1,97 @@
+package tracker
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// Sets the address policy for one test, restoring the default when it ends
+func withAddressPolicy(t *testing.T, ipPolicy string, trustedProxies ...string) {
+	t.Helper()
+	if err := SetAddressPolicy(ipPolicy, trustedProxies); err != nil {
+		t.Fatalf("setting policy %s: %v", ipPolicy, err)
+	}
+	t.Cleanup(func() { Address = AddressConfig{IpPolicy: IP_POLICY_NONE} })
+}
+
+func TestClientIP(t *testing.T) {
+	withAddressPolicy(t, IP_POLICY_NONE, "10.0.0.1", "10.1.0.0/16", "fd00::1")
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string // X-Forwarded-For headers, in order
+		wantIp     string
+		wantProxy  bool
+	}{
+		{"direct", "203.0.113.5:4000", nil, "203.0.113.5", false},
+		{"direct ignores forwarded", "203.0.113.5:4000", []string{"198.51.100.7"}, "203.0.113.5", false},
+		{"address outside the trusted range", "10.2.0.1:4000", []string{"198.51.100.7"}, "10.2.0.1", false},
+		{"trusted proxy", "10.0.0.1:4000", []string{"198.51.100.7"}, "198.51.100.7", true},
+		{"trusted proxy in range", "10.1.2.3:4000", []string{"198.51.100.7"}, "198.51.100.7", true},
+		{"trusted ipv6 proxy", "[fd00::1]:4000", []string{"2001:db8::7"}, "2001:db8::7", true},
+		{"rightmost untrusted hop", "10.0.0.1:4000", []string{"1.2.3.4, 198.51.100.7"}, "198.51.100.7", true},
+		{"trusted hops skipped", "10.0.0.1:4000", []string{"1.2.3.4, 198.51.100.7, 10.1.0.9, 10.0.0.1"}, "198.51.100.7", true},
+		{"headers joined", "10.0.0.1:4000", []string{"1.2.3.4", "198.51.100.7, 10.1.0.9"}, "198.51.100.7", true},
+		{"only trusted hops", "10.0.0.1:4000", []string{"10.1.0.9, 10.1.0.8"}, "10.1.0.9", true},
+		{"no header", "10.0.0.1:4000", nil, "10.0.0.1", true},
+		{"garbage stops the walk", "10.0.0.1:4000", []string{"1.2.3.4, bogus, 10.1.0.9"}, "10.1.0.9", true},
+		{"no port", "203.0.113.5", nil, "203.0.113.5", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/announce", nil)
+		r.RemoteAddr = test.remoteAddr
+		for _, value := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		ip, fromProxy := ClientIP(r)
+		if ip.String() != test.wantIp || fromProxy != test.wantProxy {
+			t.Errorf("%s: got %s from proxy %v, want %s from proxy %v", test.name, ip, fromProxy, test.wantIp, test.wantProxy)
+		}
+	}
+}
+
+func TestPeerAddressPolicies(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     string
+		remoteAddr string
+		ip         string // ip parameter sent by the peer
+		wantIp     string
+	}{
+		{"none ignores the parameter", IP_POLICY_NONE, "203.0.113.5:4000", "192.168.1.2", "203.0.113.5"},
+		{"none ignores it from proxies", IP_POLICY_NONE, "10.0.0.1:4000", "198.51.100.9", "198.51.100.7"},
+		{"private accepts private", IP_POLICY_PRIVATE, "203.0.113.5:4000", "192.168.1.2", "192.168.1.2"},
+		{"private accepts loopback", IP_POLICY_PRIVATE, "203.0.113.5:4000", "127.0.0.1", "127.0.0.1"},
+		{"private refuses public", IP_POLICY_PRIVATE, "203.0.113.5:4000", "198.51.100.9", "203.0.113.5"},
+		{"proxy refuses direct", IP_POLICY_PROXY, "203.0.113.5:4000", "198.51.100.9", "203.0.113.5"},
+		{"proxy accepts from proxies", IP_POLICY_PROXY, "10.0.0.1:4000", "198.51.100.9", "198.51.100.9"},
+		{"any accepts public", IP_POLICY_ANY, "203.0.113.5:4000", "198.51.100.9", "198.51.100.9"},
+	}
+	for _, test := range tests {
+		withAddressPolicy(t, test.policy, "10.0.0.1")
+		r := httptest.NewRequest("GET", "/announce", nil)
+		r.RemoteAddr = test.remoteAddr
+		r.Header.Set("X-Forwarded-For", "198.51.100.7")
+		ipv4, _, err := PeerAddress(r, test.ip, "")
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if ipv4 != test.wantIp {
+			t.Errorf("%s: got %s, want %s", test.name, ipv4, test.wantIp)
+		}
+	}
+}
+
+func TestPeerAddressInvalid(t *testing.T) {
+	withAddressPolicy(t, IP_POLICY_ANY)
+	tests := []struct{ ipv4, ipv6 string }{
+		{"bogus", ""},
+		{"2001:db8::1", ""}, // IPv6 sent as ip
+		{"", "192.168.1.2"}, // IPv4 sent as ipv6
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/announce", nil)
+		if _, _, err := PeerAddress(r, test.ipv4, test.ipv6); err == nil {
+			t.Errorf("ip %q ipv6 %q: accepted, want an error", test.ipv4, test.ipv6)
+		}
+	}
+}
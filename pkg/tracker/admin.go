@@ -0,0 +1,338 @@
+package tracker
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/mtorr"
+)
+
+/*
+Admin API of the tracker, mounted at /admin/ when a token is set.
+
+	Requests must send the token as "Authorization: Bearer TOKEN".
+	GET /admin/peers lists the active peers, of one swarm with ?swarm=ID.
+	DELETE /admin/swarms/ID removes a swarm. GET /admin/bans lists the
+	bans, and POST and DELETE /admin/bans add or lift a ban of a peer id
+	or of an IP range. GET /admin/whitelist lists the allowed torrents, and
+	POST /admin/whitelist/reload loads them again from the whitelist
+	directory
+*/
+
+const ADMIN_TOKEN_ENV = "MICROTORR_ADMIN_TOKEN"
+
+// A ban of a peer id or of an IP range. Exactly one of them is set
+type Ban struct {
+	Peer string `json:"peer,omitempty"`
+	Net  string `json:"net,omitempty"` // CIDR range or single IP
+}
+
+type Bans struct {
+	Peers []string `json:"peers"`
+	Nets  []string `json:"nets"`
+}
+
+type Whitelisted struct {
+	Dir string   `json:"dir"`
+	Ids []string `json:"ids"` // Sorted
+}
+
+// An active peer with the swarm it is in
+type AdminPeer struct {
+	Swarm string `json:"swarm"`
+	PeerStatus
+}
+
+// Guarded by Lock, like the swarms
+var (
+	Whitelist    map[string]bool               // Ids of the torrents allowed. Any torrent if nil
+	WhitelistDir string                        // Where the whitelist is loaded from
+	BannedPeers  = make(map[string]bool)       // By peer id
+	BannedNets   = make(map[string]*net.IPNet) // By CIDR
+)
+
+/*
+Allows only the torrents of the .mtorrent files in dir.
+
+	Swarms of torrents no longer allowed are removed. If some file can not
+	be loaded, the whitelist is left as it was
+*/
+func LoadWhitelist(dir string) (int, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.mtorrent"))
+	if err != nil {
+		return 0, err
+	}
+	whitelist := make(map[string]bool, len(files))
+	for _, file := range files {
+		mtorrent, err := mtorr.LoadMtorrent(file)
+		if err != nil {
+			return 0, err
+		}
+		whitelist[mtorrent.Info.Id] = true
+	}
+
+	Lock.Lock()
+	defer Lock.Unlock()
+	Whitelist = whitelist
+	WhitelistDir = dir
+	for swarmId := range Swarms {
+		if !whitelist[swarmId] {
+			logger.Info("Swarm removed, not in the whitelist", logging.Swarm(swarmId))
+			removeSwarm(swarmId)
+		}
+	}
+	logger.Info("Whitelist loaded", "dir", dir, "torrents", len(whitelist))
+	return len(whitelist), nil
+}
+
+func ReloadWhitelist() (int, error) {
+	Lock.Lock()
+	dir := WhitelistDir
+	Lock.Unlock()
+	if dir == "" {
+		return 0, fmt.Errorf("the tracker has no whitelist directory")
+	}
+	return LoadWhitelist(dir)
+}
+
+func GetWhitelist() Whitelisted {
+	Lock.Lock()
+	defer Lock.Unlock()
+	whitelisted := Whitelisted{Dir: WhitelistDir, Ids: make([]string, 0, len(Whitelist))}
+	for id := range Whitelist {
+		whitelisted.Ids = append(whitelisted.Ids, id)
+	}
+	sort.Strings(whitelisted.Ids)
+	return whitelisted
+}
+
+// Whether announces for the torrent are accepted. Called with Lock held
+func allowed(swarmId string) bool {
+	return Whitelist == nil || Whitelist[swarmId]
+}
+
+// Whether the peer id or any of the addresses is banned. Called with Lock held
+func banned(peerId string, addresses ...string) bool {
+	if BannedPeers[peerId] {
+		return true
+	}
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			continue
+		}
+		for _, ipNet := range BannedNets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Bans a peer id or an IP range, removing the peers it matches from every swarm
+func AddBan(ban Ban) error {
+	Lock.Lock()
+	defer Lock.Unlock()
+	switch {
+	case ban.Peer != "" && ban.Net == "":
+		BannedPeers[ban.Peer] = true
+	case ban.Net != "" && ban.Peer == "":
+		ipNet, err := ParseNet(ban.Net)
+		if err != nil {
+			return fmt.Errorf("invalid IP range %s", ban.Net)
+		}
+		BannedNets[ipNet.String()] = ipNet
+	default:
+		return fmt.Errorf("a ban needs either a peer id or an IP range")
+	}
+	for swarmId, swarm := range Swarms {
+		for peerId, peer := range swarm.Peers {
+			if banned(peerId, peer.Ip, peer.Ip6) {
+				logger.Info("Banned peer removed", logging.Swarm(swarmId), logging.Peer(peerId))
+				removePeer(swarmId, peerId)
+			}
+		}
+	}
+	logger.Info("Ban added", "peer", ban.Peer, "net", ban.Net)
+	return nil
+}
+
+func RemoveBan(ban Ban) error {
+	Lock.Lock()
+	defer Lock.Unlock()
+	if ban.Peer != "" {
+		if !BannedPeers[ban.Peer] {
+			return fmt.Errorf("peer %s is not banned", ban.Peer)
+		}
+		delete(BannedPeers, ban.Peer)
+		return nil
+	}
+	ipNet, err := ParseNet(ban.Net)
+	if err != nil {
+		return fmt.Errorf("invalid IP range %s", ban.Net)
+	}
+	if _, ok := BannedNets[ipNet.String()]; !ok {
+		return fmt.Errorf("%s is not banned", ipNet)
+	}
+	delete(BannedNets, ipNet.String())
+	return nil
+}
+
+func GetBans() Bans {
+	Lock.Lock()
+	defer Lock.Unlock()
+	bans := Bans{Peers: make([]string, 0, len(BannedPeers)), Nets: make([]string, 0, len(BannedNets))}
+	for peerId := range BannedPeers {
+		bans.Peers = append(bans.Peers, peerId)
+	}
+	for cidr := range BannedNets {
+		bans.Nets = append(bans.Nets, cidr)
+	}
+	sort.Strings(bans.Peers)
+	sort.Strings(bans.Nets)
+	return bans
+}
+
+// Active peers of every swarm, or only of swarmId if set, sorted by swarm and id
+func ActivePeers(swarmId string) []AdminPeer {
+	Lock.Lock()
+	defer Lock.Unlock()
+	peers := make([]AdminPeer, 0)
+	for id := range Swarms {
+		if swarmId != "" && id != swarmId {
+			continue
+		}
+		for _, peer := range swarmStatus(id, true).Peers {
+			peers = append(peers, AdminPeer{Swarm: id, PeerStatus: peer})
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Swarm != peers[j].Swarm {
+			return peers[i].Swarm < peers[j].Swarm
+		}
+		return peers[i].Id < peers[j].Id
+	})
+	return peers
+}
+
+// Removes a swarm with all its peers. Peers starting it again create it again, unless the whitelist forbids it
+func RemoveSwarm(swarmId string) bool {
+	Lock.Lock()
+	defer Lock.Unlock()
+	if _, ok := Swarms[swarmId]; !ok {
+		return false
+	}
+	removeSwarm(swarmId)
+	logger.Info("Swarm removed", logging.Swarm(swarmId))
+	return true
+}
+
+// Slots of the peers in the wheel are left to the sweeper. Called with Lock held
+func removeSwarm(swarmId string) {
+	for peerId := range Swarms[swarmId].Peers {
+		delete(PeerStates, swarmId+peerId)
+	}
+	delete(Swarms, swarmId)
+	delete(History, swarmId)
+}
+
+// Removes a peer from a swarm, and the swarm with its last peer. Called with Lock held
+func removePeer(swarmId, peerId string) {
+	swarm, ok := Swarms[swarmId]
+	if !ok {
+		return
+	}
+	delete(swarm.Peers, peerId)
+	delete(PeerStates, swarmId+peerId)
+	if len(swarm.Peers) == 0 {
+		logger.Info("Swarm removed, its last peer left", logging.Swarm(swarmId))
+		removeSwarm(swarmId)
+	}
+}
+
+// Handler of the admin API, to be mounted at /admin/. Requests without token are refused
+func AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/peers", func(w http.ResponseWriter, r *http.Request) {
+		if !method(w, r, "GET") {
+			return
+		}
+		writeJson(w, ActivePeers(r.URL.Query().Get("swarm")))
+	})
+	mux.HandleFunc("/admin/swarms/", func(w http.ResponseWriter, r *http.Request) {
+		if !method(w, r, "DELETE") {
+			return
+		}
+		if !RemoveSwarm(strings.TrimPrefix(r.URL.Path, "/admin/swarms/")) {
+			http.Error(w, "Swarm not found", http.StatusNotFound)
+		}
+	})
+	mux.HandleFunc("/admin/bans", func(w http.ResponseWriter, r *http.Request) {
+		if !method(w, r, "GET", "POST", "DELETE") {
+			return
+		}
+		if r.Method == "GET" {
+			writeJson(w, GetBans())
+			return
+		}
+		var ban Ban
+		err := json.NewDecoder(r.Body).Decode(&ban)
+		if err != nil {
+			http.Error(w, "Invalid ban: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Method == "POST" {
+			err = AddBan(ban)
+		} else {
+			err = RemoveBan(ban)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	})
+	mux.HandleFunc("/admin/whitelist", func(w http.ResponseWriter, r *http.Request) {
+		if !method(w, r, "GET") {
+			return
+		}
+		writeJson(w, GetWhitelist())
+	})
+	mux.HandleFunc("/admin/whitelist/reload", func(w http.ResponseWriter, r *http.Request) {
+		if !method(w, r, "POST") {
+			return
+		}
+		_, err := ReloadWhitelist()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJson(w, GetWhitelist())
+	})
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			logger.Warn("Unauthorized admin request", "from", r.RemoteAddr, "path", r.URL.Path)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// Whether the request uses one of methods, answering it otherwise
+func method(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
@@ -0,0 +1,100 @@
+package tracker
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Longest a request to the admin API waits for the tracker
+const ADMIN_TIMEOUT = 30 * time.Second
+
+// Client of the admin API of a running tracker
+type AdminClient struct {
+	url   string // Of the tracker, without path
+	token string
+	http  *http.Client
+}
+
+// tlsConfig is used for HTTPS trackers, nil for the defaults
+func NewAdminClient(trackerUrl, token string, tlsConfig *tls.Config) *AdminClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &AdminClient{
+		url:   strings.TrimSuffix(trackerUrl, "/"),
+		token: token,
+		http:  &http.Client{Transport: transport, Timeout: ADMIN_TIMEOUT},
+	}
+}
+
+func (c *AdminClient) Peers(swarmId string) ([]AdminPeer, error) {
+	peers := make([]AdminPeer, 0)
+	err := c.do("GET", "/admin/peers?swarm="+url.QueryEscape(swarmId), nil, &peers)
+	return peers, err
+}
+
+func (c *AdminClient) RemoveSwarm(swarmId string) error {
+	return c.do("DELETE", "/admin/swarms/"+url.PathEscape(swarmId), nil, nil)
+}
+
+func (c *AdminClient) Bans() (Bans, error) {
+	var bans Bans
+	err := c.do("GET", "/admin/bans", nil, &bans)
+	return bans, err
+}
+
+func (c *AdminClient) Ban(ban Ban) error {
+	return c.do("POST", "/admin/bans", ban, nil)
+}
+
+func (c *AdminClient) Unban(ban Ban) error {
+	return c.do("DELETE", "/admin/bans", ban, nil)
+}
+
+func (c *AdminClient) Whitelist() (Whitelisted, error) {
+	var whitelisted Whitelisted
+	err := c.do("GET", "/admin/whitelist", nil, &whitelisted)
+	return whitelisted, err
+}
+
+func (c *AdminClient) ReloadWhitelist() (Whitelisted, error) {
+	var whitelisted Whitelisted
+	err := c.do("POST", "/admin/whitelist/reload", nil, &whitelisted)
+	return whitelisted, err
+}
+
+// Sends body as JSON and decodes the JSON response into result, when they are not nil
+func (c *AdminClient) do(method, path string, body, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	request, err := http.NewRequest(method, c.url+path, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+c.token)
+	response, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		message, _ := io.ReadAll(response.Body)
+		return errors.New(strings.TrimSpace(string(message)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
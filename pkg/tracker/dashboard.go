@@ -0,0 +1,228 @@
+package tracker
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/utils"
+)
+
+/*
+HTML dashboard of the swarms, and the JSON API it is built from.
+
+	GET /api/swarms lists the swarms with their peer counts, and
+	GET /api/swarms/ID adds the peers and the last announces of a swarm.
+	The pages at / and /swarm/ID show the same data, and refresh every
+	DASHBOARD_REFRESH
+*/
+
+const DASHBOARD_REFRESH = 10 // Seconds
+
+type SwarmStatus struct {
+	Id           string           `json:"id"`
+	PeerCount    int              `json:"peer_count"`
+	Seeders      int              `json:"seeders"`
+	Leechers     int              `json:"leechers"` // Includes peers that did not announce what they miss
+	LastAnnounce time.Time        `json:"last_announce"`
+	Peers        []PeerStatus     `json:"peers,omitempty"`   // Only for a single swarm, sorted by id
+	History      []AnnounceRecord `json:"history,omitempty"` // Only for a single swarm, newest first
+}
+
+type PeerStatus struct {
+	Id       string    `json:"id"`
+	Ip       string    `json:"ip,omitempty"`
+	Ip6      string    `json:"ip6,omitempty"`
+	Port     int       `json:"port"`
+	Seeder   bool      `json:"seeder"`
+	Left     int64     `json:"left"` // -1 if the peer did not say
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Summary of every swarm, sorted by id
+func SwarmStatuses() []SwarmStatus {
+	Lock.Lock()
+	defer Lock.Unlock()
+	statuses := make([]SwarmStatus, 0, len(Swarms))
+	for swarmId := range Swarms {
+		statuses = append(statuses, swarmStatus(swarmId, false))
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Id < statuses[j].Id
+	})
+	return statuses
+}
+
+// Summary of a swarm with its peers and last announces
+func GetSwarmStatus(swarmId string) (SwarmStatus, bool) {
+	Lock.Lock()
+	defer Lock.Unlock()
+	if _, ok := Swarms[swarmId]; !ok {
+		return SwarmStatus{}, false
+	}
+	return swarmStatus(swarmId, true), true
+}
+
+// Called with Lock held
+func swarmStatus(swarmId string, details bool) SwarmStatus {
+	status := SwarmStatus{Id: swarmId, PeerCount: len(Swarms[swarmId].Peers)}
+	history := History[swarmId]
+	if len(history) > 0 {
+		status.LastAnnounce = history[len(history)-1].Time
+	}
+	for peerId, peer := range Swarms[swarmId].Peers {
+		peerStatus := PeerStatus{Id: peerId, Ip: peer.Ip, Ip6: peer.Ip6, Port: peer.Port, Left: -1}
+		if state, ok := PeerStates[swarmId+peerId]; ok {
+			peerStatus.Left = state.Left
+			peerStatus.LastSeen = state.LastSeen
+		}
+		peerStatus.Seeder = peerStatus.Left == 0
+		if peerStatus.Seeder {
+			status.Seeders++
+		} else {
+			status.Leechers++
+		}
+		if details {
+			status.Peers = append(status.Peers, peerStatus)
+		}
+	}
+	if details {
+		sort.Slice(status.Peers, func(i, j int) bool {
+			return status.Peers[i].Id < status.Peers[j].Id
+		})
+		for i := len(history) - 1; i >= 0; i-- {
+			status.History = append(status.History, history[i])
+		}
+	}
+	return status
+}
+
+// Handler of the dashboard pages and of the JSON API, to be mounted at /
+func Dashboard() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/swarms", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, SwarmStatuses())
+	})
+	mux.HandleFunc("/api/swarms/", func(w http.ResponseWriter, r *http.Request) {
+		status, ok := GetSwarmStatus(strings.TrimPrefix(r.URL.Path, "/api/swarms/"))
+		if !ok {
+			http.Error(w, "Swarm not found", http.StatusNotFound)
+			return
+		}
+		writeJson(w, status)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		Lock.Lock()
+		announces := make(map[string]int64, len(Announces))
+		for event, count := range Announces {
+			announces[event] = count
+		}
+		timeouts := Timeouts
+		Lock.Unlock()
+		renderPage(w, "swarms", map[string]any{
+			"Swarms":    SwarmStatuses(),
+			"Announces": announces,
+			"Events":    ANNOUNCE_EVENTS,
+			"Timeouts":  timeouts,
+		})
+	})
+	mux.HandleFunc("/swarm/", func(w http.ResponseWriter, r *http.Request) {
+		status, ok := GetSwarmStatus(strings.TrimPrefix(r.URL.Path, "/swarm/"))
+		if !ok {
+			http.Error(w, "Swarm not found", http.StatusNotFound)
+			return
+		}
+		renderPage(w, "swarm", status)
+	})
+	return mux
+}
+
+func writeJson(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		logger.Warn("Error writing dashboard JSON", "error", err)
+	}
+}
+
+func renderPage(w http.ResponseWriter, name string, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := pages.ExecuteTemplate(w, name, data)
+	if err != nil {
+		logger.Warn("Error rendering dashboard page", "page", name, "error", err)
+	}
+}
+
+var pages = template.Must(template.New("").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return time.Since(t).Truncate(time.Second).String() + " ago"
+	},
+	"addr": func(peer PeerStatus) string {
+		addrs := make([]string, 0, 2)
+		if peer.Ip != "" {
+			addrs = append(addrs, utils.JoinHostPort(peer.Ip, peer.Port))
+		}
+		if peer.Ip6 != "" {
+			addrs = append(addrs, utils.JoinHostPort(peer.Ip6, peer.Port))
+		}
+		return strings.Join(addrs, " ")
+	},
+	"refresh": func() int { return DASHBOARD_REFRESH },
+}).Parse(`
+{{define "head"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{refresh}}">
+<title>MicroTorr tracker</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+th { background: #eee; }
+td.id { font-family: monospace; }
+</style>
+</head>
+<body>
+{{end}}
+
+{{define "swarms"}}{{template "head"}}
+<h1>MicroTorr tracker</h1>
+<p>{{len .Swarms}} swarms. Announces:{{range .Events}} {{.}} {{index $.Announces .}},{{end}} timeouts {{.Timeouts}}. <a href="/api/swarms">JSON</a></p>
+<table>
+<tr><th>Swarm</th><th>Peers</th><th>Seeders</th><th>Leechers</th><th>Last announce</th></tr>
+{{range .Swarms}}<tr><td class="id"><a href="/swarm/{{.Id}}">{{.Id}}</a></td><td>{{.PeerCount}}</td><td>{{.Seeders}}</td><td>{{.Leechers}}</td><td>{{ago .LastAnnounce}}</td></tr>
+{{else}}<tr><td colspan="5">No swarms yet</td></tr>
+{{end}}</table>
+</body>
+</html>
+{{end}}
+
+{{define "swarm"}}{{template "head"}}
+<h1>Swarm <span class="id">{{.Id}}</span></h1>
+<p><a href="/">All swarms</a>. {{.PeerCount}} peers, {{.Seeders}} seeders, {{.Leechers}} leechers. <a href="/api/swarms/{{.Id}}">JSON</a></p>
+<h2>Peers</h2>
+<table>
+<tr><th>Peer</th><th>Address</th><th>Seeder</th><th>Bytes left</th><th>Last seen</th></tr>
+{{range .Peers}}<tr><td class="id">{{.Id}}</td><td>{{addr .}}</td><td>{{if .Seeder}}yes{{else}}no{{end}}</td><td>{{if lt .Left 0}}unknown{{else}}{{.Left}}{{end}}</td><td>{{ago .LastSeen}}</td></tr>
+{{else}}<tr><td colspan="5">No peers</td></tr>
+{{end}}</table>
+<h2>Last announces</h2>
+<table>
+<tr><th>Time</th><th>Peer</th><th>Address</th><th>Event</th></tr>
+{{range .History}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td class="id">{{.Peer}}</td><td>{{.Addr}}</td><td>{{.Event}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+{{end}}
+`))
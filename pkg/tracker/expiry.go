@@ -0,0 +1,94 @@
+package tracker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
+)
+
+/*
+Removal of the peers that stop sending alive, with a timer wheel.
+
+	The wheel has a slot for each SWEEP_INTERVAL of ALIVE_TIMER, and a peer
+	entering a swarm is put in the slot of the moment it expires. A single
+	sweeper goes through the slots as their moment passes, removing the
+	peers whose PeerState was not seen for ALIVE_TIMER, and moving the ones
+	that announced since then to the slot of their new expiry. So an alive
+	announce only updates LastSeen, and each peer is in one slot at most
+	once, whatever it announces
+*/
+
+const (
+	SWEEP_INTERVAL = time.Second
+	WHEEL_SLOTS    = int(ALIVE_TIMER/SWEEP_INTERVAL) + 2 // Expiries are never further than ALIVE_TIMER
+)
+
+type peerKey struct {
+	swarmId string
+	peerId  string
+}
+
+// Guarded by Lock, like the swarms
+var (
+	wheel     = make([]map[peerKey]struct{}, WHEEL_SLOTS)
+	lastSwept int64 // Tick of the last slot swept
+)
+
+var sweeperOnce sync.Once
+
+func tick(t time.Time) int64 {
+	return t.UnixNano() / int64(SWEEP_INTERVAL)
+}
+
+// Puts a peer in the slot of the tick after its expiry, so it is never swept early. Called with Lock held
+func schedule(swarmId, peerId string, lastSeen time.Time) {
+	sweeperOnce.Do(func() {
+		lastSwept = tick(time.Now())
+		go sweeper()
+	})
+	slot := int((tick(lastSeen.Add(ALIVE_TIMER)) + 1) % int64(WHEEL_SLOTS))
+	if wheel[slot] == nil {
+		wheel[slot] = make(map[peerKey]struct{})
+	}
+	wheel[slot][peerKey{swarmId, peerId}] = struct{}{}
+}
+
+func sweeper() {
+	ticker := time.NewTicker(SWEEP_INTERVAL)
+	for now := range ticker.C {
+		Lock.Lock()
+		sweep(now)
+		Lock.Unlock()
+	}
+}
+
+// Sweeps the slots of the ticks up to now. Called with Lock held
+func sweep(now time.Time) {
+	last := tick(now)
+	// After a stall every slot is swept once
+	if last-lastSwept > int64(WHEEL_SLOTS) {
+		lastSwept = last - int64(WHEEL_SLOTS)
+	}
+	for ; lastSwept < last; lastSwept++ {
+		slot := int((lastSwept + 1) % int64(WHEEL_SLOTS))
+		peers := wheel[slot]
+		if len(peers) == 0 {
+			continue
+		}
+		wheel[slot] = nil
+		for key := range peers {
+			state, ok := PeerStates[key.swarmId+key.peerId]
+			if !ok {
+				continue // Left the swarm or was removed
+			}
+			if now.Sub(state.LastSeen) < ALIVE_TIMER {
+				schedule(key.swarmId, key.peerId, state.LastSeen)
+				continue
+			}
+			logger.Warn("Peer timed out", logging.Swarm(key.swarmId), logging.Peer(key.peerId))
+			removePeer(key.swarmId, key.peerId)
+			Timeouts++
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package tracker
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
+)
+
+/*
+Benchmarks of the tracker with BENCH_PEERS peers in BENCH_SWARMS swarms.
+
+	Run with go test -bench . -benchmem ./pkg/tracker. Besides the time
+	and allocations of each announce, the heap and the goroutines left
+	with all the peers in the swarms are reported. The sweeps are timed
+	over the ticks of a whole ALIVE_TIMER, with a clock of their own
+*/
+
+const (
+	BENCH_PEERS  = 100000
+	BENCH_SWARMS = 1000
+	BENCH_TICKS  = int(ALIVE_TIMER / SWEEP_INTERVAL) // Sweeps in an ALIVE_TIMER
+)
+
+func init() {
+	// Timeouts are logged as warnings
+	logging.SetLevels(slog.LevelError, nil)
+}
+
+func resetTracker() {
+	Lock.Lock()
+	for swarmId := range Swarms {
+		removeSwarm(swarmId)
+	}
+	Announces = make(map[string]int64)
+	wheel = make([]map[peerKey]struct{}, WHEEL_SLOTS)
+	Lock.Unlock()
+	SetLimits(LimitsConfig{})
+}
+
+func announce(swarm, peer int, event string) {
+	url := fmt.Sprintf("/announce?swarmId=swarm%d&peerId=peer%d&port=6881&event=%s", swarm, peer, event)
+	request := httptest.NewRequest("GET", url, nil)
+	request.RemoteAddr = fmt.Sprintf("10.%d.%d.%d:6881", peer>>16&255, peer>>8&255, peer&255)
+	recorder := httptest.NewRecorder()
+	Announce(recorder, request)
+	if recorder.Code != http.StatusOK {
+		panic(fmt.Sprintf("announce %s of peer %d: %d %s", event, peer, recorder.Code, recorder.Body))
+	}
+}
+
+func startPeers(peers int) {
+	for peer := 0; peer < peers; peer++ {
+		announce(peer%BENCH_SWARMS, peer, "started")
+	}
+}
+
+// Heap in use and goroutines running, after a GC
+func reportUsage(b *testing.B) {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	b.ReportMetric(float64(stats.HeapInuse)/1e6, "heap-MB")
+	b.ReportMetric(float64(runtime.NumGoroutine()), "goroutines")
+}
+
+// Peers entering the swarms, until BENCH_PEERS are in them
+func BenchmarkStarted(b *testing.B) {
+	resetTracker()
+	defer resetTracker()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%BENCH_PEERS == 0 {
+			b.StopTimer()
+			resetTracker()
+			b.StartTimer()
+		}
+		announce(i%BENCH_SWARMS, i%BENCH_PEERS, "started")
+	}
+	b.StopTimer()
+	resetTracker()
+	startPeers(BENCH_PEERS)
+	reportUsage(b)
+}
+
+// Alive announces of BENCH_PEERS peers already in the swarms
+func BenchmarkAlive(b *testing.B) {
+	resetTracker()
+	defer resetTracker()
+	startPeers(BENCH_PEERS)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		peer := i % BENCH_PEERS
+		announce(peer%BENCH_SWARMS, peer, "alive")
+	}
+	b.StopTimer()
+	reportUsage(b)
+}
+
+/*
+Puts BENCH_PEERS peers in the swarms without announcing. Called with Lock held.
+
+	Each peer was put in the wheel when it announced at scheduled, and
+	last announced at lastSeen
+*/
+func fillPeers(scheduled, lastSeen func(peer int) time.Time) {
+	for peer := 0; peer < BENCH_PEERS; peer++ {
+		swarmId, peerId := fmt.Sprintf("swarm%d", peer%BENCH_SWARMS), fmt.Sprintf("peer%d", peer)
+		swarm, ok := Swarms[swarmId]
+		if !ok {
+			swarm = Swarm{IdHash: swarmId, Peers: make(map[string]Peer)}
+			Swarms[swarmId] = swarm
+		}
+		swarm.Peers[peerId] = Peer{Ip: "10.0.0.1", Port: 6881, Id: peerId}
+		PeerStates[swarmId+peerId] = &PeerState{LastSeen: lastSeen(peer), Left: -1}
+		schedule(swarmId, peerId, scheduled(peer))
+	}
+}
+
+// Put in the wheel evenly over the ALIVE_TIMER before start, so they expire evenly over the one after it
+func evenly(start time.Time) func(peer int) time.Time {
+	return func(peer int) time.Time {
+		return start.Add(-ALIVE_TIMER + time.Duration(peer%BENCH_TICKS)*SWEEP_INTERVAL)
+	}
+}
+
+// Sweeps every tick of the ALIVE_TIMER after start. Called with Lock held
+func sweepAll(start time.Time) {
+	lastSwept = tick(start)
+	for i := 1; i <= BENCH_TICKS; i++ {
+		sweep(start.Add(time.Duration(i) * SWEEP_INTERVAL))
+	}
+}
+
+// Sweeps of BENCH_PEERS peers that all stopped announcing
+func BenchmarkSweepExpired(b *testing.B) {
+	resetTracker()
+	defer resetTracker()
+	Lock.Lock()
+	defer Lock.Unlock()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		start := time.Now()
+		fillPeers(evenly(start), evenly(start))
+		b.StartTimer()
+		sweepAll(start)
+		if len(PeerStates) != 0 {
+			b.Fatalf("%d peers not expired", len(PeerStates))
+		}
+	}
+}
+
+// Sweeps of BENCH_PEERS peers that all announced again right after start, so each is moved to another slot
+func BenchmarkSweepAlive(b *testing.B) {
+	resetTracker()
+	defer resetTracker()
+	Lock.Lock()
+	defer Lock.Unlock()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		start := time.Now()
+		wheel = make([]map[peerKey]struct{}, WHEEL_SLOTS)
+		fillPeers(evenly(start), func(peer int) time.Time { return start.Add(SWEEP_INTERVAL) })
+		b.StartTimer()
+		sweepAll(start)
+		if len(PeerStates) != BENCH_PEERS {
+			b.Fatalf("%d peers expired", BENCH_PEERS-len(PeerStates))
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package tracker
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+/*
+Limits that protect the tracker from misbehaving clients.
+
+	Each IP has a token bucket of announces. Swarms and peers are capped, so
+	a client can not fill the memory with them, and known peers can not
+	announce again sooner than the minimum interval, except to leave. Every
+	limit answers with its own status and message, and 429s say when to
+	retry in Retry-After
+*/
+
+const (
+	DEFAULT_ANNOUNCE_RATE  = 10 // Per second, for each IP
+	DEFAULT_ANNOUNCE_BURST = 50
+	DEFAULT_MAX_SWARMS     = 10000
+	DEFAULT_MAX_PEERS      = 1000 // In each swarm
+	DEFAULT_MIN_INTERVAL   = 5 * time.Second
+	LIMITER_IDLE           = time.Minute // Buckets of IPs that did not announce for this long are dropped
+)
+
+// Reasons announces are rejected for, as counted in Rejected
+const (
+	REJECT_RATE      = "rate"
+	REJECT_INTERVAL  = "interval"
+	REJECT_SWARMS    = "swarms"
+	REJECT_PEERS     = "peers"
+	REJECT_WHITELIST = "whitelist"
+	REJECT_BANNED    = "banned"
+)
+
+var REJECT_REASONS = []string{REJECT_RATE, REJECT_INTERVAL, REJECT_SWARMS, REJECT_PEERS, REJECT_WHITELIST, REJECT_BANNED}
+
+// 0 disables a limit
+type LimitsConfig struct {
+	AnnounceRate  float64 // Announces per second from each IP
+	AnnounceBurst int     // Announces an IP can send at once
+	MaxSwarms     int
+	MaxPeers      int // In each swarm
+	MinInterval   time.Duration
+}
+
+var Limits = LimitsConfig{
+	AnnounceRate:  DEFAULT_ANNOUNCE_RATE,
+	AnnounceBurst: DEFAULT_ANNOUNCE_BURST,
+	MaxSwarms:     DEFAULT_MAX_SWARMS,
+	MaxPeers:      DEFAULT_MAX_PEERS,
+	MinInterval:   DEFAULT_MIN_INTERVAL,
+}
+
+var Rejected = make(map[string]int64) // Announces rejected by reason. Guarded by Lock
+
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Buckets of each IP, with their own lock so flooding IPs do not hold Lock
+var (
+	ipLimiters     = make(map[string]*ipLimiter)
+	ipLimitersLock sync.Mutex
+	lastIdleSweep  time.Time
+)
+
+func SetLimits(limits LimitsConfig) error {
+	if limits.AnnounceRate < 0 || limits.AnnounceBurst < 0 || limits.MaxSwarms < 0 || limits.MaxPeers < 0 || limits.MinInterval < 0 {
+		return fmt.Errorf("tracker limits can not be negative")
+	}
+	if limits.AnnounceRate > 0 && limits.AnnounceBurst == 0 {
+		return fmt.Errorf("an announce rate needs a burst of at least 1")
+	}
+	Limits = limits
+	ipLimitersLock.Lock()
+	ipLimiters = make(map[string]*ipLimiter)
+	ipLimitersLock.Unlock()
+	return nil
+}
+
+// Takes an announce from the bucket of ip. If it is empty, returns how long until it is not
+func allowAnnounce(ip string) (bool, time.Duration) {
+	if Limits.AnnounceRate == 0 {
+		return true, 0
+	}
+	ipLimitersLock.Lock()
+	defer ipLimitersLock.Unlock()
+	now := time.Now()
+	if now.Sub(lastIdleSweep) > LIMITER_IDLE {
+		for key, bucket := range ipLimiters {
+			if now.Sub(bucket.lastSeen) > LIMITER_IDLE {
+				delete(ipLimiters, key)
+			}
+		}
+		lastIdleSweep = now
+	}
+	bucket, ok := ipLimiters[ip]
+	if !ok {
+		bucket = &ipLimiter{limiter: rate.NewLimiter(rate.Limit(Limits.AnnounceRate), Limits.AnnounceBurst)}
+		ipLimiters[ip] = bucket
+	}
+	bucket.lastSeen = now
+	reservation := bucket.limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// Whether a known peer announced less than MinInterval ago, and how long until it may. Called with Lock held
+func tooSoon(swarmId, peerId string) (bool, time.Duration) {
+	state, ok := PeerStates[swarmId+peerId]
+	if !ok || Limits.MinInterval == 0 {
+		return false, 0
+	}
+	wait := Limits.MinInterval - time.Since(state.LastSeen)
+	return wait > 0, wait
+}
+
+// Whether a known peer that was missing pieces announces it has them all. Called with Lock held
+func becameSeeder(swarmId, peerId string, left int64) bool {
+	state, ok := PeerStates[swarmId+peerId]
+	return ok && left == 0 && state.Left != 0
+}
+
+// Answers a rejected announce. Called with Lock held
+func reject(w http.ResponseWriter, reason, message string, status int, retryAfter time.Duration) {
+	Rejected[reason]++
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+	http.Error(w, message, status)
+}
@@ -0,0 +1,39 @@
+package tracker
+
+import (
+	"sort"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/metrics"
+)
+
+var ANNOUNCE_EVENTS = []string{"started", "alive", "completed", "stopped"}
+
+// Writes the metrics of the swarms and announces, as served by --metrics
+func WriteMetrics(w *metrics.Writer) {
+	Lock.Lock()
+	swarmIds := make([]string, 0, len(Swarms))
+	for swarmId := range Swarms {
+		swarmIds = append(swarmIds, swarmId)
+	}
+	sort.Strings(swarmIds)
+	peers := make([]metrics.Sample, 0, len(swarmIds))
+	for _, swarmId := range swarmIds {
+		peers = append(peers, metrics.Sample{Labels: []string{"swarm", swarmId}, Value: float64(len(Swarms[swarmId].Peers))})
+	}
+	announces := make([]metrics.Sample, 0, len(ANNOUNCE_EVENTS))
+	for _, event := range ANNOUNCE_EVENTS {
+		announces = append(announces, metrics.Sample{Labels: []string{"event", event}, Value: float64(Announces[event])})
+	}
+	rejected := make([]metrics.Sample, 0, len(REJECT_REASONS))
+	for _, reason := range REJECT_REASONS {
+		rejected = append(rejected, metrics.Sample{Labels: []string{"reason", reason}, Value: float64(Rejected[reason])})
+	}
+	timeouts := Timeouts
+	Lock.Unlock()
+
+	w.Write("microtorr_tracker_swarms", metrics.GAUGE, "Swarms known by the tracker.", metrics.Sample{Value: float64(len(swarmIds))})
+	w.Write("microtorr_tracker_peers", metrics.GAUGE, "Peers in a swarm.", peers...)
+	w.Write("microtorr_tracker_announces_total", metrics.COUNTER, "Announces received, by event.", announces...)
+	w.Write("microtorr_tracker_rejected_total", metrics.COUNTER, "Announces rejected, by reason.", rejected...)
+	w.Write("microtorr_tracker_timeouts_total", metrics.COUNTER, "Peers removed for not sending alive in time.", metrics.Sample{Value: float64(timeouts)})
+}
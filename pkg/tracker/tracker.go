@@ -3,10 +3,13 @@ package tracker
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
 	"github.com/rafaelbarbeta/MicroTorr/pkg/utils"
 )
 
@@ -18,56 +21,163 @@ type Swarm struct {
 // Peers also should send a request with their status ("started," "stopped" or "completed")
 type Peer struct {
 	Ip   string
+	Ip6  string
 	Port int
 	Id   string
 }
 
 const (
-	ALIVE_TIMER = 30 * time.Second
+	ALIVE_TIMER      = 30 * time.Second
+	ANNOUNCE_HISTORY = 50 // Announces kept for each swarm
 )
 
+// What the tracker knows about a peer besides its address
+type PeerState struct {
+	LastSeen time.Time // Last announce
+	Left     int64     // Bytes the peer is missing, 0 for seeders. -1 if it did not say
+}
+
+type AnnounceRecord struct {
+	Time  time.Time `json:"time"`
+	Peer  string    `json:"peer"`
+	Addr  string    `json:"addr"`
+	Event string    `json:"event"`
+}
+
+var logger = logging.For("tracker")
+
 var (
-	Swarms        = make(map[string]Swarm)
-	TimerChannels = make(map[string]*chan bool)
+	Swarms     = make(map[string]Swarm)
+	Lock       sync.Mutex                          // Guards all of these
+	Announces  = make(map[string]int64)            // Announces by event
+	Timeouts   int64                               // Peers removed for not sending alive
+	PeerStates = make(map[string]*PeerState)       // By swarmId+peerId, for every peer in the swarms
+	History    = make(map[string][]AnnounceRecord) // Last ANNOUNCE_HISTORY announces of each swarm, oldest first
 )
 
-func Announce(w http.ResponseWriter, r *http.Request, verbosity int) {
-	fmt.Println("Announce")
+func Announce(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	client, _ := ClientIP(r)
+	if ok, retryAfter := allowAnnounce(client.String()); !ok {
+		logger.Debug("Announce rate limited", "from", client)
+		Lock.Lock()
+		reject(w, REJECT_RATE, "Too many announces from this address", http.StatusTooManyRequests, retryAfter)
+		Lock.Unlock()
+		return
+	}
 	queryParams := r.URL.Query()
-	utils.PrintVerbose(3, utils.VERBOSE, "Received request: ", r.URL)
+	logger.Debug("Received announce", "url", r.URL)
 	swarmId := queryParams.Get("swarmId")
 	peerId := queryParams.Get("peerId")
-	ipv4 := queryParams.Get("ip")
+	ipv4, ipv6, err := PeerAddress(r, queryParams.Get("ip"), queryParams.Get("ipv6"))
+	if err != nil {
+		logger.Warn("Invalid peer address", "from", r.RemoteAddr, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Used only to identify the peer in the logs
+	ip := ipv4
+	if ip == "" {
+		ip = ipv6
+	}
 	port, err := strconv.Atoi(queryParams.Get("port"))
 	if err != nil {
-		utils.PrintVerbose(verbosity, utils.CRITICAL, ipv4, ":Invalid port: Not a Number")
+		logger.Warn("Invalid port: Not a Number", "ip", ip)
 		http.Error(w, "Invalid port: Not a Number", http.StatusBadRequest)
 		return
 	}
+	left := int64(-1)
+	if queryParams.Has("left") {
+		left, err = strconv.ParseInt(queryParams.Get("left"), 10, 64)
+		if err != nil || left < 0 {
+			logger.Warn("Invalid left: Not a positive number", "ip", ip)
+			http.Error(w, "Invalid left: Not a positive number", http.StatusBadRequest)
+			return
+		}
+	}
 	event := queryParams.Get("event")
-	if swarmId == "" || peerId == "" || ipv4 == "" || port == 0 || event == "" {
-		utils.PrintVerbose(1, utils.CRITICAL, ipv4, ":Missing required parameters")
+	if swarmId == "" || peerId == "" || port == 0 || event == "" {
+		logger.Warn("Missing required parameters", "ip", ip)
 		http.Error(w, "Missing required parameters", http.StatusBadRequest)
 		return
 	}
+	switch event {
+	case "started", "stopped", "completed", "alive":
+	default:
+		logger.Warn("Invalid event", logging.Swarm(swarmId), logging.Peer(peerId), "ip", ip, "event", event)
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	peer := Peer{Ip: ipv4, Ip6: ipv6, Port: port, Id: peerId}
 
+	Lock.Lock()
+	defer Lock.Unlock()
+	if !allowed(swarmId) {
+		logger.Warn("Torrent not in the whitelist", logging.Swarm(swarmId), "ip", ip)
+		reject(w, REJECT_WHITELIST, "Torrent not allowed by this tracker", http.StatusForbidden, 0)
+		return
+	}
+	if banned(peerId, ipv4, ipv6, client.String()) {
+		logger.Warn("Banned peer", logging.Swarm(swarmId), logging.Peer(peerId), "ip", ip)
+		reject(w, REJECT_BANNED, "Peer banned by this tracker", http.StatusForbidden, 0)
+		return
+	}
+	// Leaving is always allowed, and so is telling all pieces are here, which peers announce as soon as it happens
+	if event == "started" || (event == "alive" && !becameSeeder(swarmId, peerId, left)) {
+		if soon, retryAfter := tooSoon(swarmId, peerId); soon {
+			logger.Debug("Peer announced too soon", logging.Swarm(swarmId), logging.Peer(peerId), "ip", ip)
+			reject(w, REJECT_INTERVAL, fmt.Sprintf("Announced too soon, the minimum interval is %v", Limits.MinInterval),
+				http.StatusTooManyRequests, retryAfter)
+			return
+		}
+	}
 	swarm, exist := Swarms[swarmId]
+	// Only started creates a swarm, the other events are for peers already in one
+	if !exist && event != "started" {
+		logger.Debug("Announce for an unknown swarm", logging.Swarm(swarmId), logging.Peer(peerId), "ip", ip, "event", event)
+		if event == "alive" {
+			http.Error(w, "Peer is not in this swarm", http.StatusBadRequest)
+		} else {
+			w.Write([]byte("Peer exited the swarm"))
+		}
+		return
+	}
+	if !exist && Limits.MaxSwarms > 0 && len(Swarms) >= Limits.MaxSwarms {
+		logger.Warn("Swarm limit reached", logging.Swarm(swarmId), "ip", ip, "swarms", len(Swarms))
+		reject(w, REJECT_SWARMS, "Tracker is full: too many swarms", http.StatusServiceUnavailable, 0)
+		return
+	}
+	if _, known := swarm.Peers[peerId]; event == "started" && exist && !known && Limits.MaxPeers > 0 && len(swarm.Peers) >= Limits.MaxPeers {
+		logger.Warn("Peer limit reached", logging.Swarm(swarmId), logging.Peer(peerId), "ip", ip, "peers", len(swarm.Peers))
+		reject(w, REJECT_PEERS, "Swarm is full: too many peers", http.StatusServiceUnavailable, 0)
+		return
+	}
+	state, known := PeerStates[swarmId+peerId]
+	if event == "alive" && !known {
+		logger.Debug("Keep alive from a peer not in the swarm", logging.Swarm(swarmId), logging.Peer(peerId), "ip", ip)
+		http.Error(w, "Peer is not in this swarm", http.StatusBadRequest)
+		return
+	}
 	if !exist {
-		utils.PrintVerbose(verbosity, utils.INFORMATION, ipv4, ":New Swarm created with ID: ", swarmId)
+		logger.Info("New swarm created", logging.Swarm(swarmId), "ip", ip)
 		swarm = Swarm{IdHash: swarmId, Peers: make(map[string]Peer)}
-		swarm.Peers[peerId] = Peer{Ip: ipv4, Port: port, Id: peerId}
 		Swarms[swarmId] = swarm
 	}
 
+	// Only accepted announces are counted
+	Announces[event]++
+	addHistory(swarmId, AnnounceRecord{Time: time.Now(), Peer: peerId, Addr: utils.JoinHostPort(ip, port), Event: event})
 	switch event {
 	case "started":
-		utils.PrintVerbose(verbosity, utils.VERBOSE, ipv4, ":", port, " :Peer entered the swarm: ", swarmId)
-		startPeerTimer(swarmId, peerId, verbosity)
-		swarm.Peers[peerId] = Peer{Ip: ipv4, Port: port, Id: peerId}
+		logger.Info("Peer entered the swarm", logging.Swarm(swarmId), logging.Peer(peerId), "addr", utils.JoinHostPort(ip, port))
+		swarm.Peers[peerId] = peer
+		PeerStates[swarmId+peerId] = &PeerState{LastSeen: time.Now(), Left: left}
+		if !known {
+			schedule(swarmId, peerId, PeerStates[swarmId+peerId].LastSeen)
+		}
 		swarmJson, error := json.Marshal(swarm)
 		if error != nil {
 			panic("Error marshalling swarm to JSON")
@@ -75,40 +185,31 @@ func Announce(w http.ResponseWriter, r *http.Request, verbosity int) {
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(swarmJson)
 	case "stopped", "completed":
-		utils.PrintVerbose(verbosity, utils.VERBOSE, ipv4, ":", port, " :Peer exited the swarm")
-		delete(swarm.Peers, peerId)
-		delete(TimerChannels, swarmId+peerId)
+		logger.Info("Peer exited the swarm", logging.Swarm(swarmId), logging.Peer(peerId), "addr", utils.JoinHostPort(ip, port), "event", event)
+		removePeer(swarmId, peerId)
 		w.Write([]byte("Peer exited the swarm"))
 	case "alive":
-		utils.PrintVerbose(verbosity, utils.DEBUG, ipv4, ":", port, " :Peer is alive")
-		chanPeer, ok := TimerChannels[swarmId+peerId]
-		if ok {
-			*chanPeer <- true
-			startPeerTimer(swarmId, peerId, verbosity)
-		} else {
-			http.Error(w, "Peer is not in this swarm", http.StatusBadRequest)
+		logger.Debug("Peer is alive", logging.Swarm(swarmId), logging.Peer(peerId), "addr", utils.JoinHostPort(ip, port))
+		// The sweeper finds the new LastSeen when the peer would have expired
+		state.LastSeen = time.Now()
+		if left >= 0 {
+			state.Left = left
 		}
-	default:
-		utils.PrintVerbose(verbosity, utils.CRITICAL, ipv4, ":Sent an invalid event!")
-		http.Error(w, "Invalid event", http.StatusBadRequest)
 	}
 
-	utils.PrintVerbose(verbosity, utils.DEBUG, "Swarm now: ", Swarms[swarmId])
+	logger.Debug("Swarm updated", logging.Swarm(swarmId), "peers", len(Swarms[swarmId].Peers))
 }
 
-func startPeerTimer(swarmId, peerId string, verbosity int) {
-	peerTimer := time.NewTimer(ALIVE_TIMER)
-	stopChannel := make(chan bool)
-	TimerChannels[swarmId+peerId] = &stopChannel
-	go func() {
-		select {
-		case <-peerTimer.C:
-			utils.PrintVerbose(verbosity, utils.CRITICAL, peerId, ":Peer timed out")
-			delete(Swarms[swarmId].Peers, peerId)
-			delete(TimerChannels, swarmId+peerId)
-		case <-stopChannel:
-			utils.PrintVerbose(verbosity, utils.DEBUG, peerId, ":Peer timer stopped")
-			break
-		}
-	}()
+// Called with Lock held
+func addHistory(swarmId string, record AnnounceRecord) {
+	history := append(History[swarmId], record)
+	if len(history) > ANNOUNCE_HISTORY {
+		history = history[len(history)-ANNOUNCE_HISTORY:]
+	}
+	History[swarmId] = history
+}
+
+func IsIPv6(address string) bool {
+	ip := net.ParseIP(address)
+	return ip != nil && ip.To4() == nil
 }
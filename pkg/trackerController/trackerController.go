@@ -1,84 +1,200 @@
 package trackercontroller
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	neturl "net/url"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
 	"github.com/rafaelbarbeta/MicroTorr/pkg/messages"
 	"github.com/rafaelbarbeta/MicroTorr/pkg/tracker"
-	"github.com/rafaelbarbeta/MicroTorr/pkg/utils"
 )
 
-func GetTrackerInfo(url, id, swarmId, ip, port string, verbosity int) tracker.Swarm {
-	urlParameters := url + fmt.Sprintf(
-		"/announce?peerId=%s&swarmId=%s&ip=%s&port=%s&event=started",
-		id, swarmId, ip, port)
+var logger = logging.For("trackercontroller")
 
-	utils.PrintVerbose(verbosity, utils.VERBOSE, "Requesting: ", urlParameters)
-	response, err := http.Get(urlParameters)
-	utils.Check(err, verbosity, "Error requesting ", urlParameters)
+// Longest an announce waits for the tracker, so a hung tracker does not keep the torrent from leaving
+const ANNOUNCE_TIMEOUT = 30 * time.Second
+
+// Client of the announces, verifying HTTPS trackers and presenting a certificate to them with config. nil for the defaults
+func NewClient(config *tls.Config) *http.Client {
+	client := &http.Client{Timeout: ANNOUNCE_TIMEOUT}
+	if config != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		client.Transport = transport
+	}
+	return client
+}
+
+func GetTrackerInfo(client *http.Client, url, id, swarmId, ip, ip6, port string, left int64) (tracker.Swarm, error) {
 	var swarm tracker.Swarm
+	urlParameters := AnnounceUrl(url, id, swarmId, ip, ip6, port, "started", left)
+
+	logger.Info("Announcing to tracker", logging.Swarm(swarmId), "url", urlParameters)
+	response, err := client.Get(urlParameters)
+	if err != nil {
+		return swarm, fmt.Errorf("error requesting %s: %w", urlParameters, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return swarm, fmt.Errorf("tracker answered %s", response.Status)
+	}
 	err = json.NewDecoder(response.Body).Decode(&swarm)
-	utils.Check(err, verbosity, "Error decoding JSON response")
+	if err != nil {
+		return swarm, fmt.Errorf("error decoding JSON response: %w", err)
+	}
 
-	return swarm
+	return swarm, nil
 }
 
-func InitTrackerController(url, id, swarmId, ip, port string, verbosity int, chanTracker chan messages.ControlMessage) {
+/*
+Builds the announce request.
+
+	Empty addresses are left out, so the tracker only gets the families
+	this peer has. left is the number of bytes missing, 0 for seeders,
+	and is left out if negative
+*/
+func AnnounceUrl(url, id, swarmId, ip, ip6, port, event string, left int64) string {
+	query := neturl.Values{}
+	query.Set("peerId", id)
+	query.Set("swarmId", swarmId)
+	if ip != "" {
+		query.Set("ip", ip)
+	}
+	if ip6 != "" {
+		query.Set("ipv6", ip6)
+	}
+	query.Set("port", port)
+	query.Set("event", event)
+	if left >= 0 {
+		query.Set("left", strconv.FormatInt(left, 10))
+	}
+	return url + "/announce?" + query.Encode()
+}
+
+/*
+Keeps this peer registered in the tracker and reports the events sent by core.
+
+	It is the only one leaving the swarm: the first completed or stopped
+	event is announced, wait is released and the controller returns, so
+	events sent later are never read. While paused, the peer leaves the
+	swarm and no keep alive is sent. Seeding is announced right away as a
+	keep alive with nothing left, as the tracker removes peers announcing
+	completed. Peers returned when it resumes are sent to chanDiscovery. left tells the bytes still missing. The result
+	of each announce, sent with client, is passed to onAnnounce, nil if it
+	succeeded
+*/
+func InitTrackerController(
+	client *http.Client,
+	url, id, swarmId, ip, ip6, port string,
+	left func() int64,
+	chanTracker chan messages.ControlMessage,
+	chanDiscovery chan tracker.Peer,
+	wait *sync.WaitGroup,
+	onAnnounce func(error),
+) {
+	logger := logger.With(logging.Swarm(swarmId))
+	paused := false
+	report := func(err error) {
+		if err != nil {
+			logger.Warn("Tracker error", "error", err)
+		}
+		onAnnounce(err)
+	}
 	timer := time.NewTimer(tracker.ALIVE_TIMER - 15*time.Second)
+	defer timer.Stop()
 	for {
 		select {
 		case <-timer.C:
-			KeepAlive(url, id, swarmId, ip, port, verbosity)
+			if !paused {
+				// Peers already known keep the swarm working through PEX, so the tracker being down is not fatal
+				report(KeepAlive(client, url, id, swarmId, ip, ip6, port, left()))
+			}
 			timer.Reset(tracker.ALIVE_TIMER - 15*time.Second)
 		case msg := <-chanTracker:
 			switch msg.Opcode {
 			case messages.TRACKER_COMPLETED:
-				DownloadCompleted(url, id, swarmId, ip, port, verbosity)
-				chanTracker <- messages.ControlMessage{
-					Opcode:  messages.EXIT,
-					PeerId:  "",
-					Payload: nil,
-				}
+				report(DownloadCompleted(client, url, id, swarmId, ip, ip6, port))
 			case messages.TRACKER_STOPPED:
-				DownloadStopped(url, id, swarmId, ip, port, verbosity)
-				chanTracker <- messages.ControlMessage{
-					Opcode:  messages.EXIT,
-					PeerId:  "",
-					Payload: nil,
+				report(DownloadStopped(client, url, id, swarmId, ip, ip6, port))
+			case messages.PAUSE:
+				report(DownloadStopped(client, url, id, swarmId, ip, ip6, port))
+				paused = true
+				continue
+			case messages.RESUME:
+				report(Resumed(client, url, id, swarmId, ip, ip6, port, left(), chanDiscovery))
+				paused = false
+				continue
+			case messages.TRACKER_SEEDING:
+				if !paused {
+					report(KeepAlive(client, url, id, swarmId, ip, ip6, port, left()))
 				}
+				continue
 			}
+			wait.Done()
 			return
 		}
 	}
 }
 
-func KeepAlive(url, id, swarmId, ip, port string, verbosity int) {
-	urlParameters := url + fmt.Sprintf(
-		"/announce?peerId=%s&swarmId=%s&ip=%s&port=%s&event=alive",
-		id, swarmId, ip, port)
-
-	utils.PrintVerbose(verbosity, utils.DEBUG, "Keeping Alive: ", urlParameters)
-	_, err := http.Get(urlParameters)
-	utils.Check(err, verbosity, "Error: keep alive failed!")
+// Enters the swarm again after a pause, sending the peers in it to chanDiscovery
+func Resumed(client *http.Client, url, id, swarmId, ip, ip6, port string, left int64, chanDiscovery chan tracker.Peer) error {
+	if url == "" { // Trackerless torrent
+		return nil
+	}
+	swarm, err := GetTrackerInfo(client, url, id, swarmId, ip, ip6, port, left)
+	if err != nil {
+		return fmt.Errorf("announce after resume failed: %w", err)
+	}
+	for _, peer := range swarm.Peers {
+		if peer.Id == id {
+			continue
+		}
+		select {
+		case chanDiscovery <- peer:
+		default: // Discovery is full of peers already
+		}
+	}
+	return nil
 }
 
-func DownloadCompleted(url, id, swarmId, ip, port string, verbosity int) {
-	urlParameters := url + fmt.Sprintf(
-		"/announce?peerId=%s&swarmId=%s&ip=%s&port=%s&event=completed",
-		id, swarmId, ip, port)
+func KeepAlive(client *http.Client, url, id, swarmId, ip, ip6, port string, left int64) error {
+	if url == "" { // Trackerless torrent
+		return nil
+	}
+	urlParameters := AnnounceUrl(url, id, swarmId, ip, ip6, port, "alive", left)
+	logger.Debug("Keeping alive", logging.Swarm(swarmId), "url", urlParameters)
+	return announce(client, urlParameters, "keep alive")
+}
 
-	_, err := http.Get(urlParameters)
-	utils.Check(err, verbosity, "Error: download completed failed!")
+func DownloadCompleted(client *http.Client, url, id, swarmId, ip, ip6, port string) error {
+	if url == "" { // Trackerless torrent
+		return nil
+	}
+	return announce(client, AnnounceUrl(url, id, swarmId, ip, ip6, port, "completed", 0), "download completed")
 }
 
-func DownloadStopped(url, id, swarmId, ip, port string, verbosity int) {
-	urlParameters := url + fmt.Sprintf(
-		"/announce?peerId=%s&swarmId=%s&ip=%s&port=%s&event=stopped",
-		id, swarmId, ip, port)
+func DownloadStopped(client *http.Client, url, id, swarmId, ip, ip6, port string) error {
+	if url == "" { // Trackerless torrent
+		return nil
+	}
+	return announce(client, AnnounceUrl(url, id, swarmId, ip, ip6, port, "stopped", -1), "download stopped")
+}
 
-	_, err := http.Get(urlParameters)
-	utils.Check(err, verbosity, "Error: download stopped failed!")
+// Sends an announce whose answer is not needed
+func announce(client *http.Client, urlParameters, event string) error {
+	response, err := client.Get(urlParameters)
+	if err != nil {
+		return fmt.Errorf("%s announce failed: %w", event, err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s announce failed: tracker answered %s", event, response.Status)
+	}
+	return nil
 }
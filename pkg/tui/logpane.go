@@ -0,0 +1,41 @@
+package tui
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var ESCAPE_CODE = regexp.MustCompile("\033\\[[0-9;?]*[A-Za-z]|\r")
+
+// Keeps the last lines written to it, without escape codes, for the log pane
+type logPane struct {
+	lock    sync.Mutex
+	lines   []string
+	size    int
+	partial string // Written after the last newline
+}
+
+func newLogPane(size int) *logPane {
+	return &logPane{size: size}
+}
+
+func (l *logPane) Write(data []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	text := l.partial + ESCAPE_CODE.ReplaceAllString(string(data), "")
+	lines := strings.Split(text, "\n")
+	l.partial = lines[len(lines)-1]
+	l.lines = append(l.lines, lines[:len(lines)-1]...)
+	if len(l.lines) > l.size {
+		l.lines = l.lines[len(l.lines)-l.size:]
+	}
+	return len(data), nil
+}
+
+// Copy of the last lines, oldest first
+func (l *logPane) Lines() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]string(nil), l.lines...)
+}
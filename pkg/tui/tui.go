@@ -0,0 +1,347 @@
+package tui
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rafaelbarbeta/MicroTorr/pkg/control"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/core"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/logging"
+	"github.com/rafaelbarbeta/MicroTorr/pkg/microtorr"
+	"golang.org/x/term"
+)
+
+/*
+Full screen view of a running torrent, drawn with ANSI escape codes.
+
+	Shows a map of the pieces coloured by state and by how many peers have
+	them, the connected peers, the tracker status, the totals and the last
+	log lines. Everything is redrawn every REFRESH_INTERVAL from a snapshot
+	of the torrent, so nothing shared with core is read directly
+*/
+
+const (
+	REFRESH_INTERVAL = 500 * time.Millisecond
+	LOG_LINES        = 5
+	DEFAULT_WIDTH    = 80 // When the size of the terminal is unknown
+	DEFAULT_HEIGHT   = 24
+	RARE_PEERS       = 1 // Missing pieces at most this many peers have are rare
+	COMMON_PEERS     = 4 // Missing pieces at least this many peers have are common
+)
+
+// Escape codes
+const (
+	ENTER  = "\033[?1049h\033[?25l" // Alternate screen, hidden cursor
+	LEAVE  = "\033[?25h\033[?1049l"
+	HOME   = "\033[H"
+	CLEAR  = "\033[K"  // Rest of the line
+	BOTTOM = "\033[J"  // Rest of the screen
+	RESET  = "\033[0m" // Colours
+	BOLD   = "\033[1m"
+)
+
+// States of the cells of the piece map. A cell with many pieces shows the state of its least available missing piece
+const (
+	CELL_HAVE        = iota
+	CELL_RARE        // Missing, at most RARE_PEERS have it
+	CELL_AVAILABLE   // Missing, fewer than COMMON_PEERS have it
+	CELL_COMMON      // Missing, at least COMMON_PEERS have it
+	CELL_UNAVAILABLE // Missing, no peer has it
+	CELL_SKIPPED     // Missing and not wanted
+)
+
+var CELL_COLOURS = []string{
+	"\033[32m", // Green
+	"\033[33m", // Yellow
+	"\033[36m", // Cyan
+	"\033[34m", // Blue
+	"\033[31m", // Red
+	"\033[90m", // Grey
+}
+
+var CELL_SYMBOLS = []string{"█", "▒", "▒", "▒", "░", "·"}
+
+var CELL_NAMES = []string{"have", "rare", "available", "common", "no peer", "skipped"}
+
+var ErrNoTerminal = errors.New("the TUI needs a terminal")
+
+// Whether stdout is a terminal the TUI can be drawn on
+func IsTerminal() bool {
+	return term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+/*
+Draws the torrent of client until it leaves the swarm.
+
+	Pressing q or Ctrl-C calls stop, and p pauses or resumes the torrent.
+	Logs printed to the terminal are shown in the log pane instead while
+	the TUI runs
+*/
+func Run(client *microtorr.Client, stop func()) error {
+	if !IsTerminal() {
+		return ErrNoTerminal
+	}
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+	logs := newLogPane(LOG_LINES)
+	if logging.Terminal() {
+		logging.SetHandler(logging.NewConsoleHandler(logs))
+		defer logging.SetHandler(logging.NewConsoleHandler(os.Stdout))
+	}
+	keys := make(chan byte, 16)
+	stdin := int(os.Stdin.Fd())
+	if term.IsTerminal(stdin) {
+		state, err := term.MakeRaw(stdin)
+		if err == nil {
+			defer term.Restore(stdin, state)
+			// Blocked reading until the process exits
+			go readKeys(keys)
+		}
+	}
+	os.Stdout.WriteString(ENTER)
+	defer os.Stdout.WriteString(LEAVE)
+
+	ticker := time.NewTicker(REFRESH_INTERVAL)
+	defer ticker.Stop()
+	stopping := false
+	for {
+		info := client.Info()
+		width, height, err := term.GetSize(int(os.Stdout.Fd()))
+		if err != nil || width <= 0 || height <= 0 {
+			width, height = DEFAULT_WIDTH, DEFAULT_HEIGHT
+		}
+		os.Stdout.WriteString(draw(info, client.Snapshot(), logs.Lines(), stopping, width, height))
+		select {
+		case <-ticker.C:
+		case <-done:
+			return nil
+		case key := <-keys:
+			switch key {
+			case 'q', 'Q', 3: // Ctrl-C does not send SIGINT in raw mode
+				if !stopping {
+					stopping = true
+					go stop()
+				}
+			case 'p', 'P':
+				if info.Paused {
+					err = client.Resume()
+				} else {
+					err = client.Pause(false)
+				}
+				if err != nil {
+					logs.Write([]byte("Error: " + err.Error() + "\n"))
+				}
+			}
+		}
+	}
+}
+
+func readKeys(keys chan byte) {
+	buffer := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buffer)
+		if err != nil {
+			return
+		}
+		for _, key := range buffer[:n] {
+			select {
+			case keys <- key:
+			default: // Keys pressed faster than handled
+			}
+		}
+	}
+}
+
+// The whole screen, from the top left corner
+func draw(info control.TorrentInfo, snapshot core.Snapshot, logs []string, stopping bool, width, height int) string {
+	lines := make([]string, 0, height)
+	add := func(text string) {
+		lines = append(lines, fit(text, width))
+	}
+
+	state := "downloading"
+	switch {
+	case stopping:
+		state = "stopping"
+	case info.Paused:
+		state = "paused"
+	case info.Seeding:
+		state = "seeding"
+	}
+	id := info.Id[:min(len(info.Id), 10)]
+	add(BOLD + fmt.Sprintf("MicroTorr  %s  %s  [%s]", info.Name, id, state) + RESET)
+	seeders := 0
+	for _, peer := range snapshot.Peers {
+		if peer.Seeder {
+			seeders++
+		}
+	}
+	add(fmt.Sprintf("Progress %.1f%%  Down %s/s  Up %s/s  Downloaded %s  Uploaded %s  Peers %d  Seeders %d",
+		info.Progress, formatBytes(info.DownRate), formatBytes(info.UpRate),
+		formatBytes(float64(info.Downloaded)), formatBytes(float64(info.Uploaded)), len(snapshot.Peers), seeders))
+	add(trackerStatus(snapshot))
+	add("")
+
+	// Rows left once the fixed lines are drawn are shared by the piece map and the peer table
+	fixed := len(lines) + 1 + 1 + 2 + 1 + 1 + LOG_LINES + 1
+	free := max(height-fixed, 2)
+	mapRows := max(min((len(snapshot.Have)+width-1)/width, free/2), 1)
+	peerRows := max(free-mapRows, 1)
+
+	legend := fmt.Sprintf("Pieces %d ", len(snapshot.Have))
+	for state, name := range CELL_NAMES {
+		legend += " " + CELL_COLOURS[state] + CELL_SYMBOLS[state] + RESET + " " + name
+	}
+	add(legend)
+	lines = append(lines, pieceMap(snapshot, width, mapRows)...)
+	add("")
+
+	add(fmt.Sprintf("Peers (%d)", len(snapshot.Peers)))
+	add(fmt.Sprintf("%-20s  %-21s  %12s  %12s  %6s  %6s  %6s", "ID", "ADDRESS", "DOWN", "UP", "SEEDER", "CHOKED", "PIECES"))
+	for i, peer := range snapshot.Peers {
+		if i == peerRows-1 && len(snapshot.Peers) > peerRows {
+			add(fmt.Sprintf("... and %d more", len(snapshot.Peers)-i))
+			break
+		}
+		add(fmt.Sprintf("%-20s  %-21s  %10s/s  %10s/s  %6s  %6s  %5.1f%%",
+			peer.Id, peer.Addr, formatBytes(peer.DownRate), formatBytes(peer.UpRate),
+			yesNo(peer.Seeder), yesNo(peer.Choked), float64(peer.Pieces)/float64(max(len(snapshot.Have), 1))*100))
+	}
+	for i := len(snapshot.Peers); i < peerRows; i++ {
+		add("")
+	}
+	add("")
+
+	add("Log")
+	for i := len(logs); i < LOG_LINES; i++ {
+		add("")
+	}
+	for _, line := range logs {
+		add(line)
+	}
+	add("q quit  p pause/resume")
+
+	var screen strings.Builder
+	screen.WriteString(HOME)
+	for i, line := range lines[:min(len(lines), height)] {
+		if i > 0 {
+			screen.WriteString("\r\n")
+		}
+		screen.WriteString(line + CLEAR)
+	}
+	screen.WriteString(BOTTOM)
+	return screen.String()
+}
+
+func trackerStatus(snapshot core.Snapshot) string {
+	switch {
+	case snapshot.Tracker == "":
+		return "Tracker none"
+	case snapshot.TrackerErr != nil:
+		return fmt.Sprintf("Tracker %s  error: %v", snapshot.Tracker, snapshot.TrackerErr)
+	case snapshot.LastAnnounce.IsZero():
+		return fmt.Sprintf("Tracker %s  not announced yet", snapshot.Tracker)
+	}
+	return fmt.Sprintf("Tracker %s  ok, last announce %s ago", snapshot.Tracker, time.Since(snapshot.LastAnnounce).Truncate(time.Second))
+}
+
+/*
+Rows of cells showing the state of the pieces.
+
+	Each cell shows one piece, or several consecutive pieces when there
+	are more pieces than cells
+*/
+func pieceMap(snapshot core.Snapshot, width, rows int) []string {
+	pieces := len(snapshot.Have)
+	if pieces == 0 {
+		return []string{""}
+	}
+	perCell := (pieces + width*rows - 1) / (width * rows)
+	cells := (pieces + perCell - 1) / perCell
+	lines := make([]string, 0, rows)
+	var line strings.Builder
+	for cell := 0; cell < cells; cell++ {
+		if cell > 0 && cell%width == 0 {
+			lines = append(lines, line.String()+RESET)
+			line.Reset()
+		}
+		state := cellState(snapshot, cell*perCell, min((cell+1)*perCell, pieces))
+		line.WriteString(CELL_COLOURS[state] + CELL_SYMBOLS[state])
+	}
+	return append(lines, line.String()+RESET)
+}
+
+func cellState(snapshot core.Snapshot, from, to int) int {
+	state := CELL_HAVE
+	fewest := -1 // Peers with the least available missing piece
+	for i := from; i < to; i++ {
+		if snapshot.Have[i] {
+			continue
+		}
+		if snapshot.Priorities[i] == core.PRIORITY_SKIP {
+			if state == CELL_HAVE {
+				state = CELL_SKIPPED
+			}
+			continue
+		}
+		if fewest < 0 || snapshot.Availability[i] < fewest {
+			fewest = snapshot.Availability[i]
+		}
+	}
+	switch {
+	case fewest < 0:
+		return state
+	case fewest == 0:
+		return CELL_UNAVAILABLE
+	case fewest <= RARE_PEERS:
+		return CELL_RARE
+	case fewest < COMMON_PEERS:
+		return CELL_AVAILABLE
+	}
+	return CELL_COMMON
+}
+
+// Cuts text to width runes, not counting escape codes
+func fit(text string, width int) string {
+	var fitted strings.Builder
+	visible := 0
+	escape := false
+	for _, r := range text {
+		switch {
+		case r == '\033':
+			escape = true
+		case escape:
+			escape = !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z')
+		case visible == width:
+			return fitted.String() + RESET
+		default:
+			visible++
+		}
+		fitted.WriteRune(r)
+	}
+	return fitted.String()
+}
+
+// In B, KB, MB or GB, with powers of 1000 as the KB/s of the speed limits
+func formatBytes(bytes float64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	unit := 0
+	for bytes >= 1000 && unit < len(units)-1 {
+		bytes /= 1000
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", bytes, units[unit])
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
@@ -5,63 +5,11 @@ import (
 	"math"
 	"math/rand"
 	"net"
-	"os"
 	"sort"
-	"strings"
+	"strconv"
 	"time"
-
-	"github.com/mitchellh/colorstring"
-)
-
-// Verbosity levels for PrintVerbose
-const (
-	CRITICAL    = -1 // Always print
-	DEBUG       = 3  // Print if verbose 3
-	INFORMATION = 2  // Print if verbose 2
-	VERBOSE     = 1  // Peint if verbose 1
 )
 
-func Check(e error, verbosity int, message ...string) {
-	if e != nil {
-		fmt.Println(strings.Join(message, " "))
-		if verbosity >= DEBUG {
-			panic(e)
-		} else {
-			os.Exit(-1)
-		}
-	}
-}
-
-func PrintVerbose(verbosity, priority int, message ...interface{}) {
-	if verbosity < priority {
-		return
-	}
-
-	var sb strings.Builder
-	switch priority {
-	case CRITICAL:
-		sb.WriteString(colorstring.Color("[red][CRITICAL]: "))
-	case DEBUG:
-		sb.WriteString(colorstring.Color("[green][DEBUG]: "))
-	case INFORMATION:
-		sb.WriteString(colorstring.Color("[yellow][INFORMATION]: "))
-	case VERBOSE:
-		sb.WriteString(colorstring.Color("[blue][VERBOSE]: "))
-	default:
-		sb.WriteString(colorstring.Color("[blue][VERBOSE]: "))
-	}
-	for _, m := range message {
-		sb.WriteString(fmt.Sprintf("%v", m))
-	}
-
-	clearLine()
-	fmt.Println(sb.String())
-}
-
-func clearLine() {
-	fmt.Print("\033[2K\r")
-}
-
 // GenerateRandomString generates a random string of length n
 func GenerateRandomString(n int) string {
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
@@ -73,37 +21,58 @@ func GenerateRandomString(n int) string {
 	return string(b)
 }
 
-// GetIP returns the IP address for the default route in this host
-func GetDefaultRouteIP() (string, error) {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		return "", err
-	}
-	defer conn.Close()
-
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	return localAddr.IP.String(), nil
-}
+/*
+GetInterfaceIPs returns the IPv4 and IPv6 addresses of a network interface.
 
-// GetInterfaceIP returns the IP address of a network interface
-func GetInterfaceIP(name string) (string, error) {
+	Link local IPv6 addresses are skipped, as they need a zone to be dialed.
+	Only fails if the interface has neither
+*/
+func GetInterfaceIPs(name string) (string, string, error) {
+	var ip4, ip6 string
 	iface, err := net.InterfaceByName(name)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	addrs, err := iface.Addrs()
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	for _, addr := range addrs {
 		switch v := addr.(type) {
 		case *net.IPNet:
 			if v.IP.To4() != nil {
-				return v.IP.String(), nil
+				if ip4 == "" {
+					ip4 = v.IP.String()
+				}
+			} else if ip6 == "" && !v.IP.IsLinkLocalUnicast() {
+				ip6 = v.IP.String()
 			}
 		}
 	}
-	return "", fmt.Errorf("no IPv4 address found for interface %s", name)
+	if ip4 == "" && ip6 == "" {
+		return "", "", fmt.Errorf("no IP address found for interface %s", name)
+	}
+	return ip4, ip6, nil
+}
+
+// IsLocalIP returns whether ip is assigned to one of this host's interfaces
+func IsLocalIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	addrs, err := net.InterfaceAddrs()
+	if parsed == nil || err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// JoinHostPort builds a host:port address, with brackets for IPv6 literals
+func JoinHostPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
 }
 
 func MinWithExclusion(values []int, exclude []bool) int {